@@ -1,11 +1,59 @@
 package common
 
-import "darknes/nes"
+import (
+	"image"
 
-type CpuEmulator interface {
-	Step() nes.CpuState
+	"darknes/nes"
+)
+
+type Emulator interface {
+	StepInstruction() nes.CpuState
+	StepFrame() nes.CpuState
+	Frame() *image.RGBA
+}
+
+type DiskDrive interface {
+	SideCount() int
+	CurrentSide() int
+	SwitchSide()
+}
+
+type MusicPlayer interface {
+	Title() string
+	Artist() string
+	Track() int
+	TrackCount() int
+	TrackName() string
+	NextTrack()
+	PrevTrack()
+	Volume() float32
+}
+
+type AudioSource interface {
+	Samples() []float32
+	SetRateAdjust(ratio float64)
+	SetMasterVolume(volume float32)
+}
+
+type AudioRecorder interface {
+	Write() error
+	Close() error
+}
+
+type StateSlots interface {
+	SaveState(slot int) error
+	LoadState(slot int) error
+}
+
+type Resetter interface {
+	Reset(hard bool)
+}
+
+type Joypad interface {
+	SetButton(button int, pressed bool)
 }
 
-type PpuEmulator interface {
-	Step(cycles uint16)
+type LightGun interface {
+	Aim(x, y int)
+	SetTrigger(pulled bool)
 }
@@ -1,38 +1,406 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
+	"darknes/common"
 	"darknes/nes"
 	"darknes/ui"
 )
 
+// Input devices selectable with -device
+var deviceNames = map[string]byte{
+	"standard":      nes.ExpansionStandard,
+	"fourscore":     nes.ExpansionFourScore,
+	"zapper":        nes.ExpansionZapper,
+	"powerpad":      nes.ExpansionPowerPadB,
+	"familytrainer": nes.ExpansionFamilyTrainerB,
+	"vaus":          nes.ExpansionVaus,
+	"vaus-famicom":  nes.ExpansionVausFamicom,
+	"keyboard":      nes.ExpansionFamilyBASIC,
+}
+
 func main() {
-	if len(os.Args) < 2 {
+	// darknes run --headless emulates without a window
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		os.Exit(runCommand(os.Args[2:]))
+	}
+
+	patchPath := flag.String("patch", "", "IPS, UPS or BPS patch to apply to the ROM")
+	entry := flag.String("entry", "", "ROM file to load from zip archive with several ROMs")
+	gameDBPath := flag.String("gamedb", "", "additional game database in NES 2.0 DB XML format")
+	keys := [4]*string{
+		flag.String("keys", "", "keyboard bindings of player 1, e.g. a=S,b=A,start=Space"),
+		flag.String("keys2", "", "keyboard bindings of player 2"),
+		flag.String("keys3", "", "keyboard bindings of player 3 (Four Score)"),
+		flag.String("keys4", "", "keyboard bindings of player 4 (Four Score)"),
+	}
+	device := flag.String("device", "", "input device overriding NES 2.0 header: "+strings.Join(deviceList(), ", "))
+	fourScore := flag.Bool("fourscore", false, "plug Four Score adapter with four controllers, same as -device fourscore")
+	padMaps := flag.String("padmap", "", "gamepad bindings by pad name or GUID, e.g. \"Xbox Controller:a=b,b=a\"")
+	deadzone := flag.Float64("deadzone", 0.3, "analog stick deadzone as a fraction of its range")
+	zapper := flag.Bool("zapper", false, "plug Zapper light gun controlled by mouse into port 2, same as -device zapper")
+	playMovie := flag.String("movie", "", "play input movie in FCEUX FM2 format")
+	recordMovie := flag.String("record-movie", "", "record input from power on to FM2 movie")
+	recordFromState := flag.Int("record-from-state", 0, "start the recorded movie from save state slot 1-10 instead of power on")
+	region := flag.String("region", "", "console region overriding the ROM header: ntsc, pal or dendy")
+	trace := flag.Bool("trace", false, "print every executed CPU instruction")
+	recordAudio := flag.String("record-audio", "", "record audio to WAV file (F12 toggles recording)")
+	recordChannels := flag.Bool("record-channels", false, "also record every APU channel to its own WAV file")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
 		fmt.Println("No rom file specified")
 		return
 	}
-	path := os.Args[1]
-	romData, err := os.ReadFile(path)
+	if *gameDBPath != "" {
+		if err := loadGameDB(*gameDBPath); err != nil {
+			fmt.Println("Failed to load game database:", err)
+			os.Exit(1)
+		}
+	}
+	path := flag.Arg(0)
+	r, err := loadRom(path, *entry, *patchPath)
 	if err != nil {
-		panic(err)
+		fmt.Println("Failed to load ROM:", err)
+		os.Exit(1)
 	}
+	for _, fix := range r.Header.Fixes {
+		fmt.Println("Header corrected by game database:", fix)
+	}
+	consoleRegion, err := selectRegion(r, *region)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	console := nes.NewRegionConsole(r, consoleRegion)
+	fmt.Println("Region:", console.Region())
+	mem := console.Memory()
+	cpu := console.CPU()
+	cpu.SetTrace(*trace)
 
-	r := nes.LoadRomData(romData)
-	mem := r.Load()
-	cpu := nes.InitCPU(mem)
-	ppu := nes.InitPPU(cpu)
-	cpu.Reset()
-	ppu.Reset()
+	inputDevice := r.Header.ExpansionDevice()
+	switch {
+	case *device != "":
+		var ok bool
+		if inputDevice, ok = deviceNames[*device]; !ok {
+			fmt.Printf("Unknown input device %s, use one of: %s\n", *device, strings.Join(deviceList(), ", "))
+			os.Exit(1)
+		}
+	case *fourScore:
+		inputDevice = nes.ExpansionFourScore
+	case *zapper:
+		inputDevice = nes.ExpansionZapper
+	}
+
+	// Restore battery-backed memory from the save file next to the ROM
+	savePath := strings.TrimSuffix(path, filepath.Ext(path)) + ".sav"
+	battery, hasBattery := mem.Mapper().(nes.Battery)
+	hasBattery = hasBattery && r.Header.HasBattery
+	if hasBattery {
+		if saveData, err := os.ReadFile(savePath); err == nil {
+			battery.LoadSaveData(saveData)
+		}
+	}
 
 	fmt.Printf("Init state: A=%x, X=%x, Y=%x, S=%x, P=%b, PC=%x\n",
 		cpu.A, cpu.X, cpu.Y, cpu.S, cpu.P, cpu.PC)
 
-	sdlFrontend := ui.CreateFrontend(cpu, ppu)
+	player := console.NsfPlayer()
+	if r.Nsf != nil {
+		if chips := r.Nsf.UnsupportedChips(); len(chips) > 0 {
+			fmt.Println("Expansion chips not emulated, their channels are silent:", strings.Join(chips, ", "))
+		}
+	}
+	mixer := console.Audio()
+
+	sdlFrontend := ui.CreateFrontend(console)
+	sdlFrontend.AttachAudio(mixer)
+	sdlFrontend.SetFrameRate(console.Region().FrameRate())
+	pads := plugInput(console, inputDevice, sdlFrontend)
+	slots := &stateSlots{console: console, base: strings.TrimSuffix(path, filepath.Ext(path))}
+	resetter := &resetButton{console: console}
+	var movie *nes.Movie
+	switch {
+	case *playMovie != "":
+		if movie, err = loadMovie(*playMovie); err != nil {
+			fmt.Println("Failed to load movie:", err)
+			os.Exit(1)
+		}
+		if movie.RomChecksum != r.MD5 {
+			fmt.Println("Movie was recorded with a different ROM, playback may desync")
+		}
+		if movie.PAL != (console.Region() == nes.RegionPAL) {
+			fmt.Println("Movie was recorded in a different region, playback may desync")
+		}
+		if movie.FourScore != (len(pads) == 4) {
+			fmt.Println("Movie was recorded with different controllers, playback may desync")
+		}
+		if _, err := console.PlayMovie(movie, pads); err != nil {
+			fmt.Println("Failed to play movie:", err)
+			os.Exit(1)
+		}
+		// Movie input replaces keyboard and gamepads
+		for player := range pads {
+			sdlFrontend.AttachController(player, nil)
+		}
+	case *recordMovie != "":
+		movie = nes.NewMovie(r, filepath.Base(path))
+		movie.PAL = console.Region() == nes.RegionPAL
+		movie.FourScore = len(pads) == 4
+		movie.Ports[1] = len(pads) > 1
+		source := make([]*nes.Controller, len(pads))
+		for player := range pads {
+			source[player] = nes.NewController()
+			sdlFrontend.AttachController(player, source[player])
+		}
+		if *recordFromState != 0 {
+			if err := slots.LoadState(*recordFromState); err != nil {
+				fmt.Println("Failed to load save state:", err)
+				os.Exit(1)
+			}
+		}
+		// Resets are recorded into the movie to replay them
+		if resetter.recorder, err = console.RecordMovie(movie, source, pads, *recordFromState != 0); err != nil {
+			fmt.Println("Failed to record movie:", err)
+			os.Exit(1)
+		}
+	}
+	for player, spec := range keys {
+		if *spec == "" {
+			continue
+		}
+		keyMap := ui.KeyMap{}
+		if player == 0 {
+			keyMap = ui.DefaultKeyMap()
+		}
+		if err := keyMap.Parse(*spec); err != nil {
+			fmt.Printf("Bad key bindings of player %d: %v\n", player+1, err)
+			os.Exit(1)
+		}
+		sdlFrontend.SetKeyMap(player, keyMap)
+	}
+	if *padMaps != "" {
+		maps, err := ui.ParsePadMaps(*padMaps)
+		if err != nil {
+			fmt.Println("Bad gamepad bindings:", err)
+			os.Exit(1)
+		}
+		sdlFrontend.SetPadMaps(maps)
+	}
+	sdlFrontend.SetDeadzone(float32(*deadzone))
+	sdlFrontend.AttachAudioRecorder(func() (common.AudioRecorder, error) {
+		name := strings.TrimSuffix(path, filepath.Ext(path)) + time.Now().Format("-20060102-150405.wav")
+		fmt.Println("Recording audio to", name)
+		return nes.NewAudioRecorder(name, mixer, *recordChannels)
+	})
+	if *recordAudio != "" {
+		recorder, err := nes.NewAudioRecorder(*recordAudio, mixer, *recordChannels)
+		if err != nil {
+			fmt.Println("Failed to start recording:", err)
+			os.Exit(1)
+		}
+		sdlFrontend.RecordAudio(recorder)
+	}
+	if player != nil {
+		sdlFrontend.AttachMusicPlayer(player)
+	}
+	if disk, ok := mem.Mapper().(*nes.FDS); ok {
+		sdlFrontend.AttachDiskDrive(disk)
+	}
+	// Loading a state would desync the movie from its input
+	if movie == nil {
+		sdlFrontend.AttachStateSlots(slots)
+	}
+	// Played movies carry their own resets
+	if *playMovie == "" {
+		sdlFrontend.AttachResetter(resetter)
+	}
 
 	// Start emulator frontend
-	if err := sdlFrontend.RunSdlLoop(); err != nil {
+	if err = sdlFrontend.RunSdlLoop(); err != nil {
+		fmt.Println("Emulation stopped:", err)
+	}
+
+	if *recordMovie != "" {
+		if err := saveMovie(*recordMovie, movie); err != nil {
+			fmt.Println("Failed to write movie:", err)
+		}
+	}
+	if hasBattery {
+		// Mapper is replaced when the console is power cycled
+		battery := mem.Mapper().(nes.Battery)
+		if err := os.WriteFile(savePath, battery.SaveData(), 0644); err != nil {
+			fmt.Println("Failed to write save file:", err)
+		}
+	}
+	if err != nil {
 		os.Exit(1)
 	}
 }
+
+// deviceList returns sorted names of -device values
+func deviceList() []string {
+	names := make([]string, 0, len(deviceNames))
+	for name := range deviceNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// plugInput connects controllers and the given NES 2.0 expansion device
+// to the console and lets the frontend drive them. Standard controllers
+// stay in the ports the device does not occupy, they are returned
+// in the order of players
+func plugInput(console *nes.Console, device byte, frontend *ui.SdlFrontend) []*nes.Controller {
+	mem := console.Memory()
+	pads := console.ConnectControllers(device == nes.ExpansionFourScore)
+	for player, pad := range pads {
+		frontend.AttachController(player, pad)
+	}
+
+	switch device {
+	case nes.ExpansionZapper:
+		gun := nes.NewZapper(console.PPU())
+		mem.ConnectInput(1, gun)
+		frontend.AttachLightGun(gun)
+		frontend.AttachController(1, nil)
+		pads = pads[:1]
+	case nes.ExpansionVaus:
+		paddle := nes.NewVaus()
+		mem.ConnectInput(1, paddle)
+		frontend.AttachLightGun(paddle)
+		frontend.AttachController(1, nil)
+		pads = pads[:1]
+	case nes.ExpansionVausFamicom:
+		paddle := nes.NewVaus()
+		mem.ConnectExpansion(paddle)
+		frontend.AttachLightGun(paddle)
+	case nes.ExpansionPowerPadA, nes.ExpansionPowerPadB:
+		mat := nes.NewPowerPad()
+		mem.ConnectInput(1, mat)
+		frontend.AttachKeyboardDevice(mat, ui.DefaultMatKeyMap())
+		frontend.AttachController(1, nil)
+		pads = pads[:1]
+	case nes.ExpansionFamilyTrainerA, nes.ExpansionFamilyTrainerB:
+		mat := nes.NewPowerPad()
+		mem.ConnectExpansion(mat)
+		frontend.AttachKeyboardDevice(mat, ui.DefaultMatKeyMap())
+	case nes.ExpansionFamilyBASIC:
+		// Whole keyboard types, player 1 is left to gamepads
+		keyboard := nes.NewFamilyKeyboard()
+		mem.ConnectExpansion(keyboard)
+		frontend.AttachKeyboardDevice(keyboard, ui.FamilyKeyboardKeyMap())
+		frontend.SetKeyMap(0, ui.KeyMap{})
+	}
+	return pads
+}
+
+// loadRom reads cartridge or disk image at the given path,
+// unpacking it from zip or gzip archive, and applies patch to it
+func loadRom(path string, entry string, patchPath string) (*nes.Rom, error) {
+	return nes.LoadRomFile(path, nes.LoadOptions{
+		Entry: entry,
+		Patch: patchPath,
+		Log:   func(msg string) { fmt.Println(msg) },
+	})
+}
+
+// loadGameDB adds games from the database file to the bundled ones
+func loadGameDB(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := nes.LoadGameDB(data); err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// loadMovie reads FM2 movie file
+func loadMovie(path string) (*nes.Movie, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	movie, err := nes.ReadFM2(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	return movie, nil
+}
+
+// saveMovie writes recorded movie in FM2 format
+func saveMovie(path string, movie *nes.Movie) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := movie.WriteFM2(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// stateSlots keeps save states in files next to the ROM
+type stateSlots struct {
+	console *nes.Console
+	base    string
+}
+
+func (s *stateSlots) path(slot int) string {
+	return fmt.Sprintf("%s.ss%d", s.base, slot)
+}
+
+// SaveState writes snapshot of the console into the slot file
+func (s *stateSlots) SaveState(slot int) error {
+	f, err := os.Create(s.path(slot))
+	if err != nil {
+		return err
+	}
+	if err := s.console.SaveState(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadState restores snapshot from the slot file
+func (s *stateSlots) LoadState(slot int) error {
+	f, err := os.Open(s.path(slot))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.console.LoadState(f)
+}
+
+// resetButton resets the console between frames, recording
+// the reset into the movie being recorded
+type resetButton struct {
+	console  *nes.Console
+	recorder *nes.MovieRecorder
+}
+
+// Reset soft resets or power cycles the console
+func (r *resetButton) Reset(hard bool) {
+	command := nes.MovieSoftReset
+	if hard {
+		command = nes.MovieHardReset
+	}
+	if r.recorder != nil {
+		r.recorder.Command(command)
+	} else {
+		r.console.MovieCommand(command)
+	}
+}
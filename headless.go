@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image/png"
+	"os"
+	"strings"
+
+	"darknes/nes"
+)
+
+// runCommand handles "darknes run": emulates the ROM for a number of
+// frames without opening a window and dumps the results to files.
+// Returns exit status, nonzero when the CPU jams or emulation fails
+func runCommand(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	headless := fs.Bool("headless", false, "run without window, sound output and input devices")
+	frames := fs.Int("frames", 600, "number of frames to emulate")
+	screenshot := fs.String("screenshot", "", "write the last frame to PNG file")
+	ramDump := fs.String("ram-dump", "", "write 2 KB of console RAM to file")
+	audioPath := fs.String("audio", "", "write sound to WAV file")
+	fs.StringVar(audioPath, "record-audio", "", "same as -audio")
+	recordChannels := fs.Bool("record-channels", false, "also write every APU channel to its own WAV file")
+	playMovie := fs.String("movie", "", "feed controller input from FM2 movie")
+	region := fs.String("region", "", "console region overriding the ROM header: ntsc, pal or dendy")
+	patchPath := fs.String("patch", "", "IPS, UPS or BPS patch to apply to the ROM")
+	entry := fs.String("entry", "", "ROM file to load from zip archive with several ROMs")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if !*headless {
+		fmt.Println("run supports only --headless mode, start darknes without run to open a window")
+		return 2
+	}
+	if fs.NArg() < 1 {
+		fmt.Println("No rom file specified")
+		return 2
+	}
+
+	r, err := loadRom(fs.Arg(0), *entry, *patchPath)
+	if err != nil {
+		fmt.Println("Failed to load ROM:", err)
+		return 1
+	}
+	if r.Nsf != nil {
+		if chips := r.Nsf.UnsupportedChips(); len(chips) > 0 {
+			fmt.Println("Expansion chips not emulated, their channels are silent:", strings.Join(chips, ", "))
+		}
+	}
+	consoleRegion, err := selectRegion(r, *region)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	console := nes.NewRegionConsole(r, consoleRegion)
+
+	var movie *nes.Movie
+	if *playMovie != "" {
+		if movie, err = loadMovie(*playMovie); err != nil {
+			fmt.Println("Failed to load movie:", err)
+			return 1
+		}
+	}
+	pads := console.ConnectControllers(movie != nil && movie.FourScore)
+	if movie != nil {
+		if _, err := console.PlayMovie(movie, pads); err != nil {
+			fmt.Println("Failed to play movie:", err)
+			return 1
+		}
+	}
+
+	var recorder *nes.AudioRecorder
+	if *audioPath != "" {
+		if recorder, err = nes.NewAudioRecorder(*audioPath, console.Audio(), *recordChannels); err != nil {
+			fmt.Println("Failed to start recording:", err)
+			return 1
+		}
+	}
+
+	status := 0
+	err = console.RunFrames(*frames, func() error {
+		// Samples pile up in the mixer unless taken every frame
+		console.Audio().Samples()
+		if recorder != nil {
+			return recorder.Write()
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Emulation stopped:", err)
+		status = 1
+	}
+
+	// Results are written even after a jam to help finding its cause
+	if recorder != nil {
+		if err := recorder.Close(); err != nil {
+			fmt.Println("Failed to write audio:", err)
+			status = 1
+		}
+	}
+	if *screenshot != "" {
+		if err := saveScreenshot(*screenshot, console); err != nil {
+			fmt.Println("Failed to write screenshot:", err)
+			status = 1
+		}
+	}
+	if *ramDump != "" {
+		if err := os.WriteFile(*ramDump, console.Memory().RAM(), 0644); err != nil {
+			fmt.Println("Failed to write RAM dump:", err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// selectRegion returns console region given by name, or the one
+// the ROM header asks for when name is empty
+func selectRegion(r *nes.Rom, name string) (nes.Region, error) {
+	if name == "" {
+		return r.Header.Region(), nil
+	}
+	return nes.ParseRegion(name)
+}
+
+// saveScreenshot writes the last frame of the console as PNG
+func saveScreenshot(path string, console *nes.Console) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, console.Frame()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
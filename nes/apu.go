@@ -0,0 +1,333 @@
+package nes
+
+const (
+	// APU register addresses
+	APUStatus       uint16 = 0x4015
+	APUFrameCounter uint16 = 0x4017
+
+	// Frame counter steps in CPU cycles after $4017 write takes effect (NTSC)
+	frameStep1        = 7457
+	frameStep2        = 14913
+	frameStep3        = 22371
+	frameStep4        = 29829
+	frameStep4Period  = 29830
+	frameStep5        = 37281
+	frameStep5Period  = 37282
+	frameIRQFirstStep = frameStep4 - 1
+)
+
+// frameSteps is the frame counter sequence of a region
+type frameSteps struct {
+	step1, step2, step3 uint32
+	step4, step4Period  uint32
+	step5, step5Period  uint32
+}
+
+var ntscFrameSteps = frameSteps{
+	frameStep1, frameStep2, frameStep3,
+	frameStep4, frameStep4Period,
+	frameStep5, frameStep5Period,
+}
+
+var palFrameSteps = frameSteps{
+	8313, 16627, 24939,
+	33252, 33253,
+	41565, 41566,
+}
+
+// APU channels
+const (
+	ChannelPulse1 = iota
+	ChannelPulse2
+	ChannelTriangle
+	ChannelNoise
+	ChannelDMC
+)
+
+// APU is the audio processing unit of the 2A03
+type APU struct {
+	pulse1   pulse
+	pulse2   pulse
+	triangle triangle
+	noise    noise
+	dmc      dmc
+
+	// DMC sample fetches go through the CPU bus
+	mem *Memory
+	// CPU cycles stolen by DMA not yet accounted by CPU
+	stall uint16
+	// Mixers sampling channel outputs every cycle
+	mixers []*Mixer
+
+	// Frame counter position in CPU cycles
+	frameCycle uint32
+	fiveStep   bool
+	irqInhibit bool
+	frameIRQ   bool
+	// $4017 write takes effect after 3 or 4 CPU cycles
+	frameWriteDelay byte
+	frameWriteValue byte
+
+	// CPU cycle parity, pulse timers are clocked every other cycle
+	oddCycle bool
+
+	// Region timing
+	steps *frameSteps
+}
+
+// NewAPU creates APU in its power up state, DMC samples are read from mem
+func NewAPU(mem *Memory) *APU {
+	a := &APU{pulse1: pulse{onesComplement: true}, mem: mem}
+	a.noise.shift = 1
+	a.setRegion(RegionNTSC)
+	a.noise.period = a.noise.periods[0]
+	a.dmc.period = a.dmc.rates[0]
+	return a
+}
+
+// setRegion selects frame counter sequence and timer period tables
+func (a *APU) setRegion(region Region) {
+	p := region.profile()
+	a.steps = p.frameSteps
+	a.noise.periods = p.noisePeriods
+	a.dmc.rates = p.dmcRates
+}
+
+// powerOn returns APU to its power up state, mixers and region stay
+func (a *APU) powerOn() {
+	mixers, steps, periods, rates := a.mixers, a.steps, a.noise.periods, a.dmc.rates
+	*a = *NewAPU(a.mem)
+	a.mixers, a.steps, a.noise.periods, a.dmc.rates = mixers, steps, periods, rates
+	a.noise.period = periods[0]
+	a.dmc.period = rates[0]
+}
+
+// state covers channels and frame counter, region tables
+// and mixers stay as they are
+func (a *APU) state(s *stateBuffer) {
+	a.pulse1.state(s)
+	a.pulse2.state(s)
+	a.triangle.state(s)
+	a.noise.state(s)
+	a.dmc.state(s)
+	stateNum(s, &a.stall)
+	stateNum(s, &a.frameCycle)
+	s.bool(&a.fiveStep)
+	s.bool(&a.irqInhibit)
+	s.bool(&a.frameIRQ)
+	stateNum(s, &a.frameWriteDelay)
+	stateNum(s, &a.frameWriteValue)
+	s.bool(&a.oddCycle)
+}
+
+// ReadRegister reads $4015 status, other APU registers are write-only.
+// Reading status acknowledges frame IRQ
+func (a *APU) ReadRegister(addr uint16) byte {
+	if addr != APUStatus {
+		return 0
+	}
+	var status byte
+	if a.pulse1.length > 0 {
+		status |= 0x01
+	}
+	if a.pulse2.length > 0 {
+		status |= 0x02
+	}
+	if a.triangle.length > 0 {
+		status |= 0x04
+	}
+	if a.noise.length > 0 {
+		status |= 0x08
+	}
+	if a.dmc.remaining > 0 {
+		status |= 0x10
+	}
+	if a.frameIRQ {
+		status |= 0x40
+	}
+	if a.dmc.irq {
+		status |= 0x80
+	}
+	a.frameIRQ = false
+	return status
+}
+
+// WriteRegister handles writes to $4000-$4017
+func (a *APU) WriteRegister(addr uint16, val byte) {
+	switch {
+	case addr >= 0x4000 && addr <= 0x4003:
+		a.pulse1.write(addr-0x4000, val)
+	case addr >= 0x4004 && addr <= 0x4007:
+		a.pulse2.write(addr-0x4004, val)
+	case addr >= 0x4008 && addr <= 0x400B:
+		a.triangle.write(addr-0x4008, val)
+	case addr >= 0x400C && addr <= 0x400F:
+		a.noise.write(addr-0x400C, val)
+	case addr >= 0x4010 && addr <= 0x4013:
+		a.dmc.write(addr-0x4010, val)
+	case addr == APUStatus:
+		a.pulse1.setEnabled(val&0x01 != 0)
+		a.pulse2.setEnabled(val&0x02 != 0)
+		a.triangle.setEnabled(val&0x04 != 0)
+		a.noise.setEnabled(val&0x08 != 0)
+		a.dmc.setEnabled(val&0x10 != 0)
+	case addr == APUFrameCounter:
+		a.irqInhibit = val&0x40 != 0
+		if a.irqInhibit {
+			a.frameIRQ = false
+		}
+		a.frameWriteValue = val
+		a.frameWriteDelay = 3
+		if a.oddCycle {
+			a.frameWriteDelay = 4
+		}
+	}
+}
+
+// IRQ reports whether the frame counter or DMC asserts the IRQ line
+func (a *APU) IRQ() bool {
+	return a.frameIRQ || a.dmc.irq
+}
+
+// takeStall returns CPU cycles stolen by DMC DMA since the last call
+func (a *APU) takeStall() uint16 {
+	stall := a.stall
+	a.stall = 0
+	return stall
+}
+
+// Clock runs the APU for the given number of CPU cycles
+func (a *APU) Clock(cycles uint16) {
+	for i := uint16(0); i < cycles; i++ {
+		a.clockCycle()
+	}
+}
+
+func (a *APU) clockCycle() {
+	if a.oddCycle {
+		a.pulse1.clockTimer()
+		a.pulse2.clockTimer()
+	}
+	a.oddCycle = !a.oddCycle
+	a.triangle.clockTimer()
+	a.noise.clockTimer()
+	a.dmc.clockTimer()
+	if a.dmc.needFetch() {
+		a.fetchSample()
+	}
+
+	a.clockFrameCounter()
+
+	for _, m := range a.mixers {
+		m.clock()
+	}
+}
+
+// Stops clocking the mixer
+func (a *APU) detachMixer(mixer *Mixer) {
+	for i, m := range a.mixers {
+		if m == mixer {
+			a.mixers = append(a.mixers[:i], a.mixers[i+1:]...)
+			return
+		}
+	}
+}
+
+// DMC memory reader halts the CPU to fetch the next sample byte
+func (a *APU) fetchSample() {
+	var val byte
+	if a.mem != nil {
+		val = a.mem.read(a.dmc.addr)
+	}
+	a.dmc.fill(val)
+
+	if a.mem != nil {
+		a.stall += a.mem.dmcStall(a.oddCycle)
+	} else {
+		a.stall += dmcFetchStall
+	}
+}
+
+func (a *APU) clockFrameCounter() {
+	if a.frameWriteDelay > 0 {
+		a.frameWriteDelay--
+		if a.frameWriteDelay == 0 {
+			// 5-step mode clocks all units immediately
+			a.frameCycle = 0
+			a.fiveStep = a.frameWriteValue&0x80 != 0
+			if a.fiveStep {
+				a.quarterFrame()
+				a.halfFrame()
+			}
+			return
+		}
+	}
+
+	a.frameCycle++
+	steps := a.steps
+	switch a.frameCycle {
+	case steps.step1, steps.step3:
+		a.quarterFrame()
+	case steps.step2:
+		a.quarterFrame()
+		a.halfFrame()
+	}
+
+	if a.fiveStep {
+		switch a.frameCycle {
+		case steps.step5:
+			a.quarterFrame()
+			a.halfFrame()
+		case steps.step5Period:
+			a.frameCycle = 0
+		}
+		return
+	}
+
+	// IRQ flag is raised during 3 last cycles of 4-step sequence
+	if a.frameCycle >= steps.step4-1 && !a.irqInhibit {
+		a.frameIRQ = true
+	}
+	switch a.frameCycle {
+	case steps.step4:
+		a.quarterFrame()
+		a.halfFrame()
+	case steps.step4Period:
+		a.frameCycle = 0
+	}
+}
+
+// Quarter frames clock envelopes and triangle linear counter
+func (a *APU) quarterFrame() {
+	a.pulse1.env.clock()
+	a.pulse2.env.clock()
+	a.noise.env.clock()
+	a.triangle.clockLinear()
+}
+
+// Half frames clock length counters and sweep units
+func (a *APU) halfFrame() {
+	a.pulse1.clockLength()
+	a.pulse2.clockLength()
+	a.triangle.clockLength()
+	a.noise.clockLength()
+	a.pulse1.clockSweep()
+	a.pulse2.clockSweep()
+}
+
+// Output returns current level of the channel
+func (a *APU) Output(channel int) byte {
+	switch channel {
+	case ChannelPulse1:
+		return a.pulse1.output()
+	case ChannelPulse2:
+		return a.pulse2.output()
+	case ChannelTriangle:
+		return a.triangle.output()
+	case ChannelNoise:
+		return a.noise.output()
+	case ChannelDMC:
+		return a.dmc.output()
+	}
+	return 0
+}
@@ -0,0 +1,157 @@
+package nes
+
+const (
+	// CPU cycles of a sample fetch: halt, dummy and get cycles.
+	// See Memory.dmcStall for alignment and overlapping with writes
+	// and OAM DMA
+	dmcFetchStall = 3
+)
+
+// DMC output rates in CPU cycles (NTSC)
+var dmcRateTable = [16]uint16{
+	428, 380, 340, 320, 286, 254, 226, 214, 190, 160, 142, 128, 106, 84, 72, 54,
+}
+
+// DMC output rates in CPU cycles (PAL)
+var dmcRateTablePAL = [16]uint16{
+	398, 354, 316, 298, 276, 236, 210, 198, 176, 148, 132, 118, 98, 78, 66, 50,
+}
+
+// dmc is the delta modulation channel playing 1-bit samples
+// fetched from $C000-$FFFF by DMA
+type dmc struct {
+	irqEnabled bool
+	loop       bool
+	irq        bool
+	timer      uint16
+	period     uint16
+	rates      *[16]uint16
+
+	// Sample set by $4012/$4013
+	sampleAddr   uint16
+	sampleLength uint16
+
+	// Memory reader
+	addr      uint16
+	remaining uint16
+	buffer    byte
+	bufferSet bool
+
+	// Output unit
+	level   byte
+	shift   byte
+	bits    byte
+	silence bool
+}
+
+func (d *dmc) state(s *stateBuffer) {
+	s.bool(&d.irqEnabled)
+	s.bool(&d.loop)
+	s.bool(&d.irq)
+	stateNum(s, &d.timer)
+	stateNum(s, &d.period)
+	stateNum(s, &d.sampleAddr)
+	stateNum(s, &d.sampleLength)
+	stateNum(s, &d.addr)
+	stateNum(s, &d.remaining)
+	stateNum(s, &d.buffer)
+	s.bool(&d.bufferSet)
+	stateNum(s, &d.level)
+	stateNum(s, &d.shift)
+	stateNum(s, &d.bits)
+	s.bool(&d.silence)
+}
+
+func (d *dmc) write(reg uint16, val byte) {
+	switch reg {
+	case 0:
+		d.irqEnabled = val&0x80 != 0
+		d.loop = val&0x40 != 0
+		d.period = d.rates[val&0x0F]
+		if !d.irqEnabled {
+			d.irq = false
+		}
+	case 1:
+		d.level = val & 0x7F
+	case 2:
+		d.sampleAddr = 0xC000 + uint16(val)*64
+	case 3:
+		d.sampleLength = uint16(val)*16 + 1
+	}
+}
+
+func (d *dmc) setEnabled(enabled bool) {
+	d.irq = false
+	if !enabled {
+		d.remaining = 0
+	} else if d.remaining == 0 {
+		d.restart()
+	}
+}
+
+func (d *dmc) restart() {
+	d.addr = d.sampleAddr
+	d.remaining = d.sampleLength
+}
+
+// Reports whether memory reader needs the next sample byte
+func (d *dmc) needFetch() bool {
+	return !d.bufferSet && d.remaining > 0
+}
+
+// Stores fetched sample byte and advances memory reader
+func (d *dmc) fill(val byte) {
+	d.buffer = val
+	d.bufferSet = true
+	// Address wraps around to $8000
+	d.addr++
+	if d.addr == 0 {
+		d.addr = 0x8000
+	}
+	d.remaining--
+	if d.remaining == 0 {
+		if d.loop {
+			d.restart()
+		} else if d.irqEnabled {
+			d.irq = true
+		}
+	}
+}
+
+// Clocked every CPU cycle
+func (d *dmc) clockTimer() {
+	if d.timer > 0 {
+		d.timer--
+		return
+	}
+	d.timer = d.period - 1
+
+	if !d.silence {
+		if d.shift&1 != 0 {
+			if d.level <= 125 {
+				d.level += 2
+			}
+		} else if d.level >= 2 {
+			d.level -= 2
+		}
+	}
+	d.shift >>= 1
+
+	if d.bits > 0 {
+		d.bits--
+	}
+	if d.bits == 0 {
+		// New output cycle starts with the buffered byte
+		d.bits = 8
+		d.silence = !d.bufferSet
+		if d.bufferSet {
+			d.shift = d.buffer
+			d.bufferSet = false
+		}
+	}
+}
+
+// Current output level 0-127
+func (d *dmc) output() byte {
+	return d.level
+}
@@ -0,0 +1,91 @@
+package nes
+
+// Noise timer periods in CPU cycles (NTSC)
+var noisePeriodTable = [16]uint16{
+	4, 8, 16, 32, 64, 96, 128, 160, 202, 254, 380, 508, 762, 1016, 2034, 4068,
+}
+
+// Noise timer periods in CPU cycles (PAL)
+var noisePeriodTablePAL = [16]uint16{
+	4, 8, 14, 30, 60, 88, 118, 148, 188, 236, 354, 472, 708, 944, 1890, 3778,
+}
+
+// noise is the APU channel producing pseudo-random noise
+type noise struct {
+	enabled bool
+	timer   uint16
+	period  uint16
+	periods *[16]uint16
+	// Short mode takes feedback from bit 6 instead of bit 1
+	shortMode bool
+	shift     uint16
+
+	length     byte
+	lengthHalt bool
+	env        envelope
+}
+
+func (n *noise) state(s *stateBuffer) {
+	s.bool(&n.enabled)
+	stateNum(s, &n.timer)
+	stateNum(s, &n.period)
+	s.bool(&n.shortMode)
+	stateNum(s, &n.shift)
+	stateNum(s, &n.length)
+	s.bool(&n.lengthHalt)
+	n.env.state(s)
+}
+
+func (n *noise) write(reg uint16, val byte) {
+	switch reg {
+	case 0:
+		n.lengthHalt = val&0x20 != 0
+		n.env.write(val)
+	case 2:
+		n.shortMode = val&0x80 != 0
+		n.period = n.periods[val&0x0F]
+	case 3:
+		if n.enabled {
+			n.length = lengthTable[val>>3]
+		}
+		n.env.start = true
+	}
+}
+
+func (n *noise) setEnabled(enabled bool) {
+	n.enabled = enabled
+	if !enabled {
+		n.length = 0
+	}
+}
+
+// Clocked every CPU cycle, shifts 15-bit LFSR on timer reload
+func (n *noise) clockTimer() {
+	if n.timer > 0 {
+		n.timer--
+		return
+	}
+	n.timer = n.period - 1
+
+	tap := uint16(1)
+	if n.shortMode {
+		tap = 6
+	}
+	feedback := (n.shift ^ n.shift>>tap) & 1
+	n.shift = n.shift>>1 | feedback<<14
+}
+
+// Clocked by half frames
+func (n *noise) clockLength() {
+	if n.length > 0 && !n.lengthHalt {
+		n.length--
+	}
+}
+
+// Current output level 0-15
+func (n *noise) output() byte {
+	if n.length == 0 || n.shift&1 != 0 {
+		return 0
+	}
+	return n.env.volume()
+}
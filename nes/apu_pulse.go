@@ -0,0 +1,202 @@
+package nes
+
+// Waveforms of the pulse duty cycles: 12.5%, 25%, 50%, 25% negated
+var pulseDutyTable = [4][8]byte{
+	{0, 1, 0, 0, 0, 0, 0, 0},
+	{0, 1, 1, 0, 0, 0, 0, 0},
+	{0, 1, 1, 1, 1, 0, 0, 0},
+	{1, 0, 0, 1, 1, 1, 1, 1},
+}
+
+// Length counter values loaded by the upper 5 bits of the length register
+var lengthTable = [32]byte{
+	10, 254, 20, 2, 40, 4, 80, 6, 160, 8, 60, 10, 14, 12, 26, 14,
+	12, 16, 24, 18, 48, 20, 96, 22, 192, 24, 72, 26, 16, 28, 32, 30,
+}
+
+// envelope produces decaying or constant volume of pulse and noise channels
+type envelope struct {
+	start    bool
+	loop     bool
+	constant bool
+	period   byte
+	divider  byte
+	decay    byte
+}
+
+func (e *envelope) state(s *stateBuffer) {
+	s.bool(&e.start)
+	s.bool(&e.loop)
+	s.bool(&e.constant)
+	stateNum(s, &e.period)
+	stateNum(s, &e.divider)
+	stateNum(s, &e.decay)
+}
+
+func (e *envelope) write(val byte) {
+	e.loop = val&0x20 != 0
+	e.constant = val&0x10 != 0
+	e.period = val & 0x0F
+}
+
+// Clocked by quarter frames
+func (e *envelope) clock() {
+	if e.start {
+		e.start = false
+		e.decay = 15
+		e.divider = e.period
+		return
+	}
+	if e.divider > 0 {
+		e.divider--
+		return
+	}
+	e.divider = e.period
+	if e.decay > 0 {
+		e.decay--
+	} else if e.loop {
+		e.decay = 15
+	}
+}
+
+func (e *envelope) volume() byte {
+	if e.constant {
+		return e.period
+	}
+	return e.decay
+}
+
+// pulse is one of the two square wave channels of the APU
+type pulse struct {
+	// Pulse 1 adds one's complement of the sweep change when
+	// decreasing the period, pulse 2 adds two's complement
+	onesComplement bool
+	// MMC5 pulses have no sweep unit, so it never mutes them
+	noSweep bool
+
+	enabled bool
+	duty    byte
+	dutyPos byte
+	timer   uint16
+	period  uint16
+
+	length     byte
+	lengthHalt bool
+	env        envelope
+
+	sweepEnabled bool
+	sweepNegate  bool
+	sweepPeriod  byte
+	sweepShift   byte
+	sweepDivider byte
+	sweepReload  bool
+}
+
+func (p *pulse) state(s *stateBuffer) {
+	s.bool(&p.enabled)
+	stateNum(s, &p.duty)
+	stateNum(s, &p.dutyPos)
+	stateNum(s, &p.timer)
+	stateNum(s, &p.period)
+	stateNum(s, &p.length)
+	s.bool(&p.lengthHalt)
+	p.env.state(s)
+	s.bool(&p.sweepEnabled)
+	s.bool(&p.sweepNegate)
+	stateNum(s, &p.sweepPeriod)
+	stateNum(s, &p.sweepShift)
+	stateNum(s, &p.sweepDivider)
+	s.bool(&p.sweepReload)
+}
+
+func (p *pulse) write(reg uint16, val byte) {
+	switch reg {
+	case 0:
+		p.duty = val >> 6
+		p.lengthHalt = val&0x20 != 0
+		p.env.write(val)
+	case 1:
+		p.sweepEnabled = val&0x80 != 0
+		p.sweepPeriod = (val >> 4) & 0x07
+		p.sweepNegate = val&0x08 != 0
+		p.sweepShift = val & 0x07
+		p.sweepReload = true
+	case 2:
+		p.period = p.period&0x0700 | uint16(val)
+	case 3:
+		p.period = p.period&0x00FF | uint16(val&0x07)<<8
+		if p.enabled {
+			p.length = lengthTable[val>>3]
+		}
+		p.dutyPos = 0
+		p.env.start = true
+	}
+}
+
+func (p *pulse) setEnabled(enabled bool) {
+	p.enabled = enabled
+	if !enabled {
+		p.length = 0
+	}
+}
+
+// Clocked every other CPU cycle
+func (p *pulse) clockTimer() {
+	if p.timer > 0 {
+		p.timer--
+		return
+	}
+	p.timer = p.period
+	p.dutyPos = (p.dutyPos - 1) & 7
+}
+
+// Clocked by half frames
+func (p *pulse) clockLength() {
+	if p.length > 0 && !p.lengthHalt {
+		p.length--
+	}
+}
+
+// Period the sweep unit is going to set
+func (p *pulse) sweepTarget() uint16 {
+	change := p.period >> p.sweepShift
+	if !p.sweepNegate {
+		return p.period + change
+	}
+	if p.onesComplement {
+		change++
+	}
+	if change > p.period {
+		return 0
+	}
+	return p.period - change
+}
+
+// Channel is silenced by the sweep unit even when sweep is disabled
+func (p *pulse) sweepMuted() bool {
+	if p.noSweep {
+		return false
+	}
+	return p.period < 8 || p.sweepTarget() > 0x07FF
+}
+
+// Clocked by half frames
+func (p *pulse) clockSweep() {
+	if p.sweepDivider == 0 && p.sweepEnabled && p.sweepShift > 0 && !p.sweepMuted() {
+		p.period = p.sweepTarget()
+	}
+	if p.sweepDivider == 0 || p.sweepReload {
+		p.sweepDivider = p.sweepPeriod
+		p.sweepReload = false
+	} else {
+		p.sweepDivider--
+	}
+}
+
+// Current output level 0-15
+func (p *pulse) output() byte {
+	if p.length == 0 || p.sweepMuted() || pulseDutyTable[p.duty][p.dutyPos] == 0 {
+		return 0
+	}
+	return p.env.volume()
+}
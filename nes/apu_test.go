@@ -0,0 +1,381 @@
+package nes
+
+import (
+	"testing"
+)
+
+func TestPulseSweepNegate(t *testing.T) {
+	a := NewAPU(nil)
+	// Negated sweep with shift 1 on both channels
+	for _, base := range []uint16{0x4000, 0x4004} {
+		a.WriteRegister(base+1, 0x89)
+		a.WriteRegister(base+2, 0x00)
+		a.WriteRegister(base+3, 0x01)
+	}
+
+	// Pulse 1 subtracts one more than pulse 2
+	if p := a.pulse1.sweepTarget(); p != 0x7F {
+		t.Fatalf("Unexpected pulse 1 sweep target %x", p)
+	}
+	if p := a.pulse2.sweepTarget(); p != 0x80 {
+		t.Fatalf("Unexpected pulse 2 sweep target %x", p)
+	}
+}
+
+func TestPulseLengthCounter(t *testing.T) {
+	a := NewAPU(nil)
+	// Length is not loaded while the channel is disabled
+	a.WriteRegister(0x4003, 0x08)
+	if a.ReadRegister(APUStatus) != 0 {
+		t.Fatalf("Length loaded into disabled channel")
+	}
+
+	a.WriteRegister(APUStatus, 0x01)
+	a.WriteRegister(0x4002, 0x40)
+	// Length index 1 is 254, index 3 is 2
+	a.WriteRegister(0x4003, 0x18)
+	if a.pulse1.length != 2 || a.ReadRegister(APUStatus) != 0x01 {
+		t.Fatalf("Unexpected length %d", a.pulse1.length)
+	}
+
+	// Two half frames silence the channel
+	a.Clock(frameStep4Period)
+	if a.ReadRegister(APUStatus)&0x01 != 0 {
+		t.Fatalf("Length counter not expired, length %d", a.pulse1.length)
+	}
+}
+
+func TestFrameCounterIRQ(t *testing.T) {
+	a := NewAPU(nil)
+	a.WriteRegister(APUFrameCounter, 0x00)
+	a.Clock(3)
+
+	a.Clock(frameIRQFirstStep - 1)
+	if a.IRQ() {
+		t.Fatalf("Frame IRQ raised too early")
+	}
+	a.Clock(1)
+	if !a.IRQ() {
+		t.Fatalf("Frame IRQ not raised at the end of 4-step sequence")
+	}
+
+	// Reading status returns and acknowledges the flag
+	if a.ReadRegister(APUStatus)&0x40 == 0 || a.IRQ() {
+		t.Fatalf("Status read did not acknowledge frame IRQ")
+	}
+
+	// 5-step mode never raises IRQ
+	a.WriteRegister(APUFrameCounter, 0x80)
+	a.Clock(4)
+	a.ReadRegister(APUStatus)
+	a.Clock(frameStep5Period)
+	a.Clock(frameStep5Period)
+	if a.IRQ() {
+		t.Fatalf("Frame IRQ raised in 5-step mode")
+	}
+}
+
+func TestFrameCounterWriteDelay(t *testing.T) {
+	a := NewAPU(nil)
+	a.WriteRegister(APUStatus, 0x01)
+	a.WriteRegister(0x4003, 0x18)
+
+	// 5-step mode clocks half frame once the write takes effect
+	a.WriteRegister(APUFrameCounter, 0x80)
+	a.Clock(2)
+	if a.pulse1.length != 2 {
+		t.Fatalf("$4017 write took effect too early")
+	}
+	a.Clock(2)
+	if a.pulse1.length != 1 {
+		t.Fatalf("$4017 write did not clock half frame, length %d", a.pulse1.length)
+	}
+}
+
+func TestTriangleLinearCounter(t *testing.T) {
+	a := NewAPU(nil)
+	a.WriteRegister(APUStatus, 0x04)
+	a.WriteRegister(0x4008, 0x02)
+	a.WriteRegister(0x400A, 0x10)
+	a.WriteRegister(0x400B, 0x08)
+
+	// Reloaded by the first quarter frame and expires after two more
+	a.Clock(frameStep1)
+	if a.triangle.linear != 2 {
+		t.Fatalf("Unexpected linear counter %d", a.triangle.linear)
+	}
+	a.Clock(frameStep3 - frameStep1)
+	if a.triangle.linear != 0 {
+		t.Fatalf("Unexpected linear counter %d", a.triangle.linear)
+	}
+
+	// Sequencer holds its position
+	step := a.triangle.step
+	a.Clock(1000)
+	if a.triangle.step != step {
+		t.Fatalf("Triangle sequencer runs with zero linear counter")
+	}
+}
+
+func TestNoiseShiftRegister(t *testing.T) {
+	n := noise{shift: 1, period: 4}
+	n.clockTimer()
+	// Feedback of bit 0 and bit 1 goes into bit 14
+	if n.shift != 0x4000 {
+		t.Fatalf("Unexpected shift register %04x", n.shift)
+	}
+
+	n = noise{shift: 0x40, period: 4, shortMode: true}
+	n.clockTimer()
+	if n.shift != 0x4020 {
+		t.Fatalf("Unexpected shift register %04x in short mode", n.shift)
+	}
+}
+
+func TestDMCFetchStall(t *testing.T) {
+	m := Memory{mapper: &NROM128{}}
+	m.apu = NewAPU(&m)
+	// NROM-128 mirrors $C000 to $8000
+	m.ram[0x8000] = 0xFF
+
+	// Fastest rate, IRQ at the end of the 1-byte sample
+	m.Write(0x4010, 0x8F)
+	m.Write(0x4012, 0x00)
+	m.Write(0x4013, 0x00)
+	m.Read(0x0000)
+	m.Write(APUStatus, 0x10)
+
+	// Fetch on an odd cycle right after a write cycle, the write
+	// overlaps the alignment cycle
+	m.clock(1)
+	if stall := m.dmaStall(); stall != dmcFetchStall {
+		t.Fatalf("Unexpected DMA stall %d after write", stall)
+	}
+	if !m.apu.IRQ() || m.Read(APUStatus)&0x90 != 0x80 {
+		t.Fatalf("DMC IRQ not raised at the end of sample")
+	}
+
+	// Restarted sample is fetched once the buffer is emptied
+	m.Write(APUStatus, 0x10)
+	m.Read(0x0000)
+	m.clock(dmcRateTable[15] * 9)
+	// Odd cycle fetch after a read takes the alignment cycle
+	if stall := m.dmaStall(); stall != dmcFetchStall+1 {
+		t.Fatalf("Unexpected DMA stall %d", stall)
+	}
+	// Set bits of the sample raise output level
+	if level := m.apu.Output(ChannelDMC); level == 0 {
+		t.Fatalf("DMC output level did not change")
+	}
+}
+
+func TestDMCStallAlignment(t *testing.T) {
+	tests := []struct {
+		oddCycle  bool
+		writeRun  uint16
+		oamCycles uint16
+		stall     uint16
+	}{
+		{false, 0, 0, 3},
+		{true, 0, 0, 4},
+		{true, 1, 0, 3},
+		{true, 2, 0, 2},
+		{true, 3, 0, 1},
+		{false, 3, 0, 1},
+		{false, 0, 100, 2},
+		{true, 0, 2, 1},
+		{true, 0, 1, 3},
+	}
+	for _, tt := range tests {
+		m := Memory{mapper: &NROM128{}, writeRun: tt.writeRun, oamCycles: tt.oamCycles}
+		if stall := m.dmcStall(tt.oddCycle); stall != tt.stall {
+			t.Fatalf("Unexpected stall %d on odd cycle %v after %d writes with %d OAM DMA cycles left",
+				stall, tt.oddCycle, tt.writeRun, tt.oamCycles)
+		}
+	}
+}
+
+func TestDMCFetchDuringOAMDMA(t *testing.T) {
+	m := Memory{mapper: &NROM128{}}
+	m.apu = NewAPU(&m)
+	NewPPU(&m)
+	m.Write(0x4010, 0x0F)
+	m.Write(0x4013, 0x00)
+	m.Write(APUStatus, 0x10)
+	m.Write(0x4014, 0x02)
+	oam := m.dmaStall()
+
+	// Sample is fetched on the first OAM DMA cycle and takes 2 cycles
+	m.clock(oam)
+	if m.oamCycles != 0 {
+		t.Fatalf("%d OAM DMA cycles not clocked", m.oamCycles)
+	}
+	if stall := m.dmaStall(); stall != 2 {
+		t.Fatalf("Unexpected DMA stall %d during OAM DMA", stall)
+	}
+}
+
+// Repeated controller read clocks it once more
+func TestDMCConflictRead(t *testing.T) {
+	m := Memory{mapper: &NROM128{}}
+	pad := NewController()
+	m.ConnectInput(0, pad)
+	pad.SetButton(ButtonA, true)
+	m.Write(Joypad1, 1)
+	m.Write(Joypad1, 0)
+	m.Read(Joypad1)
+	m.dmcStall(false)
+	if val := m.Read(Joypad1) & 1; val != 0 {
+		t.Fatalf("Controller not clocked by repeated read")
+	}
+}
+
+// Following tests check what blargg's apu_test 1-6 check, in CPU cycles
+// counted from the moment a $4017 write takes effect
+
+// frameCounterWrite writes $4017 on an even CPU cycle and waits
+// until the write takes effect
+func frameCounterWrite(a *APU, val byte) {
+	if a.oddCycle {
+		a.Clock(1)
+	}
+	a.WriteRegister(APUFrameCounter, val)
+	a.Clock(3)
+}
+
+func TestLengthCounterControl(t *testing.T) {
+	a := NewAPU(nil)
+	a.WriteRegister(APUStatus, 0x0F)
+	for _, reg := range []uint16{0x4003, 0x4007, 0x400B, 0x400F} {
+		a.WriteRegister(reg, 0x18)
+	}
+	if s := a.ReadRegister(APUStatus); s&0x0F != 0x0F {
+		t.Fatalf("Length counters not loaded, status %02x", s)
+	}
+
+	// Halt flag keeps the counters running
+	a.WriteRegister(0x4000, 0x20)
+	a.WriteRegister(0x4008, 0x80)
+	frameCounterWrite(a, 0x80)
+	frameCounterWrite(a, 0x80)
+	if s := a.ReadRegister(APUStatus); s&0x0F != 0x05 {
+		t.Fatalf("Halted length counters expired, status %02x", s)
+	}
+
+	// Disabling channel clears its counter
+	a.WriteRegister(APUStatus, 0x04)
+	if s := a.ReadRegister(APUStatus); s&0x0F != 0x04 {
+		t.Fatalf("Disabled channel kept its length, status %02x", s)
+	}
+}
+
+func TestLengthTable(t *testing.T) {
+	expected := []int{
+		10, 254, 20, 2, 40, 4, 80, 6, 160, 8, 60, 10, 14, 12, 26, 14,
+		12, 16, 24, 18, 48, 20, 96, 22, 192, 24, 72, 26, 16, 28, 32, 30,
+	}
+	for index, length := range expected {
+		a := NewAPU(nil)
+		a.WriteRegister(APUStatus, 0x01)
+		a.WriteRegister(0x4003, byte(index<<3))
+
+		// Every 5-step mode write clocks a half frame
+		clocks := 0
+		for a.ReadRegister(APUStatus)&0x01 != 0 && clocks < 256 {
+			frameCounterWrite(a, 0x80)
+			clocks++
+		}
+		if clocks != length {
+			t.Fatalf("Length index %d lasted %d half frames, expected %d", index, clocks, length)
+		}
+	}
+}
+
+func TestLengthTiming(t *testing.T) {
+	a := NewAPU(nil)
+	a.WriteRegister(APUStatus, 0x01)
+
+	// 4-step mode clocks length at 14913 and 29829
+	a.WriteRegister(0x4003, 0x18)
+	frameCounterWrite(a, 0x00)
+	a.Clock(14912)
+	if a.pulse1.length != 2 {
+		t.Fatalf("Length clocked before 14913 cycles")
+	}
+	a.Clock(1)
+	if a.pulse1.length != 1 {
+		t.Fatalf("Length not clocked at 14913 cycles")
+	}
+	a.Clock(29829 - 14913 - 1)
+	if a.pulse1.length != 1 {
+		t.Fatalf("Length clocked before 29829 cycles")
+	}
+	a.Clock(1)
+	if a.pulse1.length != 0 {
+		t.Fatalf("Length not clocked at 29829 cycles")
+	}
+
+	// 5-step mode clocks length on the write, at 14913 and 37281
+	a.WriteRegister(0x4003, 0x08)
+	frameCounterWrite(a, 0x80)
+	if a.pulse1.length != 253 {
+		t.Fatalf("Length not clocked by 5-step mode write")
+	}
+	a.Clock(14913)
+	a.Clock(37281 - 14913 - 1)
+	if a.pulse1.length != 252 {
+		t.Fatalf("Unexpected length %d before 37281 cycles", a.pulse1.length)
+	}
+	a.Clock(1)
+	if a.pulse1.length != 251 {
+		t.Fatalf("Length not clocked at 37281 cycles")
+	}
+}
+
+func TestFrameIRQFlag(t *testing.T) {
+	a := NewAPU(nil)
+	// Inhibit bit clears the flag and keeps it clear
+	frameCounterWrite(a, 0x00)
+	a.Clock(29830)
+	frameCounterWrite(a, 0x40)
+	if a.IRQ() {
+		t.Fatalf("Inhibit did not clear frame IRQ")
+	}
+	a.Clock(29830)
+	if a.IRQ() {
+		t.Fatalf("Frame IRQ raised while inhibited")
+	}
+
+	// Flag is set again on each of the last three cycles, reads
+	// in between acknowledge it
+	frameCounterWrite(a, 0x00)
+	a.Clock(29827)
+	if a.IRQ() {
+		t.Fatalf("Frame IRQ raised before 29828 cycles")
+	}
+	for cycle := 29828; cycle <= 29830; cycle++ {
+		a.Clock(1)
+		if a.ReadRegister(APUStatus)&0x40 == 0 {
+			t.Fatalf("Frame IRQ flag not set at %d cycles", cycle)
+		}
+	}
+	a.Clock(1)
+	if a.IRQ() {
+		t.Fatalf("Frame IRQ flag set after the sequence restarted")
+	}
+}
+
+func TestFrameCounterJitter(t *testing.T) {
+	a := NewAPU(nil)
+	// Write on an odd cycle takes effect one cycle later
+	a.Clock(1)
+	a.WriteRegister(APUFrameCounter, 0x00)
+	a.Clock(4 + 29827)
+	if a.IRQ() {
+		t.Fatalf("Frame IRQ raised too early after odd cycle write")
+	}
+	a.Clock(1)
+	if !a.IRQ() {
+		t.Fatalf("Frame IRQ not raised after odd cycle write")
+	}
+}
@@ -0,0 +1,94 @@
+package nes
+
+// 32-step triangle waveform
+var triangleTable = [32]byte{
+	15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0,
+	0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+}
+
+// triangle is the APU channel producing triangle wave
+type triangle struct {
+	enabled bool
+	timer   uint16
+	period  uint16
+	step    byte
+
+	length byte
+	// Control flag halts length counter and keeps linear counter reloading
+	control bool
+
+	linear       byte
+	linearReload byte
+	reloadLinear bool
+}
+
+func (t *triangle) state(s *stateBuffer) {
+	s.bool(&t.enabled)
+	stateNum(s, &t.timer)
+	stateNum(s, &t.period)
+	stateNum(s, &t.step)
+	stateNum(s, &t.length)
+	s.bool(&t.control)
+	stateNum(s, &t.linear)
+	stateNum(s, &t.linearReload)
+	s.bool(&t.reloadLinear)
+}
+
+func (t *triangle) write(reg uint16, val byte) {
+	switch reg {
+	case 0:
+		t.control = val&0x80 != 0
+		t.linearReload = val & 0x7F
+	case 2:
+		t.period = t.period&0x0700 | uint16(val)
+	case 3:
+		t.period = t.period&0x00FF | uint16(val&0x07)<<8
+		if t.enabled {
+			t.length = lengthTable[val>>3]
+		}
+		t.reloadLinear = true
+	}
+}
+
+func (t *triangle) setEnabled(enabled bool) {
+	t.enabled = enabled
+	if !enabled {
+		t.length = 0
+	}
+}
+
+// Clocked every CPU cycle, sequencer advances only while both counters are non-zero
+func (t *triangle) clockTimer() {
+	if t.timer > 0 {
+		t.timer--
+		return
+	}
+	t.timer = t.period
+	if t.length > 0 && t.linear > 0 {
+		t.step = (t.step + 1) & 31
+	}
+}
+
+// Clocked by quarter frames
+func (t *triangle) clockLinear() {
+	if t.reloadLinear {
+		t.linear = t.linearReload
+	} else if t.linear > 0 {
+		t.linear--
+	}
+	if !t.control {
+		t.reloadLinear = false
+	}
+}
+
+// Clocked by half frames
+func (t *triangle) clockLength() {
+	if t.length > 0 && !t.control {
+		t.length--
+	}
+}
+
+// Current output level 0-15, stopped sequencer holds its last value
+func (t *triangle) output() byte {
+	return triangleTable[t.step]
+}
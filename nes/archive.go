@@ -0,0 +1,107 @@
+package nes
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// RomExtensions lists file extensions of supported ROM formats
+var RomExtensions = []string{".nes", ".fds", ".nsf", ".nsfe", ".unf", ".unif"}
+
+// IsArchive reports whether data is a zip or gzip archive
+func IsArchive(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("PK\x03\x04")) || bytes.HasPrefix(data, []byte{0x1F, 0x8B})
+}
+
+// IsRomName reports whether file name has one of RomExtensions
+func IsRomName(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, romExt := range RomExtensions {
+		if ext == romExt {
+			return true
+		}
+	}
+	return false
+}
+
+// ArchiveEntries returns names of ROM files stored in zip archive
+func ArchiveEntries(data []byte) ([]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range zr.File {
+		if !f.FileInfo().IsDir() && IsRomName(f.Name) {
+			names = append(names, f.Name)
+		}
+	}
+	return names, nil
+}
+
+// ExtractRom unpacks ROM from zip or gzip archive. For zip archives
+// the named entry is extracted, or the first ROM file when entry is empty.
+// archiveName is used to name the content of gzip files without
+// the original name stored. Returns name and content of the ROM file
+func ExtractRom(data []byte, archiveName string, entry string) (string, []byte, error) {
+	if bytes.HasPrefix(data, []byte{0x1F, 0x8B}) {
+		return extractGzip(data, archiveName)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", nil, err
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if entry != "" && f.Name != entry && path.Base(f.Name) != entry {
+			continue
+		}
+		if entry == "" && !IsRomName(f.Name) {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return "", nil, err
+		}
+		defer rc.Close()
+		romData, err := io.ReadAll(rc)
+		if err != nil {
+			return "", nil, err
+		}
+		return f.Name, romData, nil
+	}
+
+	if entry != "" {
+		return "", nil, fmt.Errorf("entry %s not found in archive", entry)
+	}
+	return "", nil, errors.New("no ROM files found in archive")
+}
+
+func extractGzip(data []byte, archiveName string) (string, []byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, err
+	}
+	defer zr.Close()
+	romData, err := io.ReadAll(zr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	name := zr.Name
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(archiveName), filepath.Ext(archiveName))
+	}
+	return name, romData, nil
+}
@@ -0,0 +1,57 @@
+package nes
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+func testZip(t *testing.T, files ...string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(name))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractRomZip(t *testing.T) {
+	data := testZip(t, "readme.txt", "roms/game.nes", "roms/game (hack).nes")
+	if !IsArchive(data) {
+		t.Fatalf("Zip archive not detected")
+	}
+
+	name, romData, err := ExtractRom(data, "game.zip", "")
+	if err != nil || name != "roms/game.nes" || string(romData) != name {
+		t.Fatalf("Unexpected first entry %s (%v)", name, err)
+	}
+
+	name, _, err = ExtractRom(data, "game.zip", "game (hack).nes")
+	if err != nil || name != "roms/game (hack).nes" {
+		t.Fatalf("Unexpected chosen entry %s (%v)", name, err)
+	}
+
+	if _, _, err := ExtractRom(testZip(t, "readme.txt"), "game.zip", ""); err == nil {
+		t.Fatalf("Archive without ROMs not reported")
+	}
+}
+
+func TestExtractRomGzip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("NES\x1a"))
+	zw.Close()
+
+	name, romData, err := ExtractRom(buf.Bytes(), "/roms/game.nes.gz", "")
+	if err != nil || name != "game.nes" || string(romData) != "NES\x1a" {
+		t.Fatalf("Unexpected gzip content %s %q (%v)", name, romData, err)
+	}
+}
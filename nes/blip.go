@@ -0,0 +1,87 @@
+package nes
+
+import "math"
+
+const (
+	// Length of the band-limited step kernel in output samples
+	blipTaps = 16
+	// Sub-sample positions of the kernel
+	blipPhases = 64
+	// Cutoff frequency relative to output sample rate
+	blipCutoff = 0.45
+)
+
+// Band-limited impulses for every sub-sample phase, windowed sinc
+var blipKernel = func() (k [blipPhases][blipTaps]float32) {
+	for p := 0; p < blipPhases; p++ {
+		var sum float64
+		var taps [blipTaps]float64
+		for i := range taps {
+			x := float64(i) - blipTaps/2 - float64(p)/blipPhases
+			sinc := 1.0
+			if x != 0 {
+				sinc = math.Sin(2*math.Pi*blipCutoff*x) / (2 * math.Pi * blipCutoff * x)
+			}
+			// Blackman window centered at the impulse
+			n := 2 * math.Pi * (x + blipTaps/2) / blipTaps
+			taps[i] = sinc * (0.42 - 0.5*math.Cos(n) + 0.08*math.Cos(2*n))
+			sum += taps[i]
+		}
+		// Each impulse adds up to exactly one step
+		for i := range taps {
+			k[p][i] = float32(taps[i] / sum)
+		}
+	}
+	return
+}()
+
+// blipBuffer converts level changes happening at the CPU clock rate into
+// band-limited samples at the output rate. Changes are stored as impulses
+// which are integrated when samples are read
+type blipBuffer struct {
+	// Output samples per input clock
+	factor float64
+	// Current time in output samples since the start of deltas
+	time   float64
+	deltas []float32
+	sum    float32
+}
+
+func newBlipBuffer(clockRate int, sampleRate int) *blipBuffer {
+	return &blipBuffer{factor: float64(sampleRate) / float64(clockRate)}
+}
+
+// addDelta adds level change at the current time
+func (b *blipBuffer) addDelta(delta float32) {
+	pos := int(b.time)
+	phase := int((b.time - float64(pos)) * blipPhases)
+	if need := pos + blipTaps; need > len(b.deltas) {
+		b.deltas = append(b.deltas, make([]float32, need-len(b.deltas))...)
+	}
+	for i, k := range blipKernel[phase] {
+		b.deltas[pos+i] += delta * k
+	}
+}
+
+// advance moves current time by the given number of input clocks
+func (b *blipBuffer) advance(clocks int) {
+	b.time += float64(clocks) * b.factor
+}
+
+// read returns samples completed by now, output is delayed by half of the kernel
+func (b *blipBuffer) read() []float32 {
+	n := int(b.time)
+	if n > len(b.deltas) {
+		b.deltas = append(b.deltas, make([]float32, n-len(b.deltas))...)
+	}
+	out := make([]float32, n)
+	for i := range out {
+		b.sum += b.deltas[i]
+		out[i] = b.sum
+	}
+
+	// Keep impulses reaching into future samples
+	b.deltas = b.deltas[:copy(b.deltas, b.deltas[n:])]
+	b.time -= float64(n)
+	return out
+}
@@ -0,0 +1,266 @@
+package nes
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+)
+
+// Console is the NES: CPU, PPU and APU connected by the bus
+// to the cartridge. Every frontend and tool drives it the same way
+type Console struct {
+	rom    *Rom
+	mem    *Memory
+	cpu    *CPU
+	ppu    *PPU
+	mixer  *Mixer
+	region Region
+	clock  scheduler
+	// Drives the CPU when NSF music is loaded instead of a game
+	nsf *NsfPlayer
+	// Movie commands carried out at the end of the frame
+	commands byte
+}
+
+// NewConsole inserts cartridge into the console of the region
+// the cartridge header asks for and powers it on
+func NewConsole(rom *Rom) *Console {
+	return NewRegionConsole(rom, rom.Header.Region())
+}
+
+// NewRegionConsole inserts cartridge into the console of the given region
+// and powers it on
+func NewRegionConsole(rom *Rom, region Region) *Console {
+	mem := rom.Load()
+	c := &Console{rom: rom, mem: mem, cpu: InitCPU(mem), ppu: NewPPU(mem), region: region}
+	c.clock.profile = region.profile()
+	c.ppu.profile = c.clock.profile
+	mem.apu.setRegion(region)
+	mem.apu.powerOn()
+	c.mixer = NewMixer(mem.apu, region.CPUClock(), DefaultSampleRate)
+	c.attachExpansionAudio()
+	c.cpu.Reset()
+	c.ppu.Reset()
+	if rom.Nsf != nil {
+		c.nsf = NewNsfPlayer(c.cpu, rom.Nsf)
+	}
+	return c
+}
+
+func (c *Console) attachExpansionAudio() {
+	expansion, _ := c.mem.mapper.(ExpansionAudio)
+	c.mixer.SetExpansion(expansion)
+}
+
+// Reset presses the reset button, NSF restarts the current song
+func (c *Console) Reset() {
+	c.cpu.Reset()
+	c.ppu.Reset()
+	if c.nsf != nil {
+		c.nsf.PlaySong(c.nsf.song)
+	}
+}
+
+// PowerCycle switches the console off and on. Battery-backed memory
+// and plugged devices survive
+func (c *Console) PowerCycle() {
+	var save []byte
+	if battery, ok := c.mem.mapper.(Battery); ok && c.rom.Header.HasBattery {
+		save = battery.SaveData()
+	}
+	c.mem.powerOn(c.rom)
+	if save != nil {
+		c.mem.mapper.(Battery).LoadSaveData(save)
+	}
+	c.attachExpansionAudio()
+
+	c.ppu.powerOn()
+	c.clock.cpuTime, c.clock.ppuTime = 0, 0
+	*c.cpu = CPU{mem: c.mem, trace: c.cpu.trace}
+	c.cpu.Reset()
+	c.ppu.Reset()
+	if c.nsf != nil {
+		*c.nsf = *NewNsfPlayer(c.cpu, c.rom.Nsf)
+	}
+}
+
+// StepInstruction executes a single CPU instruction
+// and runs PPU for the same time
+func (c *Console) StepInstruction() CpuState {
+	var state CpuState
+	if c.nsf != nil {
+		state = c.nsf.Step()
+	} else {
+		state = c.cpu.Step()
+	}
+	c.ppu.Step(c.clock.cpuCycles(state.Cycles))
+	return state
+}
+
+// StepFrame runs the console until PPU starts the next frame
+// and returns state after the last instruction
+func (c *Console) StepFrame() CpuState {
+	if c.commands != 0 {
+		c.runCommands()
+	}
+	frame := c.ppu.frameCount
+	var state CpuState
+	for c.ppu.frameCount == frame {
+		state = c.StepInstruction()
+	}
+	if c.commands != 0 {
+		c.runCommands()
+	}
+	return state
+}
+
+// MovieCommand queues commands of a movie frame. Movie input is applied
+// by the PPU in the middle of the frame, so resets and disk changes wait
+// until StepFrame finishes it. Commands queued before emulation starts
+// run before the first frame
+func (c *Console) MovieCommand(commands byte) {
+	c.commands |= commands
+}
+
+func (c *Console) runCommands() {
+	commands := c.commands
+	c.commands = 0
+	if commands&MovieHardReset != 0 {
+		c.PowerCycle()
+	} else if commands&MovieSoftReset != 0 {
+		c.Reset()
+	}
+	if disk, ok := c.mem.mapper.(*FDS); ok {
+		if commands&MovieFDSInsert != 0 {
+			disk.ToggleDisk()
+		}
+		if commands&MovieFDSSelect != 0 {
+			disk.SelectSide()
+		}
+	}
+}
+
+// RunFrames emulates the given number of frames calling onFrame
+// after each of them. CPU jam and other emulator failures are
+// returned as errors instead of panicking
+func (c *Console) RunFrames(frames int, onFrame func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = PanicError(r)
+		}
+	}()
+	for i := 0; i < frames; i++ {
+		c.StepFrame()
+		if onFrame != nil {
+			if err := onFrame(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PanicError converts value recovered from a panic of StepFrame or
+// StepInstruction into error, CPU jam stays a *JamError
+func PanicError(r any) error {
+	if jam, ok := r.(*JamError); ok {
+		return jam
+	}
+	return fmt.Errorf("emulator error: %v", r)
+}
+
+// ConnectControllers plugs two standard controllers or Four Score
+// with four of them, returned in the order of players
+func (c *Console) ConnectControllers(fourScore bool) []*Controller {
+	var pads []*Controller
+	if fourScore {
+		adapter := NewFourScore()
+		for port := 0; port < 2; port++ {
+			c.mem.ConnectInput(port, adapter.Port(port))
+		}
+		for player := 0; player < 4; player++ {
+			pads = append(pads, adapter.Controller(player))
+		}
+		return pads
+	}
+	for port := 0; port < 2; port++ {
+		pads = append(pads, NewController())
+		c.mem.ConnectInput(port, pads[port])
+	}
+	return pads
+}
+
+// PlayMovie feeds movie input into the controllers from the first
+// frame on, loading the save state the movie starts from. Movie
+// commands are carried out between frames
+func (c *Console) PlayMovie(movie *Movie, pads []*Controller) (*MoviePlayer, error) {
+	if movie.SaveState != nil {
+		if err := c.LoadState(bytes.NewReader(movie.SaveState)); err != nil {
+			return nil, fmt.Errorf("movie save state: %w", err)
+		}
+	}
+	player := NewMoviePlayer(movie, pads)
+	player.OnCommand = c.MovieCommand
+	c.ppu.SetFrameHook(player.Frame)
+	player.Frame()
+	return player, nil
+}
+
+// RecordMovie records input of source controllers passed to the console
+// ones into the movie, starting from the current state when fromState
+// is set. Commands given to the recorder are carried out between frames
+func (c *Console) RecordMovie(movie *Movie, source []*Controller, pads []*Controller, fromState bool) (*MovieRecorder, error) {
+	movie.SaveState = nil
+	if fromState {
+		var state bytes.Buffer
+		if err := c.SaveState(&state); err != nil {
+			return nil, err
+		}
+		movie.SaveState = state.Bytes()
+	}
+	recorder := NewMovieRecorder(movie, source, pads)
+	recorder.OnCommand = c.MovieCommand
+	c.ppu.SetFrameHook(recorder.Frame)
+	recorder.Frame()
+	return recorder, nil
+}
+
+// Frame returns the last picture produced by PPU
+func (c *Console) Frame() *image.RGBA {
+	return c.ppu.Image()
+}
+
+// Audio returns mixer producing console sound at DefaultSampleRate
+func (c *Console) Audio() *Mixer {
+	return c.mixer
+}
+
+// Region returns TV system of the console
+func (c *Console) Region() Region {
+	return c.region
+}
+
+// Rom returns inserted cartridge
+func (c *Console) Rom() *Rom {
+	return c.rom
+}
+
+// Memory returns the CPU bus
+func (c *Console) Memory() *Memory {
+	return c.mem
+}
+
+// CPU returns the console CPU
+func (c *Console) CPU() *CPU {
+	return c.cpu
+}
+
+// PPU returns the console PPU
+func (c *Console) PPU() *PPU {
+	return c.ppu
+}
+
+// NsfPlayer returns player of the loaded NSF, nil for games
+func (c *Console) NsfPlayer() *NsfPlayer {
+	return c.nsf
+}
@@ -0,0 +1,146 @@
+package nes
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestConsoleStepFrame(t *testing.T) {
+	rom := testRom(0, 1)
+	// INC $00; JMP $8000
+	copy(rom.prgRom, []byte{0xE6, 0x00, 0x4C, 0x00, 0x80})
+	c := NewConsole(rom)
+
+	c.StepFrame()
+	if c.PPU().FrameCount() != 1 {
+		t.Fatalf("Unexpected frame count %d", c.PPU().FrameCount())
+	}
+	// Frame is 89342 dots long, 3 dots per CPU cycle
+	start := c.cpu.cyclesPassed
+	c.StepFrame()
+	if n := c.cpu.cyclesPassed - start; n < 29780-8 || n > 29781+8 {
+		t.Fatalf("Unexpected number of CPU cycles %d in a frame", n)
+	}
+	if c.mem.ram[0] == 0 {
+		t.Fatalf("Program did not run")
+	}
+
+	c.PowerCycle()
+	if c.mem.ram[0] != 0 || c.CPU().PC != 0x8000 || c.PPU().FrameCount() != 0 {
+		t.Fatalf("Console state survived power cycle")
+	}
+}
+
+func TestConsoleJam(t *testing.T) {
+	rom := testRom(0, 1)
+	// NOP; KIL
+	copy(rom.prgRom, []byte{0xEA, 0x02})
+	c := NewConsole(rom)
+
+	frames := 0
+	err := c.RunFrames(10, func() error {
+		frames++
+		return nil
+	})
+	jam, ok := err.(*JamError)
+	if !ok {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if jam.Opcode != 0x02 || jam.PC != 0x8001 || frames != 0 {
+		t.Fatalf("Unexpected jam %v after %d frames", jam, frames)
+	}
+}
+
+func TestConsoleMovieCommands(t *testing.T) {
+	rom := testRom(0, 1)
+	// INC $00; JMP $8000
+	copy(rom.prgRom, []byte{0xE6, 0x00, 0x4C, 0x00, 0x80})
+	c := NewConsole(rom)
+
+	// VS System coins do not reset
+	c.MovieCommand(MovieVSInsertCoin)
+	c.StepFrame()
+	if c.mem.ram[0] == 0 || c.PPU().FrameCount() != 1 {
+		t.Fatalf("Console reset by coin command")
+	}
+
+	// Reset requested by the movie at vblank waits for the end of the frame
+	c.PPU().SetFrameHook(func() { c.MovieCommand(MovieHardReset) })
+	c.StepFrame()
+	if c.mem.ram[0] != 0 || c.PPU().FrameCount() != 0 || c.commands != 0 {
+		t.Fatalf("Power cycle not done at the end of the frame")
+	}
+}
+
+func TestConsoleMovieFromState(t *testing.T) {
+	rom := testRom(0, 1)
+	// INC $00; JMP $8000
+	copy(rom.prgRom, []byte{0xE6, 0x00, 0x4C, 0x00, 0x80})
+	c := NewConsole(rom)
+	c.StepFrame()
+	c.StepFrame()
+	movie := &Movie{}
+	pads := c.ConnectControllers(false)
+	recorder, err := c.RecordMovie(movie, []*Controller{NewController(), NewController()}, pads, true)
+	if err != nil {
+		t.Fatalf("Recording not started: %v", err)
+	}
+	start := c.mem.ram[0]
+	recorder.Command(MovieSoftReset)
+	c.StepFrame()
+	c.StepFrame()
+
+	var out bytes.Buffer
+	if err := movie.WriteFM2(&out); err != nil {
+		t.Fatalf("Failed to write movie: %v", err)
+	}
+	movie, err = ReadFM2(&out)
+	if err != nil {
+		t.Fatalf("Failed to read movie: %v", err)
+	}
+	if movie.Frames[1].Commands != MovieSoftReset {
+		t.Fatalf("Reset not recorded %+v", movie.Frames)
+	}
+
+	// Playback starts from the recorded state, not power on
+	played := NewConsole(rom)
+	if _, err := played.PlayMovie(movie, played.ConnectControllers(false)); err != nil {
+		t.Fatalf("Movie not played: %v", err)
+	}
+	if played.mem.ram[0] != start || played.PPU().FrameCount() != 2 {
+		t.Fatalf("Save state of the movie not loaded")
+	}
+	played.StepFrame()
+	played.StepFrame()
+	if played.mem.ram[0] != c.mem.ram[0] || played.CPU().PC != c.CPU().PC {
+		t.Fatalf("Playback desynced from recording")
+	}
+
+	// FCEUX snapshots are not darknes save states
+	if _, err := ReadFM2(strings.NewReader("version 3\nsavestate base64:AAAA\n")); err == nil {
+		t.Fatalf("Movie starting from FCEUX save state accepted")
+	}
+}
+
+func TestConsolePlayMovie(t *testing.T) {
+	c := NewConsole(testRom(0, 1))
+	pads := c.ConnectControllers(true)
+	if len(pads) != 4 {
+		t.Fatalf("Unexpected %d controllers with Four Score", len(pads))
+	}
+	movie := &Movie{Frames: []MovieFrame{
+		{Pads: [4]byte{1}},
+		{Commands: MovieSoftReset, Pads: [4]byte{0, 0, 0, 2}},
+	}}
+	if _, err := c.PlayMovie(movie, pads); err != nil {
+		t.Fatalf("Movie not played: %v", err)
+	}
+	if pads[0].Buttons() != 1 {
+		t.Fatalf("Input of the first frame not applied")
+	}
+	c.StepFrame()
+	if pads[3].Buttons() != 2 || c.commands != 0 || c.CPU().PC != 0x8000 {
+		t.Fatalf("Second movie frame not played")
+	}
+}
@@ -0,0 +1,100 @@
+package nes
+
+const (
+	// Controller port registers
+	Joypad1 uint16 = 0x4016
+	Joypad2 uint16 = 0x4017
+
+	// Upper bits of $4016/$4017 are not driven and keep
+	// the high byte of the address last seen on the bus
+	joypadOpenBus byte = 0x40
+)
+
+// Standard controller buttons in the order they are read
+const (
+	ButtonA = iota
+	ButtonB
+	ButtonSelect
+	ButtonStart
+	ButtonUp
+	ButtonDown
+	ButtonLeft
+	ButtonRight
+	ButtonCount
+)
+
+// ButtonNames are names of the controller buttons
+var ButtonNames = [ButtonCount]string{"A", "B", "Select", "Start", "Up", "Down", "Left", "Right"}
+
+// InputDevice is a device plugged into a controller port
+type InputDevice interface {
+	// Read returns data lines D0-D4 of the port
+	Read() byte
+	// Write receives $4016 writes, bit 0 is the strobe
+	Write(val byte)
+}
+
+// ExpansionDevice is a Famicom device plugged into the expansion port.
+// Unlike controllers it sees reads of both $4016 and $4017
+type ExpansionDevice interface {
+	// ReadExpansion returns data lines D0-D4 of $4016 (port 0) or $4017 (port 1)
+	ReadExpansion(port int) byte
+	// Write receives $4016 writes, bits 0-2 are OUT0-OUT2
+	Write(val byte)
+}
+
+// Controller is the standard NES joypad with 8-bit shift register
+type Controller struct {
+	buttons byte
+	shift   byte
+	strobe  bool
+}
+
+// NewController creates controller with no buttons pressed
+func NewController() *Controller {
+	return &Controller{}
+}
+
+// SetButton presses or releases the button
+func (c *Controller) SetButton(button int, pressed bool) {
+	if pressed {
+		c.buttons |= 1 << button
+	} else {
+		c.buttons &^= 1 << button
+	}
+}
+
+// Buttons returns state of all buttons, bit n is set when button n is pressed
+func (c *Controller) Buttons() byte {
+	return c.buttons
+}
+
+// SetButtons sets state of all buttons at once
+func (c *Controller) SetButtons(buttons byte) {
+	c.buttons = buttons
+}
+
+// state covers the latch, buttons follow the player
+func (c *Controller) state(s *stateBuffer) {
+	stateNum(s, &c.shift)
+	s.bool(&c.strobe)
+}
+
+// Write latches buttons while strobe is high
+func (c *Controller) Write(val byte) {
+	c.strobe = val&1 != 0
+	if c.strobe {
+		c.shift = c.buttons
+	}
+}
+
+// Read shifts out the next button, 1 is returned after all 8 are read
+func (c *Controller) Read() byte {
+	if c.strobe {
+		return c.buttons & 1
+	}
+	val := c.shift & 1
+	// Shift register is filled with ones from the serial input
+	c.shift = c.shift>>1 | 0x80
+	return val
+}
@@ -0,0 +1,33 @@
+package nes
+
+import (
+	"testing"
+)
+
+func TestControllerRead(t *testing.T) {
+	m := Memory{mapper: &NROM128{}}
+	pad := NewController()
+	m.ConnectInput(0, pad)
+	pad.SetButton(ButtonA, true)
+	pad.SetButton(ButtonStart, true)
+	pad.SetButton(ButtonRight, true)
+
+	m.Write(Joypad1, 1)
+	// Strobe held high keeps returning A
+	if m.Read(Joypad1) != 0x41 || m.Read(Joypad1) != 0x41 {
+		t.Fatalf("Unexpected read with strobe high")
+	}
+	m.Write(Joypad1, 0)
+
+	expected := []byte{1, 0, 0, 1, 0, 0, 0, 1, 1, 1}
+	for i, bit := range expected {
+		if v := m.Read(Joypad1); v != joypadOpenBus|bit {
+			t.Fatalf("Read %d returned %02x, expected %02x", i, v, joypadOpenBus|bit)
+		}
+	}
+
+	// Unconnected port returns open bus only
+	if v := m.Read(Joypad2); v != joypadOpenBus {
+		t.Fatalf("Unexpected read %02x from empty port", v)
+	}
+}
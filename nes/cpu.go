@@ -18,6 +18,10 @@ const (
 
 	prgStartAddr = 0x8000
 
+	// CPU clock rates in Hz
+	CPUClockNTSC = 1789773
+	CPUClockPAL  = 1662607
+
 	stackAddr uint16 = 0x0100
 )
 
@@ -41,6 +45,20 @@ type CPU struct {
 
 	// RAM
 	mem *Memory
+
+	// Print every executed instruction
+	trace bool
+}
+
+// JamError reports opcode the CPU cannot execute, such as KIL
+// which halts the real 6502 until reset
+type JamError struct {
+	Opcode byte
+	PC     uint16
+}
+
+func (e *JamError) Error() string {
+	return fmt.Sprintf("CPU jammed on opcode %02x at %04x", e.Opcode, e.PC)
 }
 
 type CpuState struct {
@@ -80,25 +98,62 @@ func (cpu *CPU) Reset() {
 	cpu.PC = a
 }
 
+func (cpu *CPU) state(s *stateBuffer) {
+	stateNum(s, &cpu.A)
+	stateNum(s, &cpu.X)
+	stateNum(s, &cpu.Y)
+	stateNum(s, &cpu.S)
+	stateNum(s, &cpu.PC)
+	stateNum(s, &cpu.P)
+	stateNum(s, &cpu.cycles)
+	stateNum(s, &cpu.cyclesPassed)
+}
+
+// SetTrace enables printing of executed instructions
+func (cpu *CPU) SetTrace(enabled bool) {
+	cpu.trace = enabled
+}
+
 // Step executes a single instruction
 func (cpu *CPU) Step() CpuState {
+	cpu.cycles = 0
+
+	// Service pending NMI or IRQ before fetching the next instruction
+	if cpu.mem.nmi() {
+		cpu.nmiInterrupt()
+	} else if cpu.mem.irq() && cpu.P&FlagInterruptDisable == 0 {
+		cpu.irqInterrupt()
+	}
+
 	// Read next instruction
 	op := cpu.mem.Read(cpu.PC)
 
 	// Identify and process the instruction
 	opcode, ok := opcodeMap[op]
 	if ok {
-		fmt.Printf("OP=%x Handler: %s\n", op, getFunctionName(opcode.Handler))
+		if cpu.trace {
+			fmt.Printf("OP=%x Handler: %s\n", op, getFunctionName(opcode.Handler))
+		}
 
 		// Execute instruction
 		opcode.Handler(cpu, opcode.mode)
 	} else {
-		panic(fmt.Sprintf("Opcode %x not recognized\n", op))
+		panic(&JamError{Opcode: op, PC: cpu.PC})
 	}
 
 	cpu.cycles += opcode.cycles
 	cpu.cyclesPassed += uint64(cpu.cycles)
 
+	// Clock APU and cartridge hardware (IRQ counters, expansion sound)
+	cpu.mem.clock(cpu.cycles)
+
+	// DMC sample fetches halt the CPU while the rest keeps running
+	for stall := cpu.mem.dmaStall(); stall > 0; stall = cpu.mem.dmaStall() {
+		cpu.cycles += stall
+		cpu.cyclesPassed += uint64(stall)
+		cpu.mem.clock(stall)
+	}
+
 	// Return current copy of CPU state for debugging
 	state := CpuState{A: cpu.A,
 		X:            cpu.X,
@@ -118,15 +173,28 @@ func (cpu *CPU) Step() CpuState {
 
 func (cpu *CPU) nmiInterrupt() {
 	cpu.pushWord(cpu.PC)
-	cpu.push(cpu.P)
-	// TODO unfinished
+	cpu.push(cpu.P &^ FlagBreakCommand)
 	cpu.setFlag(FlagInterruptDisable)
 
 	// fetch address vector
 	pcLow := cpu.mem.Read(0xFFFA)
 	pcHigh := cpu.mem.Read(0xFFFB)
 	// jump to the address
-	cpu.PC = uint16((pcHigh << 8) | pcLow)
+	cpu.PC = uint16(pcHigh)<<8 | uint16(pcLow)
+	cpu.cycles += 7
+}
+
+func (cpu *CPU) irqInterrupt() {
+	cpu.pushWord(cpu.PC)
+	cpu.push(cpu.P &^ FlagBreakCommand)
+	cpu.setFlag(FlagInterruptDisable)
+
+	// fetch address vector
+	pcLow := cpu.mem.Read(0xFFFE)
+	pcHigh := cpu.mem.Read(0xFFFF)
+	// jump to the address
+	cpu.PC = uint16(pcHigh)<<8 | uint16(pcLow)
+	cpu.cycles += 7
 }
 
 // Push value to stack
@@ -138,9 +206,8 @@ func (cpu *CPU) push(val byte) {
 
 // Pop value from stack
 func (cpu *CPU) pop() byte {
-	addr := stackAddr + uint16(cpu.S)
 	cpu.S++
-	return cpu.mem.Read(addr)
+	return cpu.mem.Read(stackAddr + uint16(cpu.S))
 }
 
 func (cpu *CPU) pushWord(val uint16) {
@@ -151,7 +218,7 @@ func (cpu *CPU) pushWord(val uint16) {
 func (cpu *CPU) popWord() uint16 {
 	lowByte := cpu.pop()
 	highByte := cpu.pop()
-	return uint16(highByte<<8 | lowByte)
+	return uint16(highByte)<<8 | uint16(lowByte)
 }
 
 // Sets flag in register P
@@ -163,11 +230,12 @@ func (cpu *CPU) clearFlag(flag byte) {
 	cpu.P &= ^flag
 }
 
+// Adds cycles taken by a branch on top of the base 2 cycles of the opcode
 func (cpu *CPU) setBranchCycles(addr uint16) {
 	if ((cpu.PC + 1) & 0xFF00 >> 8) != ((addr & 0xFF00) >> 8) {
-		cpu.cycles = 4
+		cpu.cycles += 2
 	} else {
-		cpu.cycles = 3
+		cpu.cycles++
 	}
 }
 
@@ -0,0 +1,80 @@
+package nes
+
+import (
+	"testing"
+)
+
+func TestVausRead(t *testing.T) {
+	m := Memory{mapper: &NROM128{}}
+	v := NewVaus()
+	m.ConnectInput(1, v)
+	v.Aim(0, 0)
+	v.SetTrigger(true)
+
+	m.Write(Joypad1, 1)
+	m.Write(Joypad1, 0)
+	var position byte
+	for i := 0; i < 8; i++ {
+		val := m.Read(Joypad2)
+		if val&0x08 == 0 {
+			t.Fatalf("Fire button not pressed")
+		}
+		position = position<<1 | val>>4&1
+	}
+	// Value is sent inverted
+	if ^position != vausMin {
+		t.Fatalf("Unexpected position %02x", ^position)
+	}
+}
+
+func TestPowerPadRead(t *testing.T) {
+	m := Memory{mapper: &NROM128{}}
+	p := NewPowerPad()
+	m.ConnectInput(1, p)
+	// Buttons 1 and 3 on the mat
+	p.SetButton(0, true)
+	p.SetButton(2, true)
+
+	m.Write(Joypad1, 1)
+	m.Write(Joypad1, 0)
+	var d3, d4 byte
+	for i := 0; i < 8; i++ {
+		val := m.Read(Joypad2)
+		d3 |= (val >> 3 & 1) << i
+		d4 |= (val >> 4 & 1) << i
+	}
+	if d3 != 0x02 || d4 != 0xF2 {
+		t.Fatalf("Unexpected Power Pad bits %02x %02x", d3, d4)
+	}
+
+	// Family Trainer reads the first row with bit 0 low
+	m.ConnectInput(1, nil)
+	m.ConnectExpansion(p)
+	m.Write(Joypad1, 0x06)
+	if val := m.Read(Joypad2) & 0x1E; val != 0x14 {
+		t.Fatalf("Unexpected Family Trainer row %02x", val)
+	}
+}
+
+func TestFamilyKeyboardScan(t *testing.T) {
+	m := Memory{mapper: &NROM128{}}
+	k := NewFamilyKeyboard()
+	m.ConnectExpansion(k)
+	// Q is in row 7, column 0
+	k.SetButton(57, true)
+
+	m.Write(Joypad1, 0x05)
+	for row := 0; row < familyKeyboardRows; row++ {
+		m.Write(Joypad1, 0x04)
+		left := m.Read(Joypad2) & 0x1E
+		m.Write(Joypad1, 0x06)
+		right := m.Read(Joypad2) & 0x1E
+		expected := byte(0x1E)
+		if row == 7 {
+			expected = 0x16
+		}
+		if left != expected || right != 0x1E {
+			t.Fatalf("Unexpected row %d: %02x %02x", row, left, right)
+		}
+	}
+}
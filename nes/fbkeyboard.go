@@ -0,0 +1,82 @@
+package nes
+
+const (
+	familyKeyboardRows = 9
+	// Each row has 2 columns of 4 keys
+	familyKeyboardKeys = familyKeyboardRows * 8
+)
+
+// FamilyKeyNames names keys of the Family BASIC keyboard. Key n is
+// in row n/8, column n%8/4, returned in $4017 bit 4-n%4
+var FamilyKeyNames = [familyKeyboardKeys]string{
+	"]", "[", "Return", "F8", "Stop", "Yen", "RShift", "Kana",
+	";", ":", "@", "F7", "^", "-", "/", "_",
+	"K", "L", "O", "F6", "0", "P", ",", ".",
+	"J", "U", "I", "F5", "8", "9", "N", "M",
+	"H", "G", "Y", "F4", "6", "7", "V", "B",
+	"D", "R", "T", "F3", "4", "5", "C", "F",
+	"A", "S", "W", "F2", "3", "E", "Z", "X",
+	"Ctrl", "Q", "Esc", "F1", "2", "1", "Grph", "LShift",
+	"Left", "Right", "Up", "Clr Home", "Ins", "Del", "Space", "Down",
+}
+
+// FamilyKeyboard is the Family BASIC keyboard attached to the expansion
+// port. $4016 writes reset the scan (bit 0), select column (bit 1, row
+// advances when it goes low) and enable the matrix (bit 2). Keys of the
+// selected row and column are read in $4017 D1-D4, pressed keys read as 0
+type FamilyKeyboard struct {
+	keys    [familyKeyboardKeys]bool
+	row     int
+	column  int
+	enabled bool
+}
+
+// NewFamilyKeyboard creates keyboard with no keys pressed
+func NewFamilyKeyboard() *FamilyKeyboard {
+	return &FamilyKeyboard{}
+}
+
+// SetButton presses or releases key, see FamilyKeyNames
+func (k *FamilyKeyboard) SetButton(key int, pressed bool) {
+	if key >= 0 && key < familyKeyboardKeys {
+		k.keys[key] = pressed
+	}
+}
+
+func (k *FamilyKeyboard) state(s *stateBuffer) {
+	stateNum(s, &k.row)
+	stateNum(s, &k.column)
+	s.bool(&k.enabled)
+}
+
+// Write advances keyboard scan
+func (k *FamilyKeyboard) Write(val byte) {
+	column := int(val>>1) & 1
+	if k.column == 1 && column == 0 {
+		k.row = (k.row + 1) % (familyKeyboardRows + 1)
+	}
+	k.column = column
+	if val&1 != 0 {
+		k.row, k.column = 0, 0
+	}
+	k.enabled = val&4 != 0
+}
+
+// ReadExpansion returns keys of the selected row and column in $4017 D1-D4
+func (k *FamilyKeyboard) ReadExpansion(port int) byte {
+	if port == 0 || !k.enabled {
+		return 0
+	}
+	// Scanning past the last row returns no keys pressed
+	if k.row >= familyKeyboardRows {
+		return 0x1E
+	}
+	var val byte
+	first := k.row*8 + k.column*4
+	for i := 0; i < 4; i++ {
+		if !k.keys[first+i] {
+			val |= 1 << (4 - i)
+		}
+	}
+	return val
+}
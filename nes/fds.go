@@ -0,0 +1,607 @@
+package nes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+const (
+	// iNES mapper number historically reserved for the Famicom Disk System
+	fdsMapperNum byte = 20
+
+	fdsHeaderLen   = 16
+	fdsSideSize    = 65500
+	fdsBiosSize    = 8 * 1024
+	fdsPrgRAMSize  = 32 * 1024
+	fdsChrRAMSize  = 8 * 1024
+	fdsBlockMarker = 0x80
+
+	// Gaps between blocks on the raw disk surface (in bytes)
+	fdsLeadingGap = 28300 / 8
+	fdsBlockGap   = 976 / 8
+
+	// CPU cycles needed to transfer a single byte
+	fdsByteCycles = 150
+	// CPU cycles needed for the head to rewind to the start of the disk
+	fdsRewindCycles = 50000
+	// CPU cycles the disk stays ejected when switching sides
+	fdsInsertDelay = 3000000
+)
+
+var fdsSideMagic = []byte("\x01*NINTENDO-HVC*")
+
+// LoadFdsData parses .fds disk image (with or without fwNES header)
+// and returns a cartridge running it with the given disksys.rom BIOS
+func LoadFdsData(diskData []byte, biosData []byte) (*Rom, error) {
+	if len(biosData) != fdsBiosSize {
+		return nil, fmt.Errorf("invalid FDS BIOS size %d", len(biosData))
+	}
+
+	// fwNES header: "FDS\x1a", number of sides, 11 bytes of padding
+	if bytes.HasPrefix(diskData, []byte("FDS\x1a")) {
+		diskData = diskData[fdsHeaderLen:]
+	}
+	if len(diskData) < fdsSideSize {
+		return nil, errors.New("FDS image is too short")
+	}
+
+	var sides [][]byte
+	for p := 0; p+fdsSideSize <= len(diskData); p += fdsSideSize {
+		side := diskData[p : p+fdsSideSize]
+		if !bytes.HasPrefix(side, fdsSideMagic) {
+			return nil, fmt.Errorf("FDS side %d has no disk header", len(sides))
+		}
+		sides = append(sides, side)
+	}
+
+	rom := &Rom{
+		data: diskData,
+		Header: &RomHeader{
+			MapperNum:  fdsMapperNum,
+			HasBattery: true,
+		},
+		prgRom: biosData,
+		disk:   sides,
+	}
+	rom.checksum()
+	return rom, nil
+}
+
+// Converts disk side into raw bitstream layout with gaps, block
+// start markers and CRCs in between the blocks
+func fdsRawSide(side []byte) []byte {
+	raw := make([]byte, fdsLeadingGap, fdsSideSize*2)
+	p := 0
+	for p < len(side) {
+		length := fdsBlockLength(side[p], side[:p])
+		if length == 0 || p+length > len(side) {
+			break
+		}
+		raw = append(raw, fdsBlockMarker)
+		raw = append(raw, side[p:p+length]...)
+		// CRC is not verified, a fixed value is stored
+		raw = append(raw, 0x4D, 0x62)
+		raw = append(raw, make([]byte, fdsBlockGap)...)
+		p += length
+	}
+	// Unused part of the disk stays available for writing
+	return append(raw, make([]byte, fdsSideSize-p)...)
+}
+
+// Returns length of the block with the given type, size of the file
+// data block is taken from the preceding file header. Returns 0 when
+// there are no more blocks
+func fdsBlockLength(blockType byte, before []byte) int {
+	switch blockType {
+	case 1: // Disk info
+		return 56
+	case 2: // File amount
+		return 2
+	case 3: // File header
+		return 16
+	case 4: // File data
+		if len(before) < 16 || before[len(before)-16] != 3 {
+			return 0
+		}
+		header := before[len(before)-16:]
+		return 1 + (int(header[13]) | int(header[14])<<8)
+	}
+	return 0
+}
+
+// Converts raw disk side back into .fds layout
+func fdsPackSide(raw []byte) []byte {
+	side := make([]byte, 0, fdsSideSize)
+	for p := 0; p < len(raw); {
+		// Skip the gap up to the block start marker
+		if raw[p] != fdsBlockMarker {
+			p++
+			continue
+		}
+		p++
+		if p >= len(raw) {
+			break
+		}
+		length := fdsBlockLength(raw[p], side)
+		if length == 0 || p+length > len(raw) {
+			break
+		}
+		side = append(side, raw[p:p+length]...)
+		// Skip CRC
+		p += length + 2
+	}
+	return fdsPadSide(side)
+}
+
+func fdsPadSide(side []byte) []byte {
+	if len(side) > fdsSideSize {
+		return side[:fdsSideSize]
+	}
+	return append(side, make([]byte, fdsSideSize-len(side))...)
+}
+
+// FDS emulates the Famicom Disk System RAM adapter and disk drive
+type FDS struct {
+	bios   []byte
+	prgRAM []byte
+	chrRAM []byte
+
+	// Raw disk sides, see fdsRawSide
+	sides    [][]byte
+	side     int
+	inserted bool
+	// Countdown to insert the next side when switching sides
+	insertDelay int
+
+	// Master I/O enable ($4023)
+	diskRegOn  bool
+	soundRegOn bool
+
+	// Timer IRQ ($4020-$4022)
+	irqReload    uint16
+	irqCounter   uint16
+	irqRepeat    bool
+	irqEnabled   bool
+	timerIrq     bool
+	diskIrq      bool
+	diskIrqOn    bool
+	transferDone bool
+
+	// Drive control ($4025)
+	motorOn       bool
+	resetTransfer bool
+	readMode      bool
+	crcControl    bool
+	diskReady     bool
+	mirroring     Mirroring
+
+	// Disk head
+	position   int
+	delay      int
+	endOfHead  bool
+	scanning   bool
+	gapEnded   bool
+	prevCrc    bool
+	crc        uint16
+	readData   byte
+	writeData  byte
+	extConnect byte
+
+	audio *FdsAudio
+}
+
+// NewFDS creates RAM adapter with the first disk side inserted
+func NewFDS(rom *Rom) *FDS {
+	m := &FDS{
+		bios:      rom.prgRom,
+		prgRAM:    make([]byte, fdsPrgRAMSize),
+		chrRAM:    make([]byte, fdsChrRAMSize),
+		inserted:  true,
+		endOfHead: true,
+		audio:     NewFdsAudio(),
+	}
+	for _, side := range rom.disk {
+		m.sides = append(m.sides, fdsRawSide(side))
+	}
+	return m
+}
+
+// state covers disk contents too, games save to the disk
+func (m *FDS) state(s *stateBuffer) {
+	s.block(m.prgRAM)
+	s.block(m.chrRAM)
+	sides := len(m.sides)
+	stateNum(s, &sides)
+	if sides != len(m.sides) {
+		s.fail(fmt.Errorf("%d disk sides, expected %d", sides, len(m.sides)))
+		return
+	}
+	for _, side := range m.sides {
+		s.block(side)
+	}
+	stateNum(s, &m.side)
+	s.bool(&m.inserted)
+	stateNum(s, &m.insertDelay)
+	s.bool(&m.diskRegOn)
+	s.bool(&m.soundRegOn)
+	stateNum(s, &m.irqReload)
+	stateNum(s, &m.irqCounter)
+	s.bool(&m.irqRepeat)
+	s.bool(&m.irqEnabled)
+	s.bool(&m.timerIrq)
+	s.bool(&m.diskIrq)
+	s.bool(&m.diskIrqOn)
+	s.bool(&m.transferDone)
+	s.bool(&m.motorOn)
+	s.bool(&m.resetTransfer)
+	s.bool(&m.readMode)
+	s.bool(&m.crcControl)
+	s.bool(&m.diskReady)
+	stateNum(s, &m.mirroring)
+	stateNum(s, &m.position)
+	stateNum(s, &m.delay)
+	s.bool(&m.endOfHead)
+	s.bool(&m.scanning)
+	s.bool(&m.gapEnded)
+	s.bool(&m.prevCrc)
+	stateNum(s, &m.crc)
+	stateNum(s, &m.readData)
+	stateNum(s, &m.writeData)
+	stateNum(s, &m.extConnect)
+	m.audio.state(s)
+}
+
+// Translate is a no-op, RAM adapter serves cartridge space by itself
+func (m *FDS) Translate(addr uint16) uint16 {
+	return addr
+}
+
+// ReadPrg reads a byte from the cartridge space
+func (m *FDS) ReadPrg(addr uint16) byte {
+	switch {
+	case addr == 0x4030:
+		return m.readStatus()
+	case addr == 0x4031:
+		m.transferDone = false
+		m.diskIrq = false
+		return m.readData
+	case addr == 0x4032:
+		return m.readDriveStatus()
+	case addr == 0x4033:
+		// Battery is good
+		return 0x80 | m.extConnect&0x7F
+	case addr >= 0x4040 && addr < 0x40A0:
+		if m.soundRegOn {
+			return m.audio.Read(addr)
+		}
+	case addr >= 0x6000 && addr < 0xE000:
+		return m.prgRAM[addr-0x6000]
+	case addr >= 0xE000:
+		return m.bios[addr-0xE000]
+	}
+	return 0
+}
+
+// WritePrg handles writes into PRG RAM and RAM adapter registers
+func (m *FDS) WritePrg(addr uint16, val byte) {
+	switch {
+	case addr >= 0x4020 && addr <= 0x4026:
+		m.writeRegister(addr, val)
+	case addr >= 0x4040 && addr < 0x40A0:
+		if m.soundRegOn {
+			m.audio.Write(addr, val)
+		}
+	case addr >= 0x6000 && addr < 0xE000:
+		m.prgRAM[addr-0x6000] = val
+	}
+}
+
+func (m *FDS) writeRegister(addr uint16, val byte) {
+	if addr != 0x4023 && !m.diskRegOn {
+		return
+	}
+	switch addr {
+	case 0x4020:
+		m.irqReload = m.irqReload&0xFF00 | uint16(val)
+	case 0x4021:
+		m.irqReload = m.irqReload&0x00FF | uint16(val)<<8
+	case 0x4022:
+		m.irqRepeat = val&0x01 != 0
+		m.irqEnabled = val&0x02 != 0
+		if m.irqEnabled {
+			m.irqCounter = m.irqReload
+		} else {
+			m.timerIrq = false
+		}
+	case 0x4023:
+		m.diskRegOn = val&0x01 != 0
+		m.soundRegOn = val&0x02 != 0
+		if !m.diskRegOn {
+			m.irqEnabled = false
+			m.timerIrq = false
+			m.diskIrq = false
+		}
+	case 0x4024:
+		m.writeData = val
+		m.transferDone = false
+		m.diskIrq = false
+	case 0x4025:
+		m.motorOn = val&0x01 != 0
+		m.resetTransfer = val&0x02 != 0
+		m.readMode = val&0x04 != 0
+		m.mirroring = MirrorVertical
+		if val&0x08 != 0 {
+			m.mirroring = MirrorHorizontal
+		}
+		m.crcControl = val&0x10 != 0
+		m.diskReady = val&0x40 != 0
+		m.diskIrqOn = val&0x80 != 0
+		m.diskIrq = false
+	case 0x4026:
+		m.extConnect = val
+	}
+}
+
+func (m *FDS) readStatus() byte {
+	var v byte
+	if m.timerIrq {
+		v |= 0x01
+	}
+	if m.transferDone {
+		v |= 0x02
+	}
+	if m.endOfHead {
+		v |= 0x40
+	}
+	m.transferDone = false
+	m.timerIrq = false
+	m.diskIrq = false
+	return v
+}
+
+func (m *FDS) readDriveStatus() byte {
+	v := byte(0x40)
+	if !m.inserted {
+		v |= 0x01 | 0x04
+	}
+	if !m.inserted || !m.scanning {
+		v |= 0x02
+	}
+	return v
+}
+
+// ReadChr reads a byte from CHR RAM
+func (m *FDS) ReadChr(addr uint16) byte {
+	return m.chrRAM[addr&0x1FFF]
+}
+
+// WriteChr writes a byte into CHR RAM
+func (m *FDS) WriteChr(addr uint16, val byte) {
+	m.chrRAM[addr&0x1FFF] = val
+}
+
+// Mirroring returns nametable mirroring selected through $4025
+func (m *FDS) Mirroring() Mirroring {
+	return m.mirroring
+}
+
+// Clock runs timer IRQ, disk drive and sound for the given CPU cycles
+func (m *FDS) Clock(cycles uint16) {
+	for i := uint16(0); i < cycles; i++ {
+		m.clockTimer()
+		m.clockDrive()
+	}
+	m.audio.Clock(cycles)
+}
+
+func (m *FDS) clockTimer() {
+	if !m.irqEnabled {
+		return
+	}
+	if m.irqCounter == 0 {
+		m.timerIrq = true
+		m.irqCounter = m.irqReload
+		if !m.irqRepeat {
+			m.irqEnabled = false
+		}
+		return
+	}
+	m.irqCounter--
+}
+
+func (m *FDS) clockDrive() {
+	if m.insertDelay > 0 {
+		m.insertDelay--
+		if m.insertDelay == 0 {
+			m.inserted = true
+		}
+		return
+	}
+	if !m.inserted || !m.motorOn {
+		m.endOfHead = true
+		m.scanning = false
+		return
+	}
+	if m.resetTransfer && !m.scanning {
+		return
+	}
+	if m.endOfHead {
+		// Head returns to the beginning of the disk
+		m.delay = fdsRewindCycles
+		m.endOfHead = false
+		m.position = 0
+		m.gapEnded = false
+		return
+	}
+	if m.delay > 0 {
+		m.delay--
+		return
+	}
+
+	m.scanning = true
+	raw := m.sides[m.side]
+	if m.readMode {
+		m.readByte(raw[m.position])
+	} else {
+		raw[m.position] = m.writeByte()
+	}
+	m.prevCrc = m.crcControl
+
+	m.position++
+	if m.position >= len(raw) {
+		m.motorOn = false
+		m.endOfHead = true
+		return
+	}
+	m.delay = fdsByteCycles
+}
+
+// Handles byte passing under the head in read mode
+func (m *FDS) readByte(data byte) {
+	if !m.prevCrc {
+		m.updateCrc(data)
+	}
+	irq := m.diskIrqOn
+	switch {
+	case !m.diskReady:
+		m.gapEnded = false
+		m.crc = 0
+	case data != 0 && !m.gapEnded:
+		// Block start marker ends the gap, it is not delivered to the CPU
+		m.gapEnded = true
+		irq = false
+	}
+	if m.gapEnded {
+		m.transferDone = true
+		m.readData = data
+		if irq {
+			m.diskIrq = true
+		}
+	}
+}
+
+// Returns byte to be written under the head in write mode
+func (m *FDS) writeByte() byte {
+	var data byte
+	if !m.crcControl {
+		m.transferDone = true
+		data = m.writeData
+		if m.diskIrqOn {
+			m.diskIrq = true
+		}
+	}
+	if !m.diskReady {
+		data = 0
+	}
+	if !m.crcControl {
+		m.updateCrc(data)
+	} else {
+		if !m.prevCrc {
+			m.updateCrc(0)
+			m.updateCrc(0)
+		}
+		data = byte(m.crc)
+		m.crc >>= 8
+	}
+	m.gapEnded = false
+	return data
+}
+
+// CRC-16 (polynomial 0x8408) as computed by the RAM adapter
+func (m *FDS) updateCrc(val byte) {
+	for n := 0x01; n <= 0x80; n <<= 1 {
+		carry := m.crc&1 != 0
+		m.crc >>= 1
+		if carry {
+			m.crc ^= 0x8408
+		}
+		if val&byte(n) != 0 {
+			m.crc ^= 0x8000
+		}
+	}
+}
+
+// IRQ reports whether timer or disk transfer IRQ is pending
+func (m *FDS) IRQ() bool {
+	return m.timerIrq || m.diskIrq
+}
+
+// Sample returns current FDS sound channel output
+func (m *FDS) Sample() float32 {
+	return m.audio.Sample()
+}
+
+// SideCount returns number of disk sides in the image
+func (m *FDS) SideCount() int {
+	return len(m.sides)
+}
+
+// CurrentSide returns index of inserted side or -1 when ejected
+func (m *FDS) CurrentSide() int {
+	if !m.inserted {
+		return -1
+	}
+	return m.side
+}
+
+// EjectDisk removes disk from the drive
+func (m *FDS) EjectDisk() {
+	m.inserted = false
+	m.insertDelay = 0
+}
+
+// InsertDisk inserts the given disk side into the drive
+func (m *FDS) InsertDisk(side int) {
+	if side < 0 || side >= len(m.sides) {
+		return
+	}
+	m.side = side
+	m.inserted = true
+	m.insertDelay = 0
+}
+
+// SwitchSide ejects the disk and inserts the next side after a delay
+// long enough for the BIOS to notice the disk change
+func (m *FDS) SwitchSide() {
+	m.inserted = false
+	m.side = (m.side + 1) % len(m.sides)
+	m.insertDelay = fdsInsertDelay
+}
+
+// ToggleDisk ejects the disk or inserts the selected side back
+func (m *FDS) ToggleDisk() {
+	if m.inserted || m.insertDelay > 0 {
+		m.EjectDisk()
+	} else {
+		m.InsertDisk(m.side)
+	}
+}
+
+// SelectSide selects the next side to be inserted by ToggleDisk,
+// the disk must be ejected
+func (m *FDS) SelectSide() {
+	if !m.inserted && m.insertDelay == 0 {
+		m.side = (m.side + 1) % len(m.sides)
+	}
+}
+
+// SaveData returns disk image in .fds format with all modifications
+func (m *FDS) SaveData() []byte {
+	data := make([]byte, 0, len(m.sides)*fdsSideSize)
+	for _, raw := range m.sides {
+		data = append(data, fdsPackSide(raw)...)
+	}
+	return data
+}
+
+// LoadSaveData replaces the disk with previously saved image
+func (m *FDS) LoadSaveData(data []byte) {
+	for i := range m.sides {
+		p := i * fdsSideSize
+		if p+fdsSideSize > len(data) || !bytes.HasPrefix(data[p:], fdsSideMagic) {
+			return
+		}
+		m.sides[i] = fdsRawSide(data[p : p+fdsSideSize])
+	}
+}
@@ -0,0 +1,242 @@
+package nes
+
+// Modulation table values, 4 resets the modulation counter
+var fdsModSteps = [8]int8{0, 1, 2, 4, 0, -4, -2, -1}
+
+// Master volume scaling selected by bits 0-1 of $4089
+var fdsMasterVolume = [4]float32{2.0 / 2, 2.0 / 3, 2.0 / 4, 2.0 / 5}
+
+// fdsEnvelope is the volume or modulation envelope unit
+type fdsEnvelope struct {
+	disabled bool
+	increase bool
+	speed    byte
+	gain     byte
+	counter  uint32
+}
+
+func (e *fdsEnvelope) state(s *stateBuffer) {
+	s.bool(&e.disabled)
+	s.bool(&e.increase)
+	stateNum(s, &e.speed)
+	stateNum(s, &e.gain)
+	stateNum(s, &e.counter)
+}
+
+func (e *fdsEnvelope) write(val byte) {
+	e.disabled = val&0x80 != 0
+	e.increase = val&0x40 != 0
+	e.speed = val & 0x3F
+	e.counter = 0
+	if e.disabled {
+		e.gain = e.speed
+	}
+}
+
+// Ticks every 8 * (master speed + 1) * (speed + 1) CPU cycles
+func (e *fdsEnvelope) clock(masterSpeed byte) {
+	if e.disabled {
+		return
+	}
+	e.counter++
+	if e.counter < 8*(uint32(masterSpeed)+1)*(uint32(e.speed)+1) {
+		return
+	}
+	e.counter = 0
+	if e.increase && e.gain < 32 {
+		e.gain++
+	} else if !e.increase && e.gain > 0 {
+		e.gain--
+	}
+}
+
+// FdsAudio is the FDS wavetable sound channel with frequency modulation
+type FdsAudio struct {
+	wave      [64]byte
+	waveWrite bool
+	waveHalt  bool
+	waveFreq  uint16
+	waveAcc   uint32
+	output    byte
+
+	volume       fdsEnvelope
+	modEnvelope  fdsEnvelope
+	envHalt      bool
+	masterSpeed  byte
+	masterVolume byte
+
+	modTable   [64]byte
+	modPos     byte
+	modFreq    uint16
+	modAcc     uint32
+	modCounter int8
+	modHalt    bool
+}
+
+func (a *FdsAudio) state(s *stateBuffer) {
+	s.bytes(a.wave[:])
+	s.bool(&a.waveWrite)
+	s.bool(&a.waveHalt)
+	stateNum(s, &a.waveFreq)
+	stateNum(s, &a.waveAcc)
+	stateNum(s, &a.output)
+	a.volume.state(s)
+	a.modEnvelope.state(s)
+	s.bool(&a.envHalt)
+	stateNum(s, &a.masterSpeed)
+	stateNum(s, &a.masterVolume)
+	s.bytes(a.modTable[:])
+	stateNum(s, &a.modPos)
+	stateNum(s, &a.modFreq)
+	stateNum(s, &a.modAcc)
+	stateNum(s, &a.modCounter)
+	s.bool(&a.modHalt)
+}
+
+// NewFdsAudio creates FDS sound channel in its power up state
+func NewFdsAudio() *FdsAudio {
+	return &FdsAudio{masterSpeed: 0xE8}
+}
+
+// Read handles reads from $4040-$409F
+func (a *FdsAudio) Read(addr uint16) byte {
+	switch {
+	case addr < 0x4080:
+		return a.wave[addr-0x4040] | 0x40
+	case addr == 0x4090:
+		return a.volume.gain | 0x40
+	case addr == 0x4092:
+		return a.modEnvelope.gain | 0x40
+	}
+	return 0
+}
+
+// Write handles writes to $4040-$409F
+func (a *FdsAudio) Write(addr uint16, val byte) {
+	switch {
+	case addr < 0x4080:
+		if a.waveWrite {
+			a.wave[addr-0x4040] = val & 0x3F
+		}
+	case addr == 0x4080:
+		a.volume.write(val)
+	case addr == 0x4082:
+		a.waveFreq = a.waveFreq&0x0F00 | uint16(val)
+	case addr == 0x4083:
+		a.waveFreq = a.waveFreq&0x00FF | uint16(val&0x0F)<<8
+		a.envHalt = val&0x40 != 0
+		a.waveHalt = val&0x80 != 0
+		if a.waveHalt {
+			a.waveAcc = 0
+		}
+	case addr == 0x4084:
+		a.modEnvelope.write(val)
+	case addr == 0x4085:
+		a.modCounter = int8(val<<1) >> 1
+	case addr == 0x4086:
+		a.modFreq = a.modFreq&0x0F00 | uint16(val)
+	case addr == 0x4087:
+		a.modFreq = a.modFreq&0x00FF | uint16(val&0x0F)<<8
+		a.modHalt = val&0x80 != 0
+		if a.modHalt {
+			a.modAcc = 0
+		}
+	case addr == 0x4088:
+		// Table is writable only while modulation is halted,
+		// each write fills two consecutive entries
+		if a.modHalt {
+			a.modTable[a.modPos&0x3F] = val & 0x07
+			a.modTable[(a.modPos+1)&0x3F] = val & 0x07
+			a.modPos = (a.modPos + 2) & 0x3F
+		}
+	case addr == 0x4089:
+		a.waveWrite = val&0x80 != 0
+		a.masterVolume = val & 0x03
+	case addr == 0x408A:
+		a.masterSpeed = val
+	}
+}
+
+// Clock advances the channel by the given number of CPU cycles
+func (a *FdsAudio) Clock(cycles uint16) {
+	for i := uint16(0); i < cycles; i++ {
+		a.clock()
+	}
+}
+
+func (a *FdsAudio) clock() {
+	if !a.envHalt && !a.waveHalt && a.masterSpeed != 0 {
+		a.volume.clock(a.masterSpeed)
+		a.modEnvelope.clock(a.masterSpeed)
+	}
+
+	if !a.modHalt && a.modFreq != 0 {
+		a.modAcc += uint32(a.modFreq)
+		if a.modAcc >= 0x10000 {
+			a.modAcc -= 0x10000
+			a.stepModulator()
+		}
+	}
+
+	if a.waveHalt || a.waveWrite {
+		return
+	}
+	a.waveAcc += a.pitch()
+	if a.waveAcc >= 0x10000*64 {
+		a.waveAcc -= 0x10000 * 64
+	}
+	a.output = a.wave[a.waveAcc>>16]
+}
+
+func (a *FdsAudio) stepModulator() {
+	step := a.modTable[a.modPos]
+	a.modPos = (a.modPos + 1) & 0x3F
+	if step == 4 {
+		a.modCounter = 0
+		return
+	}
+	// Counter is a 7-bit signed value
+	a.modCounter = int8(byte(a.modCounter+fdsModSteps[step])<<1) >> 1
+}
+
+// Computes wave frequency adjusted by the modulator
+func (a *FdsAudio) pitch() uint32 {
+	temp := int32(a.modCounter) * int32(a.modEnvelope.gain)
+	remainder := temp & 0x0F
+	temp >>= 4
+	if remainder > 0 && temp&0x80 == 0 {
+		if a.modCounter < 0 {
+			temp--
+		} else {
+			temp += 2
+		}
+	}
+	if temp >= 192 {
+		temp -= 256
+	} else if temp < -64 {
+		temp += 256
+	}
+
+	temp = int32(a.waveFreq) * temp
+	remainder = temp & 0x3F
+	temp >>= 6
+	if remainder >= 32 {
+		temp++
+	}
+
+	freq := int32(a.waveFreq) + temp
+	if freq < 0 {
+		return 0
+	}
+	return uint32(freq)
+}
+
+// Sample returns channel output in range [0, 1]
+func (a *FdsAudio) Sample() float32 {
+	gain := a.volume.gain
+	if gain > 32 {
+		gain = 32
+	}
+	level := float32(a.output) * float32(gain) / (63 * 32)
+	return level * fdsMasterVolume[a.masterVolume]
+}
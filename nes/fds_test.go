@@ -0,0 +1,345 @@
+package nes
+
+import (
+	"bytes"
+	"crypto/md5"
+	"testing"
+)
+
+func testFdsSide() []byte {
+	side := make([]byte, fdsSideSize)
+	copy(side, fdsSideMagic)
+	// Disk info block is 56 bytes long
+	p := 56
+	// File amount
+	p += copy(side[p:], []byte{2, 1})
+	// File header with 3 bytes of data
+	header := make([]byte, 16)
+	header[0] = 3
+	header[13] = 3
+	p += copy(side[p:], header)
+	copy(side[p:], []byte{4, 0xAA, 0xBB, 0xCC})
+	return side
+}
+
+func TestFdsRawSideRoundTrip(t *testing.T) {
+	side := testFdsSide()
+	raw := fdsRawSide(side)
+
+	if raw[fdsLeadingGap] != fdsBlockMarker {
+		t.Fatalf("Block marker missing after leading gap")
+	}
+	if packed := fdsPackSide(raw); !bytes.Equal(packed, side) {
+		t.Fatalf("Disk side changed after round trip")
+	}
+}
+
+func TestLoadFdsData(t *testing.T) {
+	side := testFdsSide()
+	image := append([]byte("FDS\x1a\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), side...)
+	image = append(image, side...)
+
+	rom, err := LoadFdsData(image, make([]byte, fdsBiosSize))
+	if err != nil {
+		t.Fatalf("Failed to load FDS image: %v", err)
+	}
+	if len(rom.disk) != 2 {
+		t.Fatalf("Expected 2 disk sides, got %d", len(rom.disk))
+	}
+	if rom.MD5 != md5.Sum(append(bytes.Clone(side), side...)) {
+		t.Fatalf("MD5 of disk sides not computed")
+	}
+
+	if _, err := LoadFdsData(image, nil); err == nil {
+		t.Fatalf("Missing BIOS not reported")
+	}
+}
+
+func TestFdsMovieCommands(t *testing.T) {
+	side := testFdsSide()
+	image := append(bytes.Clone(side), side...)
+	rom, err := LoadFdsData(image, make([]byte, fdsBiosSize))
+	if err != nil {
+		t.Fatalf("Failed to load FDS image: %v", err)
+	}
+	c := NewConsole(rom)
+	disk := c.mem.mapper.(*FDS)
+
+	c.MovieCommand(MovieFDSInsert)
+	c.StepFrame()
+	if disk.CurrentSide() != -1 {
+		t.Fatalf("Disk not ejected")
+	}
+	c.MovieCommand(MovieFDSSelect)
+	c.StepFrame()
+	c.MovieCommand(MovieFDSInsert)
+	c.StepFrame()
+	if disk.CurrentSide() != 1 {
+		t.Fatalf("Unexpected side %d inserted", disk.CurrentSide())
+	}
+}
+
+func testFDS(t *testing.T) *FDS {
+	rom, err := LoadFdsData(testFdsSide(), make([]byte, fdsBiosSize))
+	if err != nil {
+		t.Fatalf("Failed to load FDS image: %v", err)
+	}
+	return NewFDS(rom)
+}
+
+// clockFDS runs the RAM adapter for any number of CPU cycles
+func clockFDS(m *FDS, cycles int) {
+	for ; cycles > 0; cycles-- {
+		m.Clock(1)
+	}
+}
+
+func TestFdsTimerIRQ(t *testing.T) {
+	m := testFDS(t)
+	// Timer registers are ignored until disk I/O is enabled
+	m.WritePrg(0x4020, 10)
+	if m.irqReload != 0 {
+		t.Fatalf("Timer reload written with disk I/O disabled")
+	}
+	m.WritePrg(0x4023, 0x01)
+	m.WritePrg(0x4020, 10)
+	m.WritePrg(0x4021, 0)
+	// Enabled with repeat
+	m.WritePrg(0x4022, 0x03)
+
+	for n := 0; n < 2; n++ {
+		clockFDS(m, 10)
+		if m.IRQ() {
+			t.Fatalf("Timer IRQ %d raised too early", n)
+		}
+		clockFDS(m, 1)
+		if !m.IRQ() {
+			t.Fatalf("Timer IRQ %d not raised", n)
+		}
+		// Reading the status acknowledges the IRQ
+		if v := m.ReadPrg(0x4030); v&0x01 == 0 || m.IRQ() {
+			t.Fatalf("Timer IRQ %d not acknowledged, status %02x", n, v)
+		}
+	}
+
+	// Without repeat the timer stops after the IRQ
+	m.WritePrg(0x4022, 0x02)
+	clockFDS(m, 11)
+	m.ReadPrg(0x4030)
+	clockFDS(m, 100)
+	if m.IRQ() {
+		t.Fatalf("Timer not stopped after IRQ")
+	}
+
+	// Disabling disk I/O stops the timer and clears its IRQ
+	m.WritePrg(0x4022, 0x03)
+	clockFDS(m, 11)
+	m.WritePrg(0x4023, 0x00)
+	clockFDS(m, 100)
+	if m.IRQ() || m.irqEnabled {
+		t.Fatalf("Timer not stopped by $4023")
+	}
+}
+
+func TestFdsDriveTransfer(t *testing.T) {
+	m := testFDS(t)
+	m.WritePrg(0x4023, 0x01)
+	if v := m.ReadPrg(0x4032); v != 0x42 {
+		t.Fatalf("Unexpected drive status %02x of an idle drive", v)
+	}
+	// Motor on, read mode, disk ready, transfer IRQ enabled
+	m.WritePrg(0x4025, 0xC5)
+
+	// Head rewinds, then every byte takes its time to pass the head
+	clockFDS(m, 1+fdsRewindCycles+1+(fdsByteCycles+1)*fdsLeadingGap)
+	if m.IRQ() {
+		t.Fatalf("Block start marker raised disk IRQ")
+	}
+	if v := m.ReadPrg(0x4032); v != 0x40 {
+		t.Fatalf("Unexpected drive status %02x while scanning", v)
+	}
+	clockFDS(m, fdsByteCycles)
+	if m.IRQ() {
+		t.Fatalf("Disk IRQ raised before the byte arrived")
+	}
+	clockFDS(m, 1)
+	if !m.IRQ() {
+		t.Fatalf("Disk IRQ not raised for the first byte")
+	}
+	// Reading data acknowledges the IRQ
+	if v := m.ReadPrg(0x4031); v != fdsSideMagic[0] || m.IRQ() {
+		t.Fatalf("Unexpected first byte %02x", v)
+	}
+
+	clockFDS(m, fdsByteCycles+1)
+	if v := m.ReadPrg(0x4030); v&0x02 == 0 || m.IRQ() {
+		t.Fatalf("Transfer not reported by status %02x", v)
+	}
+	if v := m.ReadPrg(0x4031); v != fdsSideMagic[1] {
+		t.Fatalf("Unexpected second byte %02x", v)
+	}
+
+	// Writing data acknowledges the IRQ too
+	clockFDS(m, fdsByteCycles+1)
+	m.WritePrg(0x4024, 0)
+	if m.IRQ() {
+		t.Fatalf("Disk IRQ not acknowledged by $4024")
+	}
+
+	m.EjectDisk()
+	if v := m.ReadPrg(0x4032); v != 0x47 {
+		t.Fatalf("Unexpected drive status %02x without disk", v)
+	}
+}
+
+func TestFdsStatusRegisters(t *testing.T) {
+	m := testFDS(t)
+	// Head is at its end until the motor starts
+	if v := m.ReadPrg(0x4030); v != 0x40 {
+		t.Fatalf("Unexpected status %02x", v)
+	}
+	m.WritePrg(0x4023, 0x01)
+	m.WritePrg(0x4026, 0x7F)
+	if v := m.ReadPrg(0x4033); v != 0xFF {
+		t.Fatalf("Unexpected expansion port %02x", v)
+	}
+	m.WritePrg(0x4025, 0x08)
+	if m.Mirroring() != MirrorHorizontal {
+		t.Fatalf("Horizontal mirroring not selected")
+	}
+	m.WritePrg(0x4025, 0x00)
+	if m.Mirroring() != MirrorVertical {
+		t.Fatalf("Vertical mirroring not selected")
+	}
+}
+
+func TestFdsAudioWavetable(t *testing.T) {
+	m := testFDS(t)
+	// Sound registers are ignored until sound I/O is enabled
+	m.WritePrg(0x4089, 0x80)
+	m.WritePrg(0x4040, 0x3F)
+	if v := m.ReadPrg(0x4040); v != 0 {
+		t.Fatalf("Sound register read %02x with sound I/O disabled", v)
+	}
+
+	m.WritePrg(0x4023, 0x02)
+	m.WritePrg(0x4089, 0x80)
+	for addr := uint16(0x4040); addr < 0x4080; addr++ {
+		m.WritePrg(addr, 0xFF)
+	}
+	if v := m.ReadPrg(0x4040); v != 0x7F {
+		t.Fatalf("Unexpected wavetable read %02x", v)
+	}
+	// Wavetable is write protected unless enabled by $4089
+	m.WritePrg(0x4089, 0x00)
+	m.WritePrg(0x4040, 0x01)
+	if v := m.ReadPrg(0x4040); v != 0x7F {
+		t.Fatalf("Wavetable written while protected")
+	}
+
+	// Volume envelope disabled sets the gain directly
+	m.WritePrg(0x4080, 0xA0)
+	m.WritePrg(0x4082, 0x00)
+	m.WritePrg(0x4083, 0x01)
+	m.Clock(1)
+	if s := m.Sample(); s != 1 {
+		t.Fatalf("Unexpected sample %v at full volume", s)
+	}
+	m.WritePrg(0x4089, 0x03)
+	if s := m.Sample(); s != 0.4 {
+		t.Fatalf("Unexpected sample %v at 2/5 master volume", s)
+	}
+}
+
+func TestFdsAudioEnvelope(t *testing.T) {
+	m := testFDS(t)
+	m.WritePrg(0x4023, 0x02)
+	// Envelope ticks every 8 * 2 * 1 cycles
+	m.WritePrg(0x408A, 0x01)
+	m.WritePrg(0x4080, 0x40)
+	m.WritePrg(0x4083, 0x00)
+	m.Clock(15)
+	if v := m.ReadPrg(0x4090); v != 0x40 {
+		t.Fatalf("Volume envelope ticked too early, gain %02x", v)
+	}
+	m.Clock(1)
+	if v := m.ReadPrg(0x4090); v != 0x41 {
+		t.Fatalf("Volume envelope not increased, gain %02x", v)
+	}
+
+	// Envelopes are halted by $4083
+	m.WritePrg(0x4083, 0x40)
+	m.Clock(32)
+	if v := m.ReadPrg(0x4090); v != 0x41 {
+		t.Fatalf("Halted volume envelope changed, gain %02x", v)
+	}
+
+	// Decreasing envelope stops at zero
+	m.WritePrg(0x4080, 0x00)
+	m.WritePrg(0x4083, 0x00)
+	m.Clock(64)
+	if v := m.ReadPrg(0x4090); v != 0x40 {
+		t.Fatalf("Volume envelope not decreased, gain %02x", v)
+	}
+
+	m.WritePrg(0x4084, 0x80|0x12)
+	if v := m.ReadPrg(0x4092); v != 0x52 {
+		t.Fatalf("Unexpected modulation gain %02x", v)
+	}
+}
+
+func TestFdsAudioModulation(t *testing.T) {
+	m := testFDS(t)
+	m.WritePrg(0x4023, 0x02)
+	a := m.audio
+
+	// Modulation table is writable only while modulation is halted
+	m.WritePrg(0x4088, 0x01)
+	if a.modTable[0] != 0 {
+		t.Fatalf("Modulation table written while running")
+	}
+	m.WritePrg(0x4087, 0x80)
+	m.WritePrg(0x4088, 0x01)
+	m.WritePrg(0x4088, 0x04)
+	for i := 0; i < 30; i++ {
+		m.WritePrg(0x4088, 0x00)
+	}
+	if a.modTable[1] != 1 || a.modTable[2] != 4 || a.modPos != 0 {
+		t.Fatalf("Unexpected modulation table %v", a.modTable)
+	}
+
+	// $4085 sets 7-bit signed counter
+	m.WritePrg(0x4085, 0x7F)
+	if a.modCounter != -1 {
+		t.Fatalf("Unexpected modulation counter %d", a.modCounter)
+	}
+	m.WritePrg(0x4085, 0x00)
+	// Modulator steps every 256 cycles with frequency $100
+	m.WritePrg(0x4086, 0x00)
+	m.WritePrg(0x4087, 0x01)
+	m.Clock(255)
+	if a.modCounter != 0 {
+		t.Fatalf("Modulator stepped too early")
+	}
+	m.Clock(257)
+	if a.modCounter != 2 {
+		t.Fatalf("Unexpected modulation counter %d", a.modCounter)
+	}
+	// Step 4 resets the counter
+	m.Clock(256)
+	if a.modCounter != 0 {
+		t.Fatalf("Modulation counter not reset, %d", a.modCounter)
+	}
+
+	// Counter and gain bend the wave frequency
+	m.WritePrg(0x4082, 0x00)
+	m.WritePrg(0x4083, 0x01)
+	m.WritePrg(0x4084, 0x90)
+	if p := a.pitch(); p != 0x100 {
+		t.Fatalf("Unexpected unmodulated pitch %x", p)
+	}
+	a.modCounter = 1
+	if p := a.pitch(); p != 0x104 {
+		t.Fatalf("Unexpected modulated pitch %x", p)
+	}
+}
@@ -0,0 +1,215 @@
+package nes
+
+const (
+	prgBank8k uint32 = 8 * 1024
+	chrBank1k uint32 = 1024
+)
+
+// FME7 is iNES mapper 069 (Sunsoft FME-7, 5A and 5B)
+type FME7 struct {
+	prgRom []byte
+	chrMem []byte
+	prgRAM []byte
+	// Board provides CHR RAM instead of ROM
+	chrRAM bool
+
+	// Selected command register ($8000-$9FFF)
+	command byte
+
+	chrBanks [8]byte
+	prgBanks [4]byte // $6000, $8000, $A000, $C000
+	ramSel   bool
+	ramOn    bool
+
+	mirroring Mirroring
+
+	// IRQ counter decremented every CPU cycle
+	irqCounter     uint16
+	irqEnabled     bool
+	counterEnabled bool
+	irqPending     bool
+
+	// Sunsoft 5B sound
+	audio *Sunsoft5B
+}
+
+// NewFME7 creates FME-7 mapper for the given ROM
+func NewFME7(rom *Rom) *FME7 {
+	m := &FME7{
+		prgRom: rom.prgRom,
+		chrMem: rom.chrRom,
+		audio:  NewSunsoft5B(),
+	}
+	if len(m.chrMem) == 0 {
+		m.chrMem = make([]byte, 8*chrBank1k)
+		m.chrRAM = true
+	}
+	// Truncated dumps are padded to whole banks, bank numbers are
+	// taken modulo the bank count
+	if banks := (uint32(len(m.prgRom)) + prgBank8k - 1) / prgBank8k; uint32(len(m.prgRom)) != max(banks, 1)*prgBank8k {
+		m.prgRom = make([]byte, max(banks, 1)*prgBank8k)
+		copy(m.prgRom, rom.prgRom)
+	}
+	ramSize := uint32(rom.Header.PrgRAMSize)
+	if ramSize == 0 {
+		ramSize = 1
+	}
+	m.prgRAM = make([]byte, ramSize*prgBank8k)
+	return m
+}
+
+// Translate is a no-op, FME-7 serves cartridge space by itself
+func (m *FME7) Translate(addr uint16) uint16 {
+	return addr
+}
+
+func (m *FME7) state(s *stateBuffer) {
+	s.block(m.prgRAM)
+	if m.chrRAM {
+		s.block(m.chrMem)
+	}
+	stateNum(s, &m.command)
+	s.bytes(m.chrBanks[:])
+	s.bytes(m.prgBanks[:])
+	s.bool(&m.ramSel)
+	s.bool(&m.ramOn)
+	stateNum(s, &m.mirroring)
+	stateNum(s, &m.irqCounter)
+	s.bool(&m.irqEnabled)
+	s.bool(&m.counterEnabled)
+	s.bool(&m.irqPending)
+	m.audio.state(s)
+}
+
+func (m *FME7) prgBankCount() uint32 {
+	return uint32(len(m.prgRom)) / prgBank8k
+}
+
+// ReadPrg reads a byte from the cartridge space
+func (m *FME7) ReadPrg(addr uint16) byte {
+	switch {
+	case addr < 0x6000:
+		return 0
+	case addr < 0x8000:
+		offset := uint32(addr - 0x6000)
+		bank := uint32(m.prgBanks[0] & 0x3F)
+		if m.ramSel {
+			if !m.ramOn {
+				return 0
+			}
+			return m.prgRAM[(bank*prgBank8k+offset)%uint32(len(m.prgRAM))]
+		}
+		return m.prgRom[(bank%m.prgBankCount())*prgBank8k+offset]
+	case addr < 0xE000:
+		slot := (addr-0x8000)/0x2000 + 1
+		bank := uint32(m.prgBanks[slot]&0x3F) % m.prgBankCount()
+		return m.prgRom[bank*prgBank8k+uint32(addr&0x1FFF)]
+	default:
+		// $E000-$FFFF is fixed to the last bank
+		bank := m.prgBankCount() - 1
+		return m.prgRom[bank*prgBank8k+uint32(addr&0x1FFF)]
+	}
+}
+
+// WritePrg handles writes into PRG RAM and mapper registers
+func (m *FME7) WritePrg(addr uint16, val byte) {
+	switch {
+	case addr < 0x6000:
+	case addr < 0x8000:
+		if m.ramSel && m.ramOn {
+			offset := uint32(addr - 0x6000)
+			bank := uint32(m.prgBanks[0] & 0x3F)
+			m.prgRAM[(bank*prgBank8k+offset)%uint32(len(m.prgRAM))] = val
+		}
+	case addr < 0xA000:
+		m.command = val & 0x0F
+	case addr < 0xC000:
+		m.writeParameter(val)
+	case addr < 0xE000:
+		m.audio.SelectRegister(val)
+	default:
+		m.audio.WriteRegister(val)
+	}
+}
+
+// Writes parameter of the currently selected command
+func (m *FME7) writeParameter(val byte) {
+	switch cmd := m.command; {
+	case cmd <= 0x07:
+		m.chrBanks[cmd] = val
+	case cmd == 0x08:
+		m.prgBanks[0] = val & 0x3F
+		m.ramSel = val&0x40 != 0
+		m.ramOn = val&0x80 != 0
+	case cmd <= 0x0B:
+		m.prgBanks[cmd-0x08] = val & 0x3F
+	case cmd == 0x0C:
+		m.mirroring = [...]Mirroring{MirrorVertical, MirrorHorizontal,
+			MirrorSingleLow, MirrorSingleHigh}[val&0x03]
+	case cmd == 0x0D:
+		m.irqEnabled = val&0x01 != 0
+		m.counterEnabled = val&0x80 != 0
+		// Any write acknowledges pending IRQ
+		m.irqPending = false
+	case cmd == 0x0E:
+		m.irqCounter = m.irqCounter&0xFF00 | uint16(val)
+	case cmd == 0x0F:
+		m.irqCounter = m.irqCounter&0x00FF | uint16(val)<<8
+	}
+}
+
+func (m *FME7) chrAddr(addr uint16) uint32 {
+	bank := uint32(m.chrBanks[(addr>>10)&0x07])
+	return (bank*chrBank1k + uint32(addr&0x03FF)) % uint32(len(m.chrMem))
+}
+
+// ReadChr reads a byte from the pattern tables
+func (m *FME7) ReadChr(addr uint16) byte {
+	return m.chrMem[m.chrAddr(addr)]
+}
+
+// WriteChr writes a byte into pattern tables, CHR ROM ignores writes
+func (m *FME7) WriteChr(addr uint16, val byte) {
+	if m.chrRAM {
+		m.chrMem[m.chrAddr(addr)] = val
+	}
+}
+
+// Mirroring returns currently selected nametable mirroring
+func (m *FME7) Mirroring() Mirroring {
+	return m.mirroring
+}
+
+// Clock decrements IRQ counter and runs the sound chip
+func (m *FME7) Clock(cycles uint16) {
+	for i := uint16(0); i < cycles; i++ {
+		if m.counterEnabled {
+			m.irqCounter--
+			// IRQ fires when counter wraps from $0000 to $FFFF
+			if m.irqCounter == 0xFFFF && m.irqEnabled {
+				m.irqPending = true
+			}
+		}
+	}
+	m.audio.Clock(cycles)
+}
+
+// IRQ reports whether the IRQ line is asserted
+func (m *FME7) IRQ() bool {
+	return m.irqPending
+}
+
+// Sample returns current Sunsoft 5B output
+func (m *FME7) Sample() float32 {
+	return m.audio.Sample()
+}
+
+// SaveData returns contents of PRG RAM
+func (m *FME7) SaveData() []byte {
+	return append([]byte(nil), m.prgRAM...)
+}
+
+// LoadSaveData restores PRG RAM saved by SaveData
+func (m *FME7) LoadSaveData(data []byte) {
+	copy(m.prgRAM, data)
+}
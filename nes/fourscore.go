@@ -0,0 +1,66 @@
+package nes
+
+const (
+	// Reads 17-24 return adapter signature
+	fourScoreSignature1 byte = 0x08
+	fourScoreSignature2 byte = 0x04
+)
+
+// FourScore is the NES Four Score / NES Satellite adapter. Each port
+// returns 24 bits: controller 1 or 2, controller 3 or 4, then signature
+type FourScore struct {
+	pads  [4]*Controller
+	ports [2]fourScorePort
+}
+
+// fourScorePort is one of the adapter plugs
+type fourScorePort struct {
+	first, second *Controller
+	signature     byte
+	shift         uint32
+	strobe        bool
+}
+
+// NewFourScore creates adapter with four controllers plugged in
+func NewFourScore() *FourScore {
+	fs := &FourScore{}
+	for i := range fs.pads {
+		fs.pads[i] = NewController()
+	}
+	fs.ports[0] = fourScorePort{first: fs.pads[0], second: fs.pads[2], signature: fourScoreSignature1}
+	fs.ports[1] = fourScorePort{first: fs.pads[1], second: fs.pads[3], signature: fourScoreSignature2}
+	return fs
+}
+
+// Controller returns controller of player 0-3
+func (fs *FourScore) Controller(player int) *Controller {
+	return fs.pads[player]
+}
+
+// Port returns device to plug into controller port 0 or 1
+func (fs *FourScore) Port(port int) InputDevice {
+	return &fs.ports[port]
+}
+
+func (p *fourScorePort) state(s *stateBuffer) {
+	stateNum(s, &p.shift)
+	s.bool(&p.strobe)
+}
+
+// Write latches both controllers and the signature while strobe is high
+func (p *fourScorePort) Write(val byte) {
+	p.strobe = val&1 != 0
+	if p.strobe {
+		p.shift = uint32(p.first.Buttons()) | uint32(p.second.Buttons())<<8 | uint32(p.signature)<<16
+	}
+}
+
+// Read shifts out the next bit, 1 is returned after all 24 are read
+func (p *fourScorePort) Read() byte {
+	if p.strobe {
+		return p.first.Buttons() & 1
+	}
+	val := byte(p.shift & 1)
+	p.shift = p.shift>>1 | 0x800000
+	return val
+}
@@ -0,0 +1,36 @@
+package nes
+
+import (
+	"testing"
+)
+
+func TestFourScoreRead(t *testing.T) {
+	m := Memory{mapper: &NROM128{}}
+	fs := NewFourScore()
+	m.ConnectInput(0, fs.Port(0))
+	m.ConnectInput(1, fs.Port(1))
+	fs.Controller(0).SetButton(ButtonA, true)
+	fs.Controller(2).SetButton(ButtonStart, true)
+	fs.Controller(3).SetButton(ButtonB, true)
+
+	m.Write(Joypad1, 1)
+	m.Write(Joypad1, 0)
+
+	read := func(addr uint16) (bits uint32) {
+		for i := 0; i < 24; i++ {
+			bits |= uint32(m.Read(addr)&1) << i
+		}
+		return
+	}
+	// Player 1, player 3 and signature
+	if bits := read(Joypad1); bits != 0x080801 {
+		t.Fatalf("Unexpected $4016 bits %06x", bits)
+	}
+	// Player 2, player 4 and signature
+	if bits := read(Joypad2); bits != 0x040200 {
+		t.Fatalf("Unexpected $4017 bits %06x", bits)
+	}
+	if m.Read(Joypad1)&1 != 1 {
+		t.Fatalf("Expected 1 after 24 reads")
+	}
+}
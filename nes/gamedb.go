@@ -0,0 +1,161 @@
+package nes
+
+import (
+	"crypto/sha1"
+	_ "embed" // bundled game database
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Bundled database is filtered from the NES 2.0 DB, see gamedb_gen.go
+//
+//go:generate go run gamedb_gen.go nes20db.xml
+//go:embed gamedb.xml
+var bundledGameDB []byte
+
+// GameInfo holds cartridge properties of a known dump
+type GameInfo struct {
+	Mapper    int
+	Mirroring string
+	Battery   bool
+}
+
+// HeaderFix describes header field corrected by the game database
+type HeaderFix struct {
+	Field     string
+	Original  string
+	Corrected string
+}
+
+func (f HeaderFix) String() string {
+	return fmt.Sprintf("%s %s -> %s", f.Field, f.Original, f.Corrected)
+}
+
+type gameDBFile struct {
+	Games []struct {
+		Rom struct {
+			CRC32 string `xml:"crc32,attr"`
+			SHA1  string `xml:"sha1,attr"`
+		} `xml:"rom"`
+		Pcb struct {
+			Mapper    int    `xml:"mapper,attr"`
+			Mirroring string `xml:"mirroring,attr"`
+			Battery   int    `xml:"battery,attr"`
+		} `xml:"pcb"`
+	} `xml:"game"`
+}
+
+var (
+	gameDBOnce sync.Once
+	// Guards the maps, databases may be loaded while ROMs are looked up
+	gameDBMu     sync.RWMutex
+	gamesBySHA1  = map[string]*GameInfo{}
+	gamesByCRC32 = map[uint32]*GameInfo{}
+)
+
+// LoadGameDB adds games from XML data in NES 2.0 DB format
+// to the database, overriding bundled entries
+func LoadGameDB(data []byte) error {
+	loadBundledGameDB()
+	return parseGameDB(data)
+}
+
+func loadBundledGameDB() {
+	gameDBOnce.Do(func() {
+		if err := parseGameDB(bundledGameDB); err != nil {
+			panic(fmt.Sprintf("bundled game database: %v", err))
+		}
+	})
+}
+
+func parseGameDB(data []byte) error {
+	var db gameDBFile
+	if err := xml.Unmarshal(data, &db); err != nil {
+		return err
+	}
+	gameDBMu.Lock()
+	defer gameDBMu.Unlock()
+	for _, g := range db.Games {
+		info := &GameInfo{
+			Mapper:    g.Pcb.Mapper,
+			Mirroring: g.Pcb.Mirroring,
+			Battery:   g.Pcb.Battery != 0,
+		}
+		if g.Rom.SHA1 != "" {
+			gamesBySHA1[strings.ToUpper(g.Rom.SHA1)] = info
+		}
+		if crc, err := strconv.ParseUint(g.Rom.CRC32, 16, 32); err == nil {
+			gamesByCRC32[uint32(crc)] = info
+		}
+	}
+	return nil
+}
+
+// LookupGame finds a game by checksums of its PRG and CHR data.
+// SHA-1 match is preferred, CRC32 is used when SHA-1 is unknown
+func LookupGame(crc uint32, sha1Sum [sha1.Size]byte) (*GameInfo, bool) {
+	loadBundledGameDB()
+	gameDBMu.RLock()
+	defer gameDBMu.RUnlock()
+	if info, ok := gamesBySHA1[strings.ToUpper(hex.EncodeToString(sha1Sum[:]))]; ok {
+		return info, true
+	}
+	info, ok := gamesByCRC32[crc]
+	return info, ok
+}
+
+// Computes checksums of PRG and CHR data and corrects
+// the header according to the game database
+func (r *Rom) checkGameDB() {
+	r.checksum()
+
+	info, ok := LookupGame(r.CRC32, r.SHA1)
+	if !ok {
+		return
+	}
+	h := r.Header
+
+	if info.Mapper != int(h.MapperNum) && info.Mapper >= 0 && info.Mapper <= 0xFF {
+		h.fix("mapper", strconv.Itoa(int(h.MapperNum)), strconv.Itoa(info.Mapper))
+		h.MapperNum = byte(info.Mapper)
+		h.Flags6 = h.Flags6&0x0F | (h.MapperNum&0x0F)<<4
+		h.Flags7 = h.Flags7&0x0F | h.MapperNum&0xF0
+	}
+
+	// Four-screen bit takes precedence over vertical bit
+	mirroring := "H"
+	switch {
+	case h.Flags6&0x08 != 0:
+		mirroring = "4"
+	case h.Flags6&0x01 != 0:
+		mirroring = "V"
+	}
+	// Other values mean mapper controlled mirroring, header has no bits for it
+	if m := info.Mirroring; m != mirroring && (m == "H" || m == "V" || m == "4") {
+		h.fix("mirroring", mirroring, m)
+		h.Flags6 &^= 0x09
+		switch m {
+		case "V":
+			h.Flags6 |= 0x01
+		case "4":
+			h.Flags6 |= 0x08
+		}
+	}
+
+	if info.Battery != h.HasBattery {
+		h.fix("battery", strconv.FormatBool(h.HasBattery), strconv.FormatBool(info.Battery))
+		h.HasBattery = info.Battery
+		h.Flags6 &^= 0x02
+		if info.Battery {
+			h.Flags6 |= 0x02
+		}
+	}
+}
+
+func (h *RomHeader) fix(field string, original string, corrected string) {
+	h.Fixes = append(h.Fixes, HeaderFix{field, original, corrected})
+}
@@ -0,0 +1,88 @@
+//go:build ignore
+
+// Gamedb_gen fills gamedb.xml with entries of the NES 2.0 DB
+// (nes20db.xml) for cartridges of implemented mappers.
+//
+//	go run gamedb_gen.go nes20db.xml
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strings"
+
+	"darknes/nes"
+)
+
+const header = `<?xml version="1.0" encoding="UTF-8"?>
+<!--
+  Game database in NES 2.0 DB format generated by gamedb_gen.go from
+  nes20db.xml, only cartridges of implemented mappers are kept. Games are
+  identified by CRC32 and SHA-1 of PRG and CHR ROM data following each
+  other, header excluded:
+
+  <game>
+    <rom crc32="0123ABCD" sha1="..."/>
+    <pcb mapper="1" mirroring="H" battery="1"/>
+  </game>
+
+  Mirroring is H, V or 4 (four-screen). Additional entries are loaded
+  with -gamedb.
+-->
+<nes20db>
+`
+
+type game struct {
+	Name string `xml:",comment"`
+	Rom  struct {
+		CRC32 string `xml:"crc32,attr"`
+		SHA1  string `xml:"sha1,attr"`
+	} `xml:"rom"`
+	Pcb struct {
+		Mapper    int    `xml:"mapper,attr"`
+		Mirroring string `xml:"mirroring,attr"`
+		Battery   int    `xml:"battery,attr"`
+	} `xml:"pcb"`
+}
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: go run gamedb_gen.go nes20db.xml")
+		os.Exit(2)
+	}
+	data, err := os.ReadFile(os.Args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var db struct {
+		Games []game `xml:"game"`
+	}
+	if err := xml.Unmarshal(data, &db); err != nil {
+		fmt.Fprintln(os.Stderr, "nes20db.xml:", err)
+		os.Exit(1)
+	}
+
+	var out strings.Builder
+	out.WriteString(header)
+	kept := 0
+	for _, g := range db.Games {
+		if g.Rom.CRC32 == "" || g.Pcb.Mapper > 0xFF || !nes.MapperSupported(byte(g.Pcb.Mapper)) {
+			continue
+		}
+		name := strings.TrimSpace(strings.ReplaceAll(g.Name, "--", "-"))
+		fmt.Fprintf(&out, "<game>\n  <!-- %s -->\n", name)
+		fmt.Fprintf(&out, "  <rom crc32=%q sha1=%q/>\n", g.Rom.CRC32, g.Rom.SHA1)
+		fmt.Fprintf(&out, "  <pcb mapper=\"%d\" mirroring=%q battery=\"%d\"/>\n</game>\n",
+			g.Pcb.Mapper, g.Pcb.Mirroring, g.Pcb.Battery)
+		kept++
+	}
+	out.WriteString("</nes20db>\n")
+
+	if err := os.WriteFile("gamedb.xml", []byte(out.String()), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d of %d games written\n", kept, len(db.Games))
+}
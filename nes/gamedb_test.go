@@ -0,0 +1,106 @@
+package nes
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash/crc32"
+	"maps"
+	"sync"
+	"testing"
+)
+
+// restoreGameDB drops entries added by the test once it ends
+func restoreGameDB(t *testing.T) {
+	loadBundledGameDB()
+	gameDBMu.RLock()
+	bySHA1, byCRC32 := maps.Clone(gamesBySHA1), maps.Clone(gamesByCRC32)
+	gameDBMu.RUnlock()
+	t.Cleanup(func() {
+		gameDBMu.Lock()
+		gamesBySHA1, gamesByCRC32 = bySHA1, byCRC32
+		gameDBMu.Unlock()
+	})
+}
+
+func TestGameDBCorrectsHeader(t *testing.T) {
+	restoreGameDB(t)
+	// NROM header with horizontal mirroring for MMC1 game with battery
+	data := make([]byte, romHeaderLen+16*1024+8192)
+	copy(data, []byte{'N', 'E', 'S', 0x1A, 1, 1, 0x00, 0x00})
+	copy(data[romHeaderLen:], "game database test")
+	crc := crc32.ChecksumIEEE(data[romHeaderLen:])
+
+	db := fmt.Sprintf(`<nes20db><game><rom crc32="%08X"/>
+		<pcb mapper="1" mirroring="V" battery="1"/></game></nes20db>`, crc)
+	if err := LoadGameDB([]byte(db)); err != nil {
+		t.Fatalf("Failed to load game database: %v", err)
+	}
+
+	rom := LoadRomData(data)
+	h := rom.Header
+	if rom.CRC32 != crc {
+		t.Fatalf("Unexpected CRC32 %08X, expected %08X", rom.CRC32, crc)
+	}
+	if h.MapperNum != 1 || h.Flags6 != 0x13 || !h.HasBattery {
+		t.Fatalf("Header not corrected: mapper %d, flags6 %02x, battery %v",
+			h.MapperNum, h.Flags6, h.HasBattery)
+	}
+	if len(h.Fixes) != 3 || h.Fixes[0].String() != "mapper 0 -> 1" {
+		t.Fatalf("Unexpected corrections %v", h.Fixes)
+	}
+}
+
+// useBundledGameDB replaces the embedded database until the test ends
+func useBundledGameDB(t *testing.T, data []byte) {
+	restoreGameDB(t)
+	bundled := bundledGameDB
+	t.Cleanup(func() {
+		bundledGameDB = bundled
+	})
+	bundledGameDB = data
+	gameDBOnce = sync.Once{}
+	gameDBMu.Lock()
+	gamesBySHA1, gamesByCRC32 = map[string]*GameInfo{}, map[uint32]*GameInfo{}
+	gameDBMu.Unlock()
+}
+
+func TestBundledGameDB(t *testing.T) {
+	// FME-7 cartridge dumped with NROM header and horizontal mirroring
+	data := make([]byte, romHeaderLen+32*1024+8192)
+	copy(data, []byte{'N', 'E', 'S', 0x1A, 2, 1, 0x00, 0x00})
+	copy(data[romHeaderLen:], "bundled game database test")
+	sum := sha1.Sum(data[romHeaderLen:])
+
+	// Entry as written by gamedb_gen.go
+	useBundledGameDB(t, []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<nes20db>
+<game>
+  <!-- \Test\Bundled game database test -->
+  <rom crc32="00000000" sha1="%X"/>
+  <pcb mapper="69" mirroring="V" battery="1"/>
+</game>
+</nes20db>
+`, sum)))
+
+	rom := LoadRomData(data)
+	h := rom.Header
+	if h.MapperNum != 69 || h.Flags6 != 0x53 || h.Flags7 != 0x40 || !h.HasBattery {
+		t.Fatalf("Header not corrected by bundled database: mapper %d, flags %02x %02x",
+			h.MapperNum, h.Flags6, h.Flags7)
+	}
+	if err := rom.CheckMapper(); err != nil {
+		t.Fatalf("Corrected mapper rejected: %v", err)
+	}
+}
+
+func TestGameDBRestored(t *testing.T) {
+	t.Run("load", func(t *testing.T) {
+		restoreGameDB(t)
+		if err := LoadGameDB([]byte(`<nes20db><game><rom crc32="0BADF00D"/></game></nes20db>`)); err != nil {
+			t.Fatalf("Failed to load game database: %v", err)
+		}
+	})
+	if _, ok := LookupGame(0x0BADF00D, [20]byte{}); ok {
+		t.Fatalf("Test entry left in the game database")
+	}
+}
@@ -0,0 +1,134 @@
+package nes
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FdsBiosName is the FDS BIOS file looked up next to disk images
+// and in the working directory
+const FdsBiosName = "disksys.rom"
+
+// LoadOptions tunes LoadRomFile
+type LoadOptions struct {
+	// Entry names the ROM to extract from archive holding several ones
+	Entry string
+	// Patch is applied to the ROM, otherwise a patch with the base name
+	// of the ROM is looked up next to it
+	Patch string
+	// Log receives messages about archive entries and patches used
+	Log func(msg string)
+}
+
+func (o LoadOptions) log(format string, args ...any) {
+	if o.Log != nil {
+		o.Log(fmt.Sprintf(format, args...))
+	}
+}
+
+// LoadRomFile reads cartridge, disk image or NSF at path, unpacking it
+// from zip or gzip archive and applying patch. Format is detected by
+// the file extension. Cartridges GetMapper cannot run are rejected
+func LoadRomFile(path string, opts LoadOptions) (*Rom, error) {
+	romData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Format is detected by the name of the file inside archive
+	romName := path
+	if IsArchive(romData) {
+		if romName, romData, err = unpackRom(romData, path, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if romData, err = patchRom(romData, path, opts); err != nil {
+		return nil, err
+	}
+
+	var rom *Rom
+	switch strings.ToLower(filepath.Ext(romName)) {
+	case ".fds":
+		var bios []byte
+		if bios, err = loadFdsBios(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
+		rom, err = LoadFdsData(romData, bios)
+	case ".nsf", ".nsfe":
+		rom, err = LoadNsfData(romData)
+	case ".unf", ".unif":
+		rom, err = LoadUnifData(romData)
+	default:
+		rom = LoadRomData(romData)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Console creation panics on cartridges it cannot run
+	if err := rom.CheckMapper(); err != nil {
+		return nil, err
+	}
+	return rom, nil
+}
+
+// unpackRom extracts ROM file from archive listing other ROMs
+// which could be chosen instead
+func unpackRom(data []byte, path string, opts LoadOptions) (string, []byte, error) {
+	if entries, err := ArchiveEntries(data); err == nil && len(entries) > 1 && opts.Entry == "" {
+		opts.log("Archive contains several ROMs, choose one by its entry name:")
+		for _, name := range entries {
+			opts.log("  " + name)
+		}
+	}
+
+	romName, romData, err := ExtractRom(data, path, opts.Entry)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	opts.log("Loading %s from %s", romName, filepath.Base(path))
+	return romName, romData, nil
+}
+
+// loadFdsBios looks for the BIOS next to the disk image
+// and in the working directory
+func loadFdsBios(romDir string) ([]byte, error) {
+	for _, dir := range []string{romDir, "."} {
+		bios, err := os.ReadFile(filepath.Join(dir, FdsBiosName))
+		if err == nil {
+			return bios, nil
+		}
+	}
+	return nil, fmt.Errorf("FDS BIOS %s not found", FdsBiosName)
+}
+
+// patchRom applies the given patch or the one lying next to the ROM
+// with the same base name
+func patchRom(romData []byte, path string, opts LoadOptions) ([]byte, error) {
+	patchPath := opts.Patch
+	if patchPath == "" {
+		base := strings.TrimSuffix(path, filepath.Ext(path))
+		for _, ext := range PatchExtensions {
+			if _, err := os.Stat(base + ext); err == nil {
+				patchPath = base + ext
+				break
+			}
+		}
+	}
+	if patchPath == "" {
+		return romData, nil
+	}
+
+	patchData, err := os.ReadFile(patchPath)
+	if err != nil {
+		return nil, err
+	}
+	patched, err := ApplyPatch(romData, patchData)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(patchPath), err)
+	}
+	opts.log("Applied patch %s", patchPath)
+	return patched, nil
+}
@@ -0,0 +1,64 @@
+package nes
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRomFile writes iNES file of the mapper into dir
+func testRomFile(t *testing.T, dir string, name string, mapperNum byte) string {
+	rom := testRom(mapperNum, 1)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, rom.data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRomFile(t *testing.T) {
+	dir := t.TempDir()
+	path := testRomFile(t, dir, "game.nes", 0)
+
+	// Patch next to the ROM changes the first PRG byte
+	ips := []byte("PATCH\x00\x00\x10\x00\x01\xEAEOF")
+	if err := os.WriteFile(filepath.Join(dir, "game.ips"), ips, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var log []string
+	rom, err := LoadRomFile(path, LoadOptions{Log: func(msg string) { log = append(log, msg) }})
+	if err != nil {
+		t.Fatalf("Failed to load ROM: %v", err)
+	}
+	if rom.prgRom[0] != 0xEA || len(log) != 1 || !strings.HasPrefix(log[0], "Applied patch") {
+		t.Fatalf("Patch not applied, log %q", log)
+	}
+
+	// Disk images need the BIOS
+	disk := filepath.Join(dir, "game.fds")
+	if err := os.WriteFile(disk, testFdsSide(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRomFile(disk, LoadOptions{}); err == nil {
+		t.Fatalf("FDS image loaded without BIOS")
+	}
+	if err := os.WriteFile(filepath.Join(dir, FdsBiosName), make([]byte, fdsBiosSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rom, err := LoadRomFile(disk, LoadOptions{}); err != nil || len(rom.disk) != 1 {
+		t.Fatalf("Failed to load FDS image: %v", err)
+	}
+}
+
+func TestLoadRomFileUnsupported(t *testing.T) {
+	dir := t.TempDir()
+	path := testRomFile(t, dir, "mmc3.nes", 4)
+	if _, err := LoadRomFile(path, LoadOptions{}); err == nil {
+		t.Fatalf("ROM of unimplemented mapper loaded")
+	}
+	// Regression case fails instead of stopping the suite
+	if _, err := runRegressionCase(dir, regressionCase{rom: "mmc3.nes", frame: 1}); err == nil {
+		t.Fatalf("Regression case of unimplemented mapper passed")
+	}
+}
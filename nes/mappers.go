@@ -29,3 +29,30 @@ func (m *NROM256) Translate(addr uint16) uint16 {
 	}
 	return addr
 }
+
+// Mirroring represents nametable arrangement selected by the cartridge
+type Mirroring byte
+
+const (
+	MirrorHorizontal Mirroring = iota
+	MirrorVertical
+	MirrorSingleLow
+	MirrorSingleHigh
+	MirrorFourScreen
+)
+
+// MirroringController is implemented by mappers which switch
+// nametable mirroring at runtime
+type MirroringController interface {
+	Mirroring() Mirroring
+}
+
+// NametableMapper is implemented by mappers which select memory behind
+// every nametable, console VRAM or their own CHR memory
+type NametableMapper interface {
+	// NametablePage returns VRAM page 0 or 1 of nametable 0-3,
+	// ok is false when the cartridge serves the nametable
+	NametablePage(table uint16) (page uint16, ok bool)
+	ReadNametable(addr uint16) byte
+	WriteNametable(addr uint16, val byte)
+}
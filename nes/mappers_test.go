@@ -0,0 +1,334 @@
+package nes
+
+import (
+	"testing"
+)
+
+func testRom(mapperNum byte, prgBanks byte) *Rom {
+	data := make([]byte, romHeaderLen+uint32(prgBanks)*16*1024)
+	copy(data, []byte{'N', 'E', 'S', 0x1A, prgBanks, 0, (mapperNum & 0x0F) << 4, mapperNum & 0xF0})
+	return LoadRomData(data)
+}
+
+func TestN163IRQ(t *testing.T) {
+	m := NewN163(testRom(19, 2))
+	m.WritePrg(0x5000, 0xFD)
+	m.WritePrg(0x5800, 0xFF)
+
+	// Counter stops at $7FFF and raises IRQ
+	m.Clock(1)
+	if m.IRQ() {
+		t.Fatalf("IRQ raised too early")
+	}
+	m.Clock(5)
+	if !m.IRQ() || m.ReadPrg(0x5000) != 0xFF || m.ReadPrg(0x5800) != 0xFF {
+		t.Fatalf("Unexpected IRQ counter %04x", m.irqCounter)
+	}
+
+	// Counter writes acknowledge IRQ
+	m.WritePrg(0x5000, 0x00)
+	if m.IRQ() {
+		t.Fatalf("IRQ not acknowledged")
+	}
+}
+
+func TestN163Wavetable(t *testing.T) {
+	m := NewN163(testRom(19, 2))
+	// Samples 15 and 3 at the start of the wave RAM
+	m.WritePrg(0xF800, 0x00)
+	m.WritePrg(0x4800, 0x3F)
+
+	// Channel 7 alone, full volume, 8-sample wave advancing
+	// one sample every update
+	m.WritePrg(0xF800, 0xF8)
+	for _, v := range []byte{0x00, 0x00, 0x00, 0x00, 0xF9, 0x00, 0x00, 0x0F} {
+		m.WritePrg(0x4800, v)
+	}
+
+	m.Clock(n163ChannelCycles)
+	if s := m.Sample(); s != 3.0*15/225 {
+		t.Fatalf("Unexpected sample %f", s)
+	}
+	m.Clock(n163ChannelCycles)
+	if s := m.Sample(); s != 0 {
+		t.Fatalf("Unexpected sample %f", s)
+	}
+
+	// Sound disable bit mutes the chip
+	m.WritePrg(0xE000, 0x40)
+	m.audio.outputs[7] = 1
+	if m.Sample() != 0 {
+		t.Fatalf("Sound not disabled")
+	}
+}
+
+func TestN163Nametables(t *testing.T) {
+	rom := testRom(19, 2)
+	rom.chrRom = make([]byte, 8*chrBank1k)
+	rom.chrRom[3*chrBank1k+5] = 0xAB
+	mem := rom.Load()
+	ppu := NewPPU(mem)
+
+	// Nametable 0 in CHR bank 3, nametable 1 in VRAM page 1
+	mem.Write(0xC000, 0x03)
+	mem.Write(0xC800, 0xE1)
+	if v := ppu.readVram(0x2005); v != 0xAB {
+		t.Fatalf("Unexpected nametable byte %x from CHR ROM", v)
+	}
+	ppu.writeVram(0x2405, 0xCD)
+	if ppu.vram[nametableSize+5] != 0xCD {
+		t.Fatalf("Nametable 1 not mapped to VRAM page 1")
+	}
+	// CHR ROM ignores writes
+	ppu.writeVram(0x2005, 0x00)
+	if v := ppu.readVram(0x2005); v != 0xAB {
+		t.Fatalf("CHR ROM nametable written")
+	}
+}
+
+func TestN163ChrRom(t *testing.T) {
+	rom := testRom(19, 2)
+	rom.chrRom = make([]byte, 8*chrBank1k)
+	rom.chrRom[3*chrBank1k+5] = 0xAB
+	mem := rom.Load()
+	NewPPU(mem)
+
+	// Pattern table byte written through $2007 in CHR bank 3
+	mem.Write(0x8000, 0x03)
+	mem.Write(0x2006, 0x00)
+	mem.Write(0x2006, 0x05)
+	mem.Write(0x2007, 0xEE)
+	if rom.chrRom[3*chrBank1k+5] != 0xAB {
+		t.Fatalf("CHR ROM written through $2007")
+	}
+}
+
+func TestN163RamPort(t *testing.T) {
+	m := NewN163(testRom(19, 2))
+
+	// Address 0x10 with auto-increment
+	m.WritePrg(0xF800, 0x90)
+	m.WritePrg(0x4800, 0xAB)
+	m.WritePrg(0x4800, 0xCD)
+
+	m.WritePrg(0xF800, 0x90)
+	if v := m.ReadPrg(0x4800); v != 0xAB {
+		t.Fatalf("Unexpected RAM value %x at $10", v)
+	}
+	if v := m.ReadPrg(0x4800); v != 0xCD {
+		t.Fatalf("Unexpected RAM value %x at $11", v)
+	}
+
+	// Internal RAM must be part of save data
+	save := m.SaveData()
+	if save[len(save)-n163RAMSize+0x11] != 0xCD {
+		t.Fatalf("Internal RAM missing from save data")
+	}
+}
+
+// testFME7 creates FME-7 with 8 PRG banks and 16 CHR ROM banks,
+// every bank starts with its number
+func testFME7() (*FME7, *Rom) {
+	rom := testRom(69, 4)
+	rom.chrRom = make([]byte, 16*chrBank1k)
+	for i := uint32(0); i < 8; i++ {
+		rom.prgRom[i*prgBank8k] = byte(i)
+	}
+	for i := uint32(0); i < 16; i++ {
+		rom.chrRom[i*chrBank1k] = byte(i)
+	}
+	return NewFME7(rom), rom
+}
+
+// fme7Command writes parameter of the command
+func fme7Command(m *FME7, cmd byte, val byte) {
+	m.WritePrg(0x8000, cmd)
+	m.WritePrg(0xA000, val)
+}
+
+func TestFME7Banking(t *testing.T) {
+	m, rom := testFME7()
+	fme7Command(m, 0x09, 3)
+	fme7Command(m, 0x0A, 9)
+	fme7Command(m, 0x0B, 5)
+	for addr, bank := range map[uint16]byte{0x8000: 3, 0xA000: 1, 0xC000: 5, 0xE000: 7} {
+		if v := m.ReadPrg(addr); v != bank {
+			t.Fatalf("Unexpected bank %d at %04x, expected %d", v, addr, bank)
+		}
+	}
+
+	fme7Command(m, 0x02, 5)
+	fme7Command(m, 0x07, 12)
+	if m.ReadChr(0x0800) != 5 || m.ReadChr(0x1C00) != 12 {
+		t.Fatalf("CHR banks not switched")
+	}
+	// CHR ROM stays intact
+	m.WriteChr(0x0800, 0xEE)
+	if rom.chrRom[5*chrBank1k] != 5 || m.ReadChr(0x0800) != 5 {
+		t.Fatalf("CHR ROM written")
+	}
+
+	fme7Command(m, 0x0C, 0x02)
+	if m.Mirroring() != MirrorSingleLow {
+		t.Fatalf("Unexpected mirroring %d", m.Mirroring())
+	}
+}
+
+func TestFME7PrgRAM(t *testing.T) {
+	m, _ := testFME7()
+	// ROM bank at $6000
+	fme7Command(m, 0x08, 0x02)
+	if m.ReadPrg(0x6000) != 2 {
+		t.Fatalf("PRG ROM bank not mapped at $6000")
+	}
+
+	// RAM selected but disabled
+	fme7Command(m, 0x08, 0x40)
+	m.WritePrg(0x6000, 0xAB)
+	if m.ReadPrg(0x6000) != 0 || m.prgRAM[0] != 0 {
+		t.Fatalf("Disabled PRG RAM accessed")
+	}
+	fme7Command(m, 0x08, 0xC0)
+	m.WritePrg(0x6000, 0xAB)
+	if m.ReadPrg(0x6000) != 0xAB {
+		t.Fatalf("PRG RAM not written")
+	}
+}
+
+func TestFME7IRQ(t *testing.T) {
+	m, _ := testFME7()
+	fme7Command(m, 0x0E, 0x02)
+	fme7Command(m, 0x0F, 0x00)
+
+	// Counting without IRQ enabled
+	fme7Command(m, 0x0D, 0x80)
+	m.Clock(3)
+	if m.IRQ() || m.irqCounter != 0xFFFF {
+		t.Fatalf("Unexpected IRQ counter %04x", m.irqCounter)
+	}
+
+	// IRQ fires when the counter wraps from $0000 to $FFFF
+	fme7Command(m, 0x0E, 0x02)
+	fme7Command(m, 0x0F, 0x00)
+	fme7Command(m, 0x0D, 0x81)
+	m.Clock(2)
+	if m.IRQ() {
+		t.Fatalf("IRQ raised too early")
+	}
+	m.Clock(1)
+	if !m.IRQ() {
+		t.Fatalf("IRQ not raised on wrap")
+	}
+
+	// Control write acknowledges IRQ, stopped counter keeps its value
+	fme7Command(m, 0x0D, 0x01)
+	m.Clock(10)
+	if m.IRQ() || m.irqCounter != 0xFFFF {
+		t.Fatalf("IRQ not acknowledged or counter %04x running", m.irqCounter)
+	}
+}
+
+func TestFME7ShortPrg(t *testing.T) {
+	rom := testRom(69, 0)
+	rom.prgRom = make([]byte, 4*1024)
+	rom.prgRom[0] = 0xAB
+	m := NewFME7(rom)
+	if m.prgBankCount() != 1 || m.ReadPrg(0xE000) != 0xAB || m.ReadPrg(0x8000) != 0xAB {
+		t.Fatalf("Truncated PRG ROM not padded to a bank")
+	}
+}
+
+// s5bWrite writes 5B register through the mapper
+func s5bWrite(m *FME7, reg byte, val byte) {
+	m.WritePrg(0xC000, reg)
+	m.WritePrg(0xE000, val)
+}
+
+func TestSunsoft5BTone(t *testing.T) {
+	m, _ := testFME7()
+	// Channel A tone alone at fixed full volume, toggling every 16 cycles
+	s5bWrite(m, 0x00, 0x01)
+	s5bWrite(m, 0x07, 0x3E)
+	s5bWrite(m, 0x08, 0x0F)
+	if m.Sample() != 0 {
+		t.Fatalf("Square starts high")
+	}
+	m.Clock(s5bToneDivider)
+	if s := m.Sample(); s != s5bVolumeTable[31]/3 {
+		t.Fatalf("Unexpected sample %f", s)
+	}
+	m.Clock(s5bToneDivider)
+	if m.Sample() != 0 {
+		t.Fatalf("Square did not toggle")
+	}
+
+	// Writes with upper bits of the address set are ignored
+	s5bWrite(m, 0x18, 0x00)
+	if m.audio.regs[0x08] != 0x0F {
+		t.Fatalf("Register written through invalid address")
+	}
+}
+
+func TestSunsoft5BNoise(t *testing.T) {
+	m, _ := testFME7()
+	// Channel A noise alone
+	s5bWrite(m, 0x06, 0x01)
+	s5bWrite(m, 0x07, 0x37)
+	s5bWrite(m, 0x08, 0x0F)
+	outputs := map[bool]bool{}
+	for i := 0; i < 64; i++ {
+		m.Clock(s5bToneDivider)
+		outputs[m.Sample() != 0] = true
+	}
+	if len(outputs) != 2 {
+		t.Fatalf("Noise output does not change")
+	}
+}
+
+func TestSunsoft5BEnvelope(t *testing.T) {
+	m, _ := testFME7()
+	s5bWrite(m, 0x0B, 0x01)
+	s5bWrite(m, 0x0C, 0x00)
+
+	// Attack and hold at the top
+	s5bWrite(m, 0x0D, 0x0D)
+	if m.audio.envLevel != 0 {
+		t.Fatalf("Attack starts at level %d", m.audio.envLevel)
+	}
+	m.Clock(s5bEnvelopeDivider)
+	if m.audio.envLevel != 1 {
+		t.Fatalf("Unexpected envelope level %d", m.audio.envLevel)
+	}
+	m.Clock(s5bEnvelopeDivider * 40)
+	if m.audio.envLevel != 31 {
+		t.Fatalf("Envelope holds level %d instead of the top", m.audio.envLevel)
+	}
+
+	// Decay once and stay silent
+	s5bWrite(m, 0x0D, 0x00)
+	if m.audio.envLevel != 31 {
+		t.Fatalf("Decay starts at level %d", m.audio.envLevel)
+	}
+	m.Clock(s5bEnvelopeDivider * 40)
+	if m.audio.envLevel != 0 {
+		t.Fatalf("Envelope ends at level %d", m.audio.envLevel)
+	}
+
+	// Envelope drives the volume of the channel
+	s5bWrite(m, 0x07, 0x3F)
+	s5bWrite(m, 0x08, 0x10)
+	s5bWrite(m, 0x0D, 0x0D)
+	m.Clock(s5bEnvelopeDivider * 40)
+	if s := m.Sample(); s != s5bVolumeTable[31]/3 {
+		t.Fatalf("Unexpected sample %f with envelope volume", s)
+	}
+}
+
+func TestCheckMapper(t *testing.T) {
+	if err := testRom(69, 2).CheckMapper(); err != nil {
+		t.Fatalf("FME-7 rejected: %v", err)
+	}
+	if err := testRom(4, 2).CheckMapper(); err == nil || err.Error() != "mapper 4 not implemented" {
+		t.Fatalf("Unexpected error %v for MMC3", err)
+	}
+}
@@ -2,35 +2,132 @@ package nes
 
 import "fmt"
 
+const (
+	// Start of the cartridge address space
+	cartridgeStart uint16 = 0x4020
+)
+
 // Mapper represents memory mapping
 type Mapper interface {
 	Translate(uint16) uint16
 }
 
+// BankedMapper is a mapper with switchable PRG/CHR banks.
+// It serves the cartridge space ($4020-$FFFF) and pattern tables itself
+type BankedMapper interface {
+	Mapper
+	ReadPrg(addr uint16) byte
+	WritePrg(addr uint16, val byte)
+	ReadChr(addr uint16) byte
+	WriteChr(addr uint16, val byte)
+}
+
+// ClockedMapper is a mapper with its own hardware driven by the CPU clock,
+// such as IRQ counters
+type ClockedMapper interface {
+	Clock(cycles uint16)
+	IRQ() bool
+}
+
+// ExpansionAudio is a sound source located on the cartridge
+type ExpansionAudio interface {
+	// Sample returns current output level in range [0, 1]
+	Sample() float32
+}
+
+// Battery is implemented by mappers with battery-backed memory
+type Battery interface {
+	SaveData() []byte
+	LoadSaveData(data []byte)
+}
+
 // Memory represents NES memory model
 type Memory struct {
 	// RAM
 	ram    [65536]byte
 	mapper Mapper
+	apu    *APU
+	ppu    *PPU
+	// Pattern tables of mappers without CHR banking
+	chr       []byte
+	chrRAM    bool
+	mirroring Mirroring
+	// Devices plugged into controller ports and Famicom expansion port
+	ports     [2]InputDevice
+	expansion ExpansionDevice
+
+	// Last CPU bus access, DMC DMA behaves differently
+	// depending on the cycle it interrupts
+	lastRead uint16
+	// Write cycles in a row ending at the last access, up to 3
+	writeRun uint16
+	// CPU cycles taken by OAM DMA not yet reported by dmaStall
+	oamStall uint16
+	// OAM DMA cycles left while dmaStall cycles are clocked
+	oamCycles uint16
 }
 
-// GetMapper returns iNES mapper
-func GetMapper(h *RomHeader) Mapper {
-	switch h.MapperNum {
-	case 0:
-		if h.PrgRomSize == 1 {
+// Constructors of the mappers GetMapper implements by iNES number
+var mappers = map[byte]func(rom *Rom) Mapper{
+	0: func(rom *Rom) Mapper {
+		if rom.Header.PrgRomSize == 1 {
 			return &NROM128{}
 		}
 		return &NROM256{}
-	default:
-		panic(fmt.Sprintf("Mapper %v not implemented\n", h.MapperNum))
+	},
+	19:           func(rom *Rom) Mapper { return NewN163(rom) },
+	fdsMapperNum: func(rom *Rom) Mapper { return NewFDS(rom) },
+	69:           func(rom *Rom) Mapper { return NewFME7(rom) },
+}
+
+// MapperSupported reports whether GetMapper implements iNES mapper
+func MapperSupported(mapperNum byte) bool {
+	_, ok := mappers[mapperNum]
+	return ok
+}
+
+// CheckMapper returns error for cartridges GetMapper cannot run
+func (rom *Rom) CheckMapper() error {
+	if rom.Nsf == nil && !MapperSupported(rom.Header.MapperNum) {
+		return fmt.Errorf("mapper %d not implemented", rom.Header.MapperNum)
 	}
+	return nil
+}
+
+// GetMapper returns iNES mapper
+func GetMapper(rom *Rom) Mapper {
+	if rom.Nsf != nil {
+		return NewNsfMapper(rom)
+	}
+	newMapper, ok := mappers[rom.Header.MapperNum]
+	if !ok {
+		panic(fmt.Sprintf("Mapper %v not implemented\n", rom.Header.MapperNum))
+	}
+	return newMapper(rom)
 }
 
 // Load loads NES ROM into NES memory and returns Memory
 func (rom *Rom) Load() *Memory {
-	mp := GetMapper(rom.Header)
-	m := Memory{mapper: mp}
+	m := &Memory{}
+	m.apu = NewAPU(m)
+	m.insert(rom)
+	return m
+}
+
+// insert connects cartridge to the bus
+func (m *Memory) insert(rom *Rom) {
+	mp := GetMapper(rom)
+	m.mapper, m.chr, m.chrRAM, m.mirroring = mp, rom.chrRom, false, rom.Header.Mirroring()
+	if len(m.chr) == 0 {
+		// Board provides CHR RAM instead
+		m.chr = make([]byte, 0x2000)
+		m.chrRAM = true
+	}
+	if _, ok := mp.(BankedMapper); ok {
+		// Banked mappers serve PRG ROM and vectors on their own
+		return
+	}
+
 	var p = 0x8000
 	for i := range rom.prgRom {
 		m.ram[p] = rom.prgRom[i]
@@ -40,8 +137,66 @@ func (rom *Rom) Load() *Memory {
 	// Write reset vector into 0xFFFC
 	m.Write(0xFFFD, byte(0x8000>>8))
 	m.Write(0xFFFC, byte(0x8000&0xFF))
+}
+
+// powerOn clears RAM, APU and cartridge state as if the console
+// was switched off and on. Input devices stay connected
+func (m *Memory) powerOn(rom *Rom) {
+	m.ram = [65536]byte{}
+	m.lastRead, m.writeRun, m.oamStall, m.oamCycles = 0, 0, 0, 0
+	m.apu.powerOn()
+	m.insert(rom)
+}
+
+// Mapper returns cartridge mapper attached to memory
+func (m *Memory) Mapper() Mapper {
+	return m.mapper
+}
+
+// state covers RAM below the cartridge ROM, PRG RAM of NROM boards
+// included, and CHR RAM of boards without CHR banking
+func (m *Memory) state(s *stateBuffer) {
+	s.bytes(m.ram[:0x8000])
+	if m.chrRAM {
+		s.block(m.chr)
+	}
+	stateNum(s, &m.mirroring)
+	stateNum(s, &m.lastRead)
+	stateNum(s, &m.writeRun)
+	stateNum(s, &m.oamStall)
+	stateNum(s, &m.oamCycles)
+}
+
+// RAM returns 2 KB of console internal RAM
+func (m *Memory) RAM() []byte {
+	return m.ram[:0x0800]
+}
+
+// APU returns audio processing unit attached to memory
+func (m *Memory) APU() *APU {
+	return m.apu
+}
 
-	return &m
+// ConnectInput plugs device into controller port 0 or 1,
+// nil disconnects the port
+func (m *Memory) ConnectInput(port int, device InputDevice) {
+	m.ports[port] = device
+}
+
+// ConnectExpansion plugs device into Famicom expansion port,
+// nil disconnects it
+func (m *Memory) ConnectExpansion(device ExpansionDevice) {
+	m.expansion = device
+}
+
+// Input returns device plugged into controller port
+func (m *Memory) Input(port int) InputDevice {
+	return m.ports[port]
+}
+
+// Reports whether address belongs to APU registers
+func isAPURegister(addr uint16) bool {
+	return addr >= 0x4000 && addr <= 0x4017 && addr != OAMDMA && addr != Joypad1
 }
 
 // Translate performs mirroring and mapping of the address where needed
@@ -60,9 +215,206 @@ func (m *Memory) Translate(addr uint16) uint16 {
 }
 
 func (m *Memory) Read(addr uint16) byte {
+	m.lastRead = addr
+	m.writeRun = 0
+	return m.read(addr)
+}
+
+// read accesses the bus without being seen by DMA as a CPU cycle
+func (m *Memory) read(addr uint16) byte {
+	if m.ppu != nil && addr >= 0x2000 && addr < 0x4000 {
+		return m.ppu.readRegister(addr & 7)
+	}
+	if addr == Joypad1 || addr == Joypad2 {
+		return m.readPort(int(addr - Joypad1))
+	}
+	if m.apu != nil && addr == APUStatus {
+		return m.apu.ReadRegister(addr)
+	}
+	if bm, ok := m.mapper.(BankedMapper); ok && addr >= cartridgeStart {
+		return bm.ReadPrg(addr)
+	}
 	return m.ram[m.Translate(addr)]
 }
 
 func (m *Memory) Write(addr uint16, val byte) {
+	if m.writeRun < 3 {
+		m.writeRun++
+	}
+	if bm, ok := m.mapper.(BankedMapper); ok && addr >= cartridgeStart {
+		bm.WritePrg(addr, val)
+		return
+	}
+	if m.ppu != nil && addr >= 0x2000 && addr < 0x4000 {
+		m.ppu.writeRegister(addr&7, val)
+		return
+	}
+	if m.ppu != nil && addr == OAMDMA {
+		m.oamDMA(val)
+		return
+	}
+	if addr == Joypad1 {
+		for _, device := range m.ports {
+			if device != nil {
+				device.Write(val)
+			}
+		}
+		if m.expansion != nil {
+			m.expansion.Write(val)
+		}
+		return
+	}
+	if m.apu != nil && isAPURegister(addr) {
+		m.apu.WriteRegister(addr, val)
+		return
+	}
 	m.ram[m.Translate(addr)] = val
 }
+
+// oamDMA copies page of CPU memory into sprite memory. The CPU is halted
+// for 513 cycles, plus one more to align with an odd cycle
+func (m *Memory) oamDMA(page byte) {
+	base := uint16(page) << 8
+	for i := uint16(0); i < 256; i++ {
+		m.ppu.writeOAM(m.read(base + i))
+	}
+	m.oamStall += oamDMAStall
+	if m.apu != nil && m.apu.oddCycle {
+		m.oamStall++
+	}
+}
+
+func (m *Memory) readPort(port int) byte {
+	val := joypadOpenBus
+	if m.ports[port] != nil {
+		val |= m.ports[port].Read() & 0x1F
+	}
+	if m.expansion != nil {
+		val |= m.expansion.ReadExpansion(port) & 0x1F
+	}
+	return val
+}
+
+// clock advances APU and cartridge hardware by the given number of CPU cycles.
+// OAM DMA cycles are clocked one at a time so DMC fetches know where
+// they interrupt it
+func (m *Memory) clock(cycles uint16) {
+	for ; m.oamCycles > 0 && cycles > 0; cycles-- {
+		m.clockCycles(1)
+		m.oamCycles--
+	}
+	if cycles > 0 {
+		m.clockCycles(cycles)
+	}
+}
+
+func (m *Memory) clockCycles(cycles uint16) {
+	if m.apu != nil {
+		m.apu.Clock(cycles)
+	}
+	if cm, ok := m.mapper.(ClockedMapper); ok {
+		cm.Clock(cycles)
+	}
+}
+
+// irq reports whether APU or the cartridge asserts the IRQ line
+func (m *Memory) irq() bool {
+	if m.apu != nil && m.apu.IRQ() {
+		return true
+	}
+	if cm, ok := m.mapper.(ClockedMapper); ok {
+		return cm.IRQ()
+	}
+	return false
+}
+
+// nmi reports whether PPU has raised NMI since the last call
+func (m *Memory) nmi() bool {
+	return m.ppu != nil && m.ppu.takeNMI()
+}
+
+// dmaStall returns CPU cycles stolen by OAM DMA and by DMC sample fetches
+// during the last clock. OAM DMA cycles are clocked first
+func (m *Memory) dmaStall() uint16 {
+	stall := m.oamStall
+	m.oamCycles, m.oamStall = m.oamStall, 0
+	if m.apu != nil {
+		stall += m.apu.takeStall()
+	}
+	return stall
+}
+
+// dmcStall returns CPU cycles a DMC sample fetch halts the CPU for.
+// The get cycle is aligned to an even APU cycle, which takes one more
+// cycle on odd ones. Halting waits for CPU write cycles, up to three
+// of them in a row overlap the DMA. Fetches during OAM DMA take 2
+// cycles, 1 on its second to last cycle and 3 on the last one.
+// Halting in the middle of a controller or $2007 read repeats that
+// read, which clocks the controller or increments VRAM address again
+func (m *Memory) dmcStall(oddCycle bool) uint16 {
+	switch m.oamCycles {
+	case 0:
+	case 1:
+		return 3
+	case 2:
+		return 1
+	default:
+		return 2
+	}
+	stall := uint16(dmcFetchStall)
+	if oddCycle {
+		stall++
+	}
+	if m.writeRun > 0 {
+		return stall - min(m.writeRun, stall-1)
+	}
+	addr := m.lastRead
+	if addr == Joypad1 || addr == Joypad2 || addr >= 0x2000 && addr < 0x4000 && addr&0x2007 == PPUData {
+		m.read(addr)
+	}
+	return stall
+}
+
+func (m *Memory) readChr(addr uint16) byte {
+	if bm, ok := m.mapper.(BankedMapper); ok {
+		return bm.ReadChr(addr)
+	}
+	return m.chr[int(addr)%len(m.chr)]
+}
+
+// writeChr writes into pattern tables, CHR ROM ignores writes
+func (m *Memory) writeChr(addr uint16, val byte) {
+	if bm, ok := m.mapper.(BankedMapper); ok {
+		bm.WriteChr(addr, val)
+		return
+	}
+	if m.chrRAM {
+		m.chr[int(addr)%len(m.chr)] = val
+	}
+}
+
+// nametableOffset maps PPU address $2000-$3EFF into PPU nametable memory
+// according to cartridge mirroring. ok is false when the address is
+// served by NametableMapper from cartridge memory
+func (m *Memory) nametableOffset(addr uint16) (offset uint16, ok bool) {
+	if nm, isNM := m.mapper.(NametableMapper); isNM {
+		page, ok := nm.NametablePage((addr >> 10) & 3)
+		return page*nametableSize | addr&(nametableSize-1), ok
+	}
+	mirroring := m.mirroring
+	if mc, ok := m.mapper.(MirroringController); ok {
+		mirroring = mc.Mirroring()
+	}
+	table := (addr >> 10) & 3
+	switch mirroring {
+	case MirrorHorizontal:
+		table >>= 1
+	case MirrorVertical:
+		table &= 1
+	case MirrorSingleLow:
+		table = 0
+	case MirrorSingleHigh:
+		table = 1
+	}
+	return table*nametableSize | addr&(nametableSize-1), true
+}
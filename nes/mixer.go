@@ -0,0 +1,221 @@
+package nes
+
+import "math"
+
+const (
+	// Cartridge expansion audio channel of Mixer
+	ChannelExpansion = ChannelDMC + 1
+	mixerChannels    = ChannelExpansion + 1
+
+	// Expansion chip output relative to full scale APU output
+	expansionGain = 0.5
+
+	// DefaultSampleRate is the output rate of Console audio
+	DefaultSampleRate = 48000
+)
+
+// Nonlinear DAC output of pulse channels indexed by pulse1 + pulse2
+var pulseMixTable = func() (t [31]float32) {
+	for i := 1; i < len(t); i++ {
+		t[i] = float32(95.52 / (8128/float64(i) + 100))
+	}
+	return
+}()
+
+// Nonlinear DAC output of triangle, noise and DMC
+// indexed by 3 * triangle + 2 * noise + dmc
+var tndMixTable = func() (t [203]float32) {
+	for i := 1; i < len(t); i++ {
+		t[i] = float32(163.67 / (24329/float64(i) + 100))
+	}
+	return
+}()
+
+// filter is a first-order high-pass or low-pass filter
+type filter struct {
+	highPass bool
+	alpha    float32
+	prevIn   float32
+	prevOut  float32
+}
+
+func newFilter(highPass bool, cutoff float64, sampleRate int) filter {
+	rc := 1 / (2 * math.Pi * cutoff)
+	dt := 1 / float64(sampleRate)
+	if highPass {
+		return filter{highPass: true, alpha: float32(rc / (rc + dt))}
+	}
+	return filter{alpha: float32(dt / (rc + dt))}
+}
+
+func (f *filter) apply(x float32) float32 {
+	if f.highPass {
+		f.prevOut = f.alpha * (f.prevOut + x - f.prevIn)
+	} else {
+		f.prevOut += f.alpha * (x - f.prevOut)
+	}
+	f.prevIn = x
+	return f.prevOut
+}
+
+// Mixer combines APU channels and expansion audio the way NES DACs do
+// and resamples the result to the host sample rate
+type Mixer struct {
+	apu       *APU
+	expansion ExpansionAudio
+
+	clockRate  int
+	sampleRate int
+
+	volumes [mixerChannels]float32
+	muted   [mixerChannels]bool
+	master  float32
+	// Channel played alone by recording mixers, -1 mixes all of them
+	solo int
+
+	// Mixed level at the previous CPU cycle
+	level   float32
+	blip    *blipBuffer
+	filters []filter
+}
+
+// NewMixer attaches mixer to APU running at clockRate
+// and produces samples at sampleRate, several mixers can be attached
+func NewMixer(apu *APU, clockRate int, sampleRate int) *Mixer {
+	m := &Mixer{
+		apu:        apu,
+		clockRate:  clockRate,
+		sampleRate: sampleRate,
+		master:     1,
+		solo:       -1,
+		blip:       newBlipBuffer(clockRate, sampleRate),
+		// Filter chain of the NES audio output
+		filters: []filter{
+			newFilter(true, 90, sampleRate),
+			newFilter(true, 440, sampleRate),
+			newFilter(false, 14000, sampleRate),
+		},
+	}
+	for i := range m.volumes {
+		m.volumes[i] = 1
+	}
+	apu.mixers = append(apu.mixers, m)
+	return m
+}
+
+// SetExpansion adds cartridge sound chip to the mix
+func (m *Mixer) SetExpansion(expansion ExpansionAudio) {
+	m.expansion = expansion
+}
+
+// SetVolume sets channel volume, 1 is the normal level
+func (m *Mixer) SetVolume(channel int, volume float32) {
+	m.volumes[channel] = volume
+}
+
+// Volume returns channel volume
+func (m *Mixer) Volume(channel int) float32 {
+	return m.volumes[channel]
+}
+
+// SetMuted mutes or unmutes the channel
+func (m *Mixer) SetMuted(channel int, muted bool) {
+	m.muted[channel] = muted
+}
+
+// Muted reports whether the channel is muted
+func (m *Mixer) Muted(channel int) bool {
+	return m.muted[channel]
+}
+
+// SetMasterVolume scales the whole output, used for fades
+func (m *Mixer) SetMasterVolume(volume float32) {
+	m.master = volume
+}
+
+// SetRateAdjust changes output rate by the given ratio,
+// used to keep audio device buffer from draining or overflowing
+func (m *Mixer) SetRateAdjust(ratio float64) {
+	m.blip.factor = float64(m.sampleRate) / float64(m.clockRate) * ratio
+}
+
+// Level of the channel scaled by its volume
+func (m *Mixer) channel(channel int) float32 {
+	if m.muted[channel] {
+		return 0
+	}
+	return float32(m.apu.Output(channel)) * m.volumes[channel]
+}
+
+func (m *Mixer) mix() float32 {
+	if m.solo >= 0 {
+		return m.mixSolo()
+	}
+	pulse := dacLookup(pulseMixTable[:], m.channel(ChannelPulse1)+m.channel(ChannelPulse2))
+	tnd := dacLookup(tndMixTable[:],
+		3*m.channel(ChannelTriangle)+2*m.channel(ChannelNoise)+m.channel(ChannelDMC))
+	out := pulse + tnd
+	if m.expansion != nil && !m.muted[ChannelExpansion] {
+		out += m.expansion.Sample() * expansionGain * m.volumes[ChannelExpansion]
+	}
+	return out
+}
+
+// mixSolo passes only the solo channel through its DAC
+func (m *Mixer) mixSolo() float32 {
+	switch m.solo {
+	case ChannelPulse1, ChannelPulse2:
+		return dacLookup(pulseMixTable[:], m.channel(m.solo))
+	case ChannelTriangle:
+		return dacLookup(tndMixTable[:], 3*m.channel(m.solo))
+	case ChannelNoise:
+		return dacLookup(tndMixTable[:], 2*m.channel(m.solo))
+	case ChannelDMC:
+		return dacLookup(tndMixTable[:], m.channel(m.solo))
+	}
+	if m.expansion != nil && !m.muted[ChannelExpansion] {
+		return m.expansion.Sample() * expansionGain * m.volumes[ChannelExpansion]
+	}
+	return 0
+}
+
+// Interpolates DAC table at fractional index produced by volume scaling
+func dacLookup(table []float32, x float32) float32 {
+	last := len(table) - 1
+	switch {
+	case x <= 0:
+		return 0
+	case x >= float32(last):
+		return table[last]
+	}
+	i := int(x)
+	return table[i] + (table[i+1]-table[i])*(x-float32(i))
+}
+
+// clock is called by APU every CPU cycle
+func (m *Mixer) clock() {
+	if level := m.mix(); level != m.level {
+		m.blip.addDelta(level - m.level)
+		m.level = level
+	}
+	m.blip.advance(1)
+}
+
+// Samples returns filtered samples in range [-1, 1]
+// produced since the last call
+func (m *Mixer) Samples() []float32 {
+	samples := m.blip.read()
+	for i, s := range samples {
+		for f := range m.filters {
+			s = m.filters[f].apply(s)
+		}
+		s *= m.master
+		if s > 1 {
+			s = 1
+		} else if s < -1 {
+			s = -1
+		}
+		samples[i] = s
+	}
+	return samples
+}
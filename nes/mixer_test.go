@@ -0,0 +1,85 @@
+package nes
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBlipStep(t *testing.T) {
+	b := newBlipBuffer(4, 1)
+	b.advance(1)
+	b.addDelta(1)
+	b.advance(4 * 2 * blipTaps)
+
+	samples := b.read()
+	if len(samples) != 2*blipTaps {
+		t.Fatalf("Unexpected sample count %d", len(samples))
+	}
+	if math.Abs(float64(samples[0])) > 1e-3 {
+		t.Fatalf("Step appeared before the kernel delay: %f", samples[0])
+	}
+	if last := samples[len(samples)-1]; math.Abs(float64(last-1)) > 1e-4 {
+		t.Fatalf("Step settled at %f", last)
+	}
+}
+
+// Plays 440 Hz square on pulse 1 for one frame and returns RMS of the output
+func pulseRMS(enabled byte, muted bool) (float64, int) {
+	a := NewAPU(nil)
+	m := NewMixer(a, CPUClockNTSC, 44100)
+	m.SetMuted(ChannelPulse1, muted)
+
+	a.WriteRegister(APUStatus, enabled)
+	a.WriteRegister(0x4000, 0xBF)
+	a.WriteRegister(0x4002, 0xFD)
+	a.WriteRegister(0x4003, 0x00)
+	a.Clock(CPUClockNTSC / 60)
+
+	samples := m.Samples()
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+	return math.Sqrt(sum / float64(len(samples))), len(samples)
+}
+
+func TestMixerMute(t *testing.T) {
+	rms, n := pulseRMS(0x01, false)
+	if n < 730 || n > 740 {
+		t.Fatalf("Unexpected sample count %d for one frame", n)
+	}
+	if rms < 0.05 {
+		t.Fatalf("Pulse channel too quiet, RMS %f", rms)
+	}
+	// Idle triangle still outputs DC level, muted pulse must not add to it
+	silent, _ := pulseRMS(0x00, false)
+	if rms, _ := pulseRMS(0x01, true); rms != silent {
+		t.Fatalf("Muted channel is audible, RMS %f, expected %f", rms, silent)
+	}
+}
+
+func TestMixerSolo(t *testing.T) {
+	a := NewAPU(nil)
+	muted := NewMixer(a, CPUClockNTSC, 44100)
+	for ch := 0; ch < mixerChannels; ch++ {
+		muted.SetMuted(ch, ch != ChannelPulse1)
+	}
+	solo := NewMixer(a, CPUClockNTSC, 44100)
+	solo.solo = ChannelPulse1
+
+	a.WriteRegister(APUStatus, 0x01)
+	a.WriteRegister(0x4000, 0xBF)
+	a.WriteRegister(0x4002, 0xFD)
+	a.WriteRegister(0x4003, 0x00)
+	a.Clock(CPUClockNTSC / 60)
+
+	want, got := muted.Samples(), solo.Samples()
+	if len(got) != len(want) {
+		t.Fatalf("Solo mixer produced %d samples, expected %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Solo sample %d is %f, expected %f", i, got[i], want[i])
+		}
+	}
+}
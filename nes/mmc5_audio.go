@@ -0,0 +1,120 @@
+package nes
+
+const (
+	// MMC5 frame sequencer clocks envelopes and length counters at 240 Hz
+	mmc5FrameCycles = CPUClockNTSC / 240
+
+	mmc5ExRAMSize = 1024
+)
+
+// MMC5Audio is the MMC5 expansion sound: two APU-like pulse channels
+// without sweep and a raw 8-bit PCM channel. NSF players also get
+// the ExRAM and the 8x8 multiplier of the MMC5
+type MMC5Audio struct {
+	pulses      [2]pulse
+	frameTimer  uint16
+	pulseCycle  bool
+	pcm         byte
+	pcmReadMode bool
+
+	exRAM        [mmc5ExRAMSize]byte
+	multiplicand byte
+	multiplier   byte
+}
+
+func (a *MMC5Audio) state(s *stateBuffer) {
+	for i := range a.pulses {
+		a.pulses[i].state(s)
+	}
+	stateNum(s, &a.frameTimer)
+	s.bool(&a.pulseCycle)
+	stateNum(s, &a.pcm)
+	s.bool(&a.pcmReadMode)
+	s.bytes(a.exRAM[:])
+	stateNum(s, &a.multiplicand)
+	stateNum(s, &a.multiplier)
+}
+
+// NewMMC5Audio creates MMC5 sound in its power up state
+func NewMMC5Audio() *MMC5Audio {
+	a := &MMC5Audio{}
+	for i := range a.pulses {
+		a.pulses[i].noSweep = true
+	}
+	return a
+}
+
+// Read handles reads from $5000-$5FFF
+func (a *MMC5Audio) Read(addr uint16) byte {
+	switch {
+	case addr == 0x5015:
+		var v byte
+		for i := range a.pulses {
+			if a.pulses[i].length > 0 {
+				v |= 1 << i
+			}
+		}
+		return v
+	case addr == 0x5205:
+		return byte(uint16(a.multiplicand) * uint16(a.multiplier))
+	case addr == 0x5206:
+		return byte(uint16(a.multiplicand) * uint16(a.multiplier) >> 8)
+	case addr >= 0x5C00:
+		return a.exRAM[addr-0x5C00]
+	}
+	return 0
+}
+
+// Write handles writes to $5000-$5FFF
+func (a *MMC5Audio) Write(addr uint16, val byte) {
+	switch {
+	case addr >= 0x5000 && addr < 0x5008:
+		// There is no sweep register
+		if reg := addr & 0x03; reg != 1 {
+			a.pulses[(addr-0x5000)/4].write(reg, val)
+		}
+	case addr == 0x5010:
+		a.pcmReadMode = val&0x01 != 0
+	case addr == 0x5011:
+		// Zero is ignored, it stops PCM playback in read mode
+		if !a.pcmReadMode && val != 0 {
+			a.pcm = val
+		}
+	case addr == 0x5015:
+		a.pulses[0].setEnabled(val&0x01 != 0)
+		a.pulses[1].setEnabled(val&0x02 != 0)
+	case addr == 0x5205:
+		a.multiplicand = val
+	case addr == 0x5206:
+		a.multiplier = val
+	case addr >= 0x5C00:
+		a.exRAM[addr-0x5C00] = val
+	}
+}
+
+// Clock advances the channels by the given number of CPU cycles
+func (a *MMC5Audio) Clock(cycles uint16) {
+	for i := uint16(0); i < cycles; i++ {
+		a.frameTimer++
+		if a.frameTimer == mmc5FrameCycles {
+			a.frameTimer = 0
+			for ch := range a.pulses {
+				a.pulses[ch].env.clock()
+				a.pulses[ch].clockLength()
+			}
+		}
+		// Pulse timers tick every other CPU cycle as in the APU
+		a.pulseCycle = !a.pulseCycle
+		if a.pulseCycle {
+			a.pulses[0].clockTimer()
+			a.pulses[1].clockTimer()
+		}
+	}
+}
+
+// Sample returns mixed output of all channels in range [0, 1],
+// PCM takes a third of the range
+func (a *MMC5Audio) Sample() float32 {
+	pulses := float32(a.pulses[0].output()+a.pulses[1].output()) / 30
+	return (2*pulses + float32(a.pcm)/255) / 3
+}
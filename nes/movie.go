@@ -0,0 +1,335 @@
+package nes
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	fm2Version = 3
+
+	// FM2 port types
+	fm2PortNone    = 0
+	fm2PortGamepad = 1
+
+	// FM2 gamepad buttons from the leftmost character
+	fm2Buttons = "RLDUTSBA"
+
+	// Longest line, embedded save states take a single one
+	fm2MaxLine = 16 << 20
+)
+
+// Movie commands recorded along with the input of a frame, see
+// Console.MovieCommand. VS System coins are ignored
+const (
+	MovieSoftReset byte = 1 << iota
+	MovieHardReset
+	MovieFDSInsert
+	MovieFDSSelect
+	MovieVSInsertCoin
+)
+
+// MovieFrame is input of a single frame
+type MovieFrame struct {
+	Commands byte
+	// Buttons of controllers 1-4, bit n is set when button n is pressed
+	Pads [4]byte
+}
+
+// Movie is a recording of controller input from power on or from a save
+// state, stored in FCEUX FM2 text format. Snapshots embedded by darknes
+// are darknes save states, FCEUX ones cannot be loaded
+type Movie struct {
+	RomFilename   string
+	RomChecksum   [16]byte
+	GUID          string
+	RerecordCount int
+	PAL           bool
+	FourScore     bool
+	// Standard controllers are plugged into the ports
+	Ports    [2]bool
+	Comments []string
+	Frames   []MovieFrame
+	// Save state the movie starts from, nil when it starts from power on
+	SaveState []byte
+
+	// Header fields not interpreted by the emulator, kept for writing
+	extra [][2]string
+}
+
+// NewMovie creates empty movie of the ROM with two controllers
+func NewMovie(rom *Rom, romFilename string) *Movie {
+	return &Movie{
+		RomFilename: romFilename,
+		RomChecksum: rom.MD5,
+		Ports:       [2]bool{true, true},
+	}
+}
+
+// ReadFM2 parses FM2 movie. Only gamepad input is supported, movies
+// starting from FCEUX save states are rejected
+func ReadFM2(r io.Reader) (*Movie, error) {
+	m := &Movie{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, fm2MaxLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if text == "" {
+			continue
+		}
+		if text[0] == '|' {
+			frame, err := m.parseFrame(text)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			m.Frames = append(m.Frames, frame)
+			continue
+		}
+		key, value, _ := strings.Cut(text, " ")
+		if err := m.parseHeader(key, value); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Movie) parseHeader(key string, value string) error {
+	var err error
+	switch key {
+	case "version":
+		if value != strconv.Itoa(fm2Version) {
+			return fmt.Errorf("unsupported FM2 version %s", value)
+		}
+	case "binary":
+		if value != "0" {
+			return errors.New("binary FM2 movies are not supported")
+		}
+	case "savestate":
+		m.SaveState, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(value, "base64:"))
+		if err == nil && !isSaveState(m.SaveState) {
+			err = errors.New("movies starting from FCEUX save states are not supported")
+		}
+	case "romFilename":
+		m.RomFilename = value
+	case "romChecksum":
+		var sum []byte
+		sum, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(value, "base64:"))
+		if err == nil && len(sum) != len(m.RomChecksum) {
+			err = errors.New("bad ROM checksum")
+		}
+		copy(m.RomChecksum[:], sum)
+	case "guid":
+		m.GUID = value
+	case "rerecordCount":
+		m.RerecordCount, err = strconv.Atoi(value)
+	case "palFlag":
+		m.PAL = value == "1"
+	case "fourscore":
+		m.FourScore = value == "1"
+	case "port0", "port1":
+		switch value {
+		case strconv.Itoa(fm2PortNone):
+		case strconv.Itoa(fm2PortGamepad):
+			m.Ports[key[4]-'0'] = true
+		default:
+			return fmt.Errorf("unsupported %s device %s", key, value)
+		}
+	case "comment":
+		m.Comments = append(m.Comments, value)
+	case "emuVersion", "microphone", "port2":
+		// Written with fixed values
+	default:
+		m.extra = append(m.extra, [2]string{key, value})
+	}
+	return err
+}
+
+// Frame line is |commands|port0|port1|port2| or
+// |commands|pad1|pad2|pad3|pad4|port2| with Four Score
+func (m *Movie) parseFrame(text string) (MovieFrame, error) {
+	var frame MovieFrame
+	fields := strings.Split(text, "|")
+	pads := 2
+	if m.FourScore {
+		pads = 4
+	}
+	if len(fields) < pads+3 {
+		return frame, errors.New("not enough fields in input line")
+	}
+
+	commands, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return frame, fmt.Errorf("bad commands %q", fields[1])
+	}
+	frame.Commands = byte(commands)
+
+	for i := 0; i < pads; i++ {
+		if !m.FourScore && !m.Ports[i] {
+			continue
+		}
+		field := fields[2+i]
+		if len(field) != len(fm2Buttons) {
+			return frame, fmt.Errorf("bad gamepad input %q", field)
+		}
+		for c := 0; c < len(field); c++ {
+			if field[c] != ' ' && field[c] != '.' {
+				frame.Pads[i] |= 1 << (len(fm2Buttons) - 1 - c)
+			}
+		}
+	}
+	return frame, nil
+}
+
+// WriteFM2 writes the movie in FM2 format
+func (m *Movie) WriteFM2(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "version %d\n", fm2Version)
+	fmt.Fprintf(bw, "emuVersion 22020\n")
+	fmt.Fprintf(bw, "rerecordCount %d\n", m.RerecordCount)
+	fmt.Fprintf(bw, "palFlag %d\n", boolInt(m.PAL))
+	fmt.Fprintf(bw, "romFilename %s\n", m.RomFilename)
+	fmt.Fprintf(bw, "romChecksum base64:%s\n", base64.StdEncoding.EncodeToString(m.RomChecksum[:]))
+	if m.GUID != "" {
+		fmt.Fprintf(bw, "guid %s\n", m.GUID)
+	}
+	fmt.Fprintf(bw, "fourscore %d\n", boolInt(m.FourScore))
+	fmt.Fprintf(bw, "microphone 0\n")
+	for port, plugged := range m.Ports {
+		portType := fm2PortNone
+		if plugged && !m.FourScore {
+			portType = fm2PortGamepad
+		}
+		fmt.Fprintf(bw, "port%d %d\n", port, portType)
+	}
+	fmt.Fprintf(bw, "port2 0\n")
+	for _, field := range m.extra {
+		fmt.Fprintf(bw, "%s %s\n", field[0], field[1])
+	}
+	for _, comment := range m.Comments {
+		fmt.Fprintf(bw, "comment %s\n", comment)
+	}
+	if m.SaveState != nil {
+		fmt.Fprintf(bw, "savestate base64:%s\n", base64.StdEncoding.EncodeToString(m.SaveState))
+	}
+
+	pads := 2
+	if m.FourScore {
+		pads = 4
+	}
+	for _, frame := range m.Frames {
+		fmt.Fprintf(bw, "|%d|", frame.Commands)
+		for i := 0; i < pads; i++ {
+			if m.FourScore || m.Ports[i] {
+				bw.WriteString(fm2Pad(frame.Pads[i]))
+			}
+			bw.WriteByte('|')
+		}
+		bw.WriteString("|\n")
+	}
+	return bw.Flush()
+}
+
+func fm2Pad(buttons byte) string {
+	b := []byte(fm2Buttons)
+	for c := range b {
+		if buttons&(1<<(len(b)-1-c)) == 0 {
+			b[c] = '.'
+		}
+	}
+	return string(b)
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// MoviePlayer feeds movie input into controllers. Frame should be called
+// once before emulation starts and then at every frame start (see
+// PPU.SetFrameHook), the game sees input of frame n after the n-th vblank
+type MoviePlayer struct {
+	movie *Movie
+	pads  []*Controller
+	frame int
+	// OnCommand is called for frames with commands, usually
+	// Console.MovieCommand. It runs inside PPU so it must not
+	// reset the console right away
+	OnCommand func(commands byte)
+}
+
+// NewMoviePlayer creates player driving controllers 1-4
+func NewMoviePlayer(movie *Movie, pads []*Controller) *MoviePlayer {
+	return &MoviePlayer{movie: movie, pads: pads}
+}
+
+// Frame applies input of the next frame, all buttons are released
+// once the movie ends
+func (p *MoviePlayer) Frame() {
+	var frame MovieFrame
+	if p.frame < len(p.movie.Frames) {
+		frame = p.movie.Frames[p.frame]
+	}
+	p.frame++
+	if frame.Commands != 0 && p.OnCommand != nil {
+		p.OnCommand(frame.Commands)
+	}
+	for i, pad := range p.pads {
+		pad.SetButtons(frame.Pads[i])
+	}
+}
+
+// Done reports whether all frames of the movie were played
+func (p *MoviePlayer) Done() bool {
+	return p.frame >= len(p.movie.Frames)
+}
+
+// MovieRecorder appends controller input to a movie. Input is taken from
+// source controllers driven by the user and passed to the console ones
+// only at frame start, so the game sees exactly what is recorded
+type MovieRecorder struct {
+	movie  *Movie
+	source []*Controller
+	pads   []*Controller
+	// Commands waiting for the next frame
+	commands byte
+	// OnCommand is called for frames with commands, see MoviePlayer
+	OnCommand func(commands byte)
+}
+
+// NewMovieRecorder creates recorder copying source controllers
+// into console controllers frame by frame
+func NewMovieRecorder(movie *Movie, source []*Controller, pads []*Controller) *MovieRecorder {
+	return &MovieRecorder{movie: movie, source: source, pads: pads}
+}
+
+// Command records commands such as resets into the next frame,
+// they are carried out by OnCommand when the frame starts
+func (r *MovieRecorder) Command(commands byte) {
+	r.commands |= commands
+}
+
+// Frame records input and commands of the next frame and applies them
+func (r *MovieRecorder) Frame() {
+	frame := MovieFrame{Commands: r.commands}
+	r.commands = 0
+	if frame.Commands != 0 && r.OnCommand != nil {
+		r.OnCommand(frame.Commands)
+	}
+	for i, pad := range r.pads {
+		frame.Pads[i] = r.source[i].Buttons()
+		pad.SetButtons(frame.Pads[i])
+	}
+	r.movie.Frames = append(r.movie.Frames, frame)
+}
@@ -0,0 +1,88 @@
+package nes
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testFM2 = `version 3
+emuVersion 22020
+rerecordCount 5
+palFlag 0
+romFilename test
+romChecksum base64:AAECAwQFBgcICQoLDA0ODw==
+guid 452DE2C3-EF43-2FA9-77AC-0677FC51543B
+fourscore 0
+microphone 0
+port0 1
+port1 1
+port2 0
+comment author nobody
+|0|R......A|........||
+|1|....T...|.L....B.||
+`
+
+func TestFM2RoundTrip(t *testing.T) {
+	m, err := ReadFM2(strings.NewReader(testFM2))
+	if err != nil {
+		t.Fatalf("Failed to read movie: %v", err)
+	}
+	if m.RerecordCount != 5 || m.RomChecksum[15] != 15 || len(m.Frames) != 2 {
+		t.Fatalf("Unexpected movie header %+v", m)
+	}
+	// Buttons are stored in controller order
+	if m.Frames[0].Pads[0] != 1<<ButtonRight|1<<ButtonA || m.Frames[1].Commands != MovieSoftReset ||
+		m.Frames[1].Pads[1] != 1<<ButtonLeft|1<<ButtonB {
+		t.Fatalf("Unexpected frames %+v", m.Frames)
+	}
+
+	var out bytes.Buffer
+	if err := m.WriteFM2(&out); err != nil {
+		t.Fatalf("Failed to write movie: %v", err)
+	}
+	if out.String() != testFM2 {
+		t.Fatalf("Written movie differs:\n%s", out.String())
+	}
+
+	if _, err := ReadFM2(strings.NewReader("version 3\nsavestate base64:AAAA\n")); err == nil {
+		t.Fatalf("Movie starting from save state accepted")
+	}
+}
+
+func TestMoviePlayback(t *testing.T) {
+	m, _ := ReadFM2(strings.NewReader(testFM2))
+	pads := []*Controller{NewController(), NewController()}
+	player := NewMoviePlayer(m, pads)
+	var commands byte
+	player.OnCommand = func(c byte) { commands = c }
+
+	player.Frame()
+	if pads[0].Buttons() != m.Frames[0].Pads[0] || player.Done() {
+		t.Fatalf("First frame not applied")
+	}
+	player.Frame()
+	if commands != MovieSoftReset || pads[1].Buttons() != m.Frames[1].Pads[1] || !player.Done() {
+		t.Fatalf("Second frame not applied")
+	}
+
+	// Recording the played input gives the same frames
+	recorded := &Movie{}
+	source := []*Controller{NewController(), NewController()}
+	recorder := NewMovieRecorder(recorded, source, pads)
+	source[0].SetButtons(0x81)
+	recorder.Frame()
+	if len(recorded.Frames) != 1 || recorded.Frames[0].Pads[0] != 0x81 || pads[0].Buttons() != 0x81 {
+		t.Fatalf("Unexpected recorded frames %+v", recorded.Frames)
+	}
+
+	// Resets go into the next recorded frame only
+	commands = 0
+	recorder.OnCommand = func(c byte) { commands = c }
+	recorder.Command(MovieHardReset)
+	recorder.Frame()
+	recorder.Frame()
+	if recorded.Frames[1].Commands != MovieHardReset || recorded.Frames[2].Commands != 0 || commands != MovieHardReset {
+		t.Fatalf("Reset not recorded %+v", recorded.Frames)
+	}
+}
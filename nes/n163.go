@@ -0,0 +1,332 @@
+package nes
+
+const (
+	n163RAMSize = 128
+	// Sound registers occupy the upper part of internal RAM
+	n163SoundRegs = 0x40
+	// One channel is updated every 15 CPU cycles
+	n163ChannelCycles = 15
+)
+
+// N163 is iNES mapper 019 (Namco 129/163)
+type N163 struct {
+	prgRom []byte
+	chrMem []byte
+	prgRAM []byte
+	// Board provides CHR RAM instead of ROM
+	chrRAM bool
+
+	soundOff   bool
+	ramProtect byte
+
+	chrBanks [8]byte
+	// Nametables, $E0-$FF select VRAM page, lower values CHR bank
+	ntBanks  [4]byte
+	prgBanks [3]byte // $8000, $A000, $C000
+
+	// 15-bit IRQ counter incremented every CPU cycle
+	irqCounter uint16
+	irqEnabled bool
+	irqPending bool
+
+	// Wavetable sound with internal RAM shared by game saves
+	audio *N163Audio
+}
+
+// NewN163 creates Namco 163 mapper for the given ROM
+func NewN163(rom *Rom) *N163 {
+	m := &N163{
+		prgRom: rom.prgRom,
+		chrMem: rom.chrRom,
+		prgRAM: make([]byte, prgBank8k),
+		audio:  &N163Audio{},
+	}
+	if len(m.chrMem) == 0 {
+		m.chrMem = make([]byte, 8*chrBank1k)
+		m.chrRAM = true
+	}
+	return m
+}
+
+// Translate is a no-op, N163 serves cartridge space by itself
+func (m *N163) Translate(addr uint16) uint16 {
+	return addr
+}
+
+func (m *N163) state(s *stateBuffer) {
+	s.block(m.prgRAM)
+	if m.chrRAM {
+		s.block(m.chrMem)
+	}
+	s.bool(&m.soundOff)
+	stateNum(s, &m.ramProtect)
+	s.bytes(m.chrBanks[:])
+	s.bytes(m.ntBanks[:])
+	s.bytes(m.prgBanks[:])
+	stateNum(s, &m.irqCounter)
+	s.bool(&m.irqEnabled)
+	s.bool(&m.irqPending)
+	m.audio.state(s)
+}
+
+func (m *N163) prgBankCount() uint32 {
+	return uint32(len(m.prgRom)) / prgBank8k
+}
+
+// ReadPrg reads a byte from the cartridge space
+func (m *N163) ReadPrg(addr uint16) byte {
+	switch {
+	case addr >= 0x4800 && addr < 0x5000:
+		return m.audio.ReadData()
+	case addr >= 0x5000 && addr < 0x5800:
+		return byte(m.irqCounter)
+	case addr >= 0x5800 && addr < 0x6000:
+		v := byte(m.irqCounter>>8) & 0x7F
+		if m.irqEnabled {
+			v |= 0x80
+		}
+		return v
+	case addr >= 0x6000 && addr < 0x8000:
+		return m.prgRAM[addr-0x6000]
+	case addr >= 0x8000 && addr < 0xE000:
+		slot := (addr - 0x8000) / 0x2000
+		bank := uint32(m.prgBanks[slot]&0x3F) % m.prgBankCount()
+		return m.prgRom[bank*prgBank8k+uint32(addr&0x1FFF)]
+	case addr >= 0xE000:
+		// $E000-$FFFF is fixed to the last bank
+		bank := m.prgBankCount() - 1
+		return m.prgRom[bank*prgBank8k+uint32(addr&0x1FFF)]
+	}
+	return 0
+}
+
+// WritePrg handles writes into PRG RAM and mapper registers
+func (m *N163) WritePrg(addr uint16, val byte) {
+	switch {
+	case addr >= 0x4800 && addr < 0x5000:
+		m.audio.WriteData(val)
+	case addr >= 0x5000 && addr < 0x5800:
+		m.irqCounter = m.irqCounter&0x7F00 | uint16(val)
+		m.irqPending = false
+	case addr >= 0x5800 && addr < 0x6000:
+		m.irqCounter = m.irqCounter&0x00FF | uint16(val&0x7F)<<8
+		m.irqEnabled = val&0x80 != 0
+		m.irqPending = false
+	case addr >= 0x6000 && addr < 0x8000:
+		if m.prgRAMWritable(addr) {
+			m.prgRAM[addr-0x6000] = val
+		}
+	case addr >= 0x8000 && addr < 0xC000:
+		m.chrBanks[(addr-0x8000)/0x800] = val
+	case addr >= 0xC000 && addr < 0xE000:
+		m.ntBanks[(addr-0xC000)/0x800] = val
+	case addr >= 0xE000 && addr < 0xE800:
+		m.prgBanks[0] = val & 0x3F
+		m.soundOff = val&0x40 != 0
+	case addr >= 0xE800 && addr < 0xF000:
+		m.prgBanks[1] = val & 0x3F
+	case addr >= 0xF000 && addr < 0xF800:
+		m.prgBanks[2] = val & 0x3F
+	case addr >= 0xF800:
+		m.audio.SetAddress(val)
+		m.ramProtect = val
+	}
+}
+
+// PRG RAM is split into four 2KB windows protected by bits 0-3 of $F800,
+// writes are enabled only when upper nibble equals 0100
+func (m *N163) prgRAMWritable(addr uint16) bool {
+	if m.ramProtect&0xF0 != 0x40 {
+		return false
+	}
+	window := (addr - 0x6000) / 0x800
+	return m.ramProtect&(1<<window) == 0
+}
+
+func (m *N163) chrAddr(addr uint16) uint32 {
+	bank := uint32(m.chrBanks[(addr>>10)&0x07])
+	return (bank*chrBank1k + uint32(addr&0x03FF)) % uint32(len(m.chrMem))
+}
+
+// ReadChr reads a byte from the pattern tables
+func (m *N163) ReadChr(addr uint16) byte {
+	return m.chrMem[m.chrAddr(addr)]
+}
+
+// WriteChr writes a byte into pattern tables, CHR ROM ignores writes
+func (m *N163) WriteChr(addr uint16, val byte) {
+	if m.chrRAM {
+		m.chrMem[m.chrAddr(addr)] = val
+	}
+}
+
+// NametablePage maps nametable to VRAM page for bank numbers $E0-$FF,
+// lower numbers select 1KB bank of CHR memory
+func (m *N163) NametablePage(table uint16) (uint16, bool) {
+	bank := m.ntBanks[table]
+	return uint16(bank & 1), bank >= 0xE0
+}
+
+func (m *N163) nametableAddr(addr uint16) uint32 {
+	bank := uint32(m.ntBanks[(addr>>10)&3])
+	return (bank*chrBank1k + uint32(addr&0x03FF)) % uint32(len(m.chrMem))
+}
+
+// ReadNametable reads nametable mapped into CHR memory
+func (m *N163) ReadNametable(addr uint16) byte {
+	return m.chrMem[m.nametableAddr(addr)]
+}
+
+// WriteNametable writes nametable mapped into CHR memory, CHR ROM
+// ignores writes
+func (m *N163) WriteNametable(addr uint16, val byte) {
+	if m.chrRAM {
+		m.chrMem[m.nametableAddr(addr)] = val
+	}
+}
+
+// Clock increments IRQ counter and updates sound channels
+func (m *N163) Clock(cycles uint16) {
+	for i := uint16(0); i < cycles; i++ {
+		if m.irqEnabled && m.irqCounter < 0x7FFF {
+			m.irqCounter++
+			if m.irqCounter == 0x7FFF {
+				m.irqPending = true
+			}
+		}
+	}
+	if !m.soundOff {
+		m.audio.Clock(cycles)
+	}
+}
+
+// IRQ reports whether the IRQ line is asserted
+func (m *N163) IRQ() bool {
+	return m.irqPending
+}
+
+// Sample returns N163 sound output in range [0, 1]
+func (m *N163) Sample() float32 {
+	if m.soundOff {
+		return 0
+	}
+	return m.audio.Sample()
+}
+
+// SaveData returns contents of battery-backed PRG RAM and internal RAM
+func (m *N163) SaveData() []byte {
+	data := make([]byte, 0, len(m.prgRAM)+n163RAMSize)
+	data = append(data, m.prgRAM...)
+	return append(data, m.audio.ram[:]...)
+}
+
+// LoadSaveData restores battery-backed memory saved by SaveData
+func (m *N163) LoadSaveData(data []byte) {
+	n := copy(m.prgRAM, data)
+	copy(m.audio.ram[:], data[n:])
+}
+
+// N163Audio is the Namco 163 wavetable sound with its internal RAM.
+// Up to 8 channels are time-multiplexed, so the more channels are
+// enabled the lower is the sample rate of each one
+type N163Audio struct {
+	ram      [n163RAMSize]byte
+	ramAddr  byte
+	autoIncr bool
+
+	// Current channel being updated and its output levels
+	channelTimer byte
+	channel      byte
+	outputs      [8]float32
+}
+
+func (a *N163Audio) state(s *stateBuffer) {
+	s.bytes(a.ram[:])
+	stateNum(s, &a.ramAddr)
+	s.bool(&a.autoIncr)
+	stateNum(s, &a.channelTimer)
+	stateNum(s, &a.channel)
+	for i := range a.outputs {
+		s.float(&a.outputs[i])
+	}
+}
+
+// SetAddress handles writes to the address port ($F800-$FFFF)
+func (a *N163Audio) SetAddress(val byte) {
+	a.ramAddr = val & 0x7F
+	a.autoIncr = val&0x80 != 0
+}
+
+// ReadData handles reads from the data port ($4800-$4FFF)
+func (a *N163Audio) ReadData() byte {
+	v := a.ram[a.ramAddr]
+	a.incrementAddr()
+	return v
+}
+
+// WriteData handles writes to the data port ($4800-$4FFF)
+func (a *N163Audio) WriteData(val byte) {
+	a.ram[a.ramAddr] = val
+	a.incrementAddr()
+}
+
+func (a *N163Audio) incrementAddr() {
+	if a.autoIncr {
+		a.ramAddr = (a.ramAddr + 1) & 0x7F
+	}
+}
+
+// Clock advances the channels by the given number of CPU cycles
+func (a *N163Audio) Clock(cycles uint16) {
+	for i := uint16(0); i < cycles; i++ {
+		a.channelTimer++
+		if a.channelTimer == n163ChannelCycles {
+			a.channelTimer = 0
+			a.clockChannel()
+		}
+	}
+}
+
+// Number of enabled channels is stored in bits 4-6 of $7F
+func (a *N163Audio) channelCount() byte {
+	return (a.ram[0x7F]>>4)&0x07 + 1
+}
+
+// Updates a single channel, channels are time-multiplexed
+// starting from channel 7 downwards
+func (a *N163Audio) clockChannel() {
+	count := a.channelCount()
+	if a.channel >= count {
+		a.channel = 0
+	}
+	ch := 7 - a.channel
+	regs := a.ram[n163SoundRegs+ch*8 : n163SoundRegs+ch*8+8]
+
+	freq := uint32(regs[0]) | uint32(regs[2])<<8 | uint32(regs[4]&0x03)<<16
+	phase := uint32(regs[1]) | uint32(regs[3])<<8 | uint32(regs[5])<<16
+	length := (256 - uint32(regs[4]&0xFC)) << 16
+
+	phase = (phase + freq) % length
+	regs[1], regs[3], regs[5] = byte(phase), byte(phase>>8), byte(phase>>16)
+
+	// Wave samples are 4-bit, low nibble first
+	sampleAddr := (uint32(regs[6]) + phase>>16) & 0xFF
+	sample := a.ram[(sampleAddr>>1)&0x7F]
+	if sampleAddr&1 != 0 {
+		sample >>= 4
+	}
+	sample &= 0x0F
+
+	a.outputs[ch] = float32(sample) * float32(regs[7]&0x0F) / 225
+	a.channel++
+}
+
+// Sample returns averaged output of the enabled channels in range [0, 1]
+func (a *N163Audio) Sample() float32 {
+	count := a.channelCount()
+	var out float32
+	for ch := 8 - count; ch < 8; ch++ {
+		out += a.outputs[ch]
+	}
+	return out / float32(count)
+}
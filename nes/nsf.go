@@ -0,0 +1,432 @@
+package nes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	nsfHeaderLen = 0x80
+	nsfBankSize  = 4 * 1024
+
+	// Default play routine rate in microseconds
+	nsfNtscSpeed = 16639
+	nsfPalSpeed  = 19997
+
+	// Expansion sound chips declared in the header
+	NsfChipVRC6 byte = 0x01
+	NsfChipVRC7 byte = 0x02
+	NsfChipFDS  byte = 0x04
+	NsfChipMMC5 byte = 0x08
+	NsfChipN163 byte = 0x10
+	NsfChip5B   byte = 0x20
+
+	// Address of the idle loop the player returns to after INIT and PLAY
+	nsfIdleAddr uint16 = 0x5FF0
+)
+
+// NsfInfo describes music data of an NSF or NSFe file
+type NsfInfo struct {
+	Title     string
+	Artist    string
+	Copyright string
+
+	Songs     int
+	StartSong int // 0-based
+
+	LoadAddr uint16
+	InitAddr uint16
+	PlayAddr uint16
+
+	// Play routine period in microseconds
+	PlaySpeed uint16
+	PAL       bool
+	Banks     [8]byte
+	Chips     byte
+
+	// NSFe track metadata, lengths and fades are in milliseconds
+	// (-1 when unknown)
+	TrackNames   []string
+	TrackLengths []int
+	TrackFades   []int
+}
+
+// Banked reports whether the tune uses bank switching
+func (info *NsfInfo) Banked() bool {
+	for _, b := range info.Banks {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// UnsupportedChips returns names of declared expansion chips
+// the player does not emulate, their channels stay silent.
+// Only VRC7 is not emulated
+func (info *NsfInfo) UnsupportedChips() []string {
+	var names []string
+	if info.Chips&NsfChipVRC7 != 0 {
+		names = append(names, "VRC7")
+	}
+	return names
+}
+
+// LoadNsfData parses .nsf or .nsfe file and returns a cartridge
+// which can be played by NsfPlayer
+func LoadNsfData(data []byte) (*Rom, error) {
+	var info *NsfInfo
+	var prg []byte
+	var err error
+
+	switch {
+	case bytes.HasPrefix(data, []byte("NESM\x1a")):
+		info, prg, err = parseNsf(data)
+	case bytes.HasPrefix(data, []byte("NSFE")):
+		info, prg, err = parseNsfe(data)
+	default:
+		err = errors.New("not an NSF file")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.LoadAddr < 0x8000 {
+		return nil, fmt.Errorf("unsupported NSF load address %04x", info.LoadAddr)
+	}
+
+	rom := &Rom{
+		data:   data,
+		Header: &RomHeader{},
+		prgRom: prg,
+		Nsf:    info,
+	}
+	rom.checksum()
+	return rom, nil
+}
+
+func parseNsf(data []byte) (*NsfInfo, []byte, error) {
+	if len(data) <= nsfHeaderLen {
+		return nil, nil, errors.New("NSF file is too short")
+	}
+	info := &NsfInfo{
+		Songs:     int(data[0x06]),
+		StartSong: int(data[0x07]) - 1,
+		LoadAddr:  binary.LittleEndian.Uint16(data[0x08:]),
+		InitAddr:  binary.LittleEndian.Uint16(data[0x0A:]),
+		PlayAddr:  binary.LittleEndian.Uint16(data[0x0C:]),
+		Title:     cString(data[0x0E:0x2E]),
+		Artist:    cString(data[0x2E:0x4E]),
+		Copyright: cString(data[0x4E:0x6E]),
+		PlaySpeed: binary.LittleEndian.Uint16(data[0x6E:]),
+		PAL:       data[0x7A]&0x03 == 0x01,
+		Chips:     data[0x7B],
+	}
+	copy(info.Banks[:], data[0x70:0x78])
+	if info.PAL {
+		info.PlaySpeed = binary.LittleEndian.Uint16(data[0x78:])
+	}
+	info.fixup()
+	return info, data[nsfHeaderLen:], nil
+}
+
+// NSFe consists of chunks: 4 bytes length, 4 bytes FourCC, data
+func parseNsfe(data []byte) (*NsfInfo, []byte, error) {
+	info := &NsfInfo{}
+	var prg []byte
+	var hasInfo bool
+
+	for p := 4; p+8 <= len(data); {
+		length := int(binary.LittleEndian.Uint32(data[p:]))
+		id := string(data[p+4 : p+8])
+		p += 8
+		if length < 0 || p+length > len(data) {
+			return nil, nil, fmt.Errorf("NSFe chunk %s is truncated", id)
+		}
+		chunk := data[p : p+length]
+		p += length
+
+		switch id {
+		case "INFO":
+			if len(chunk) < 8 {
+				return nil, nil, errors.New("NSFe INFO chunk is too short")
+			}
+			hasInfo = true
+			info.LoadAddr = binary.LittleEndian.Uint16(chunk[0:])
+			info.InitAddr = binary.LittleEndian.Uint16(chunk[2:])
+			info.PlayAddr = binary.LittleEndian.Uint16(chunk[4:])
+			info.PAL = chunk[6]&0x03 == 0x01
+			info.Chips = chunk[7]
+			info.Songs = 1
+			if len(chunk) > 8 {
+				info.Songs = int(chunk[8])
+			}
+			if len(chunk) > 9 {
+				info.StartSong = int(chunk[9])
+			}
+		case "DATA":
+			prg = chunk
+		case "BANK":
+			copy(info.Banks[:], chunk)
+		case "RATE":
+			if len(chunk) >= 2 && !info.PAL {
+				info.PlaySpeed = binary.LittleEndian.Uint16(chunk)
+			}
+			if len(chunk) >= 4 && info.PAL {
+				info.PlaySpeed = binary.LittleEndian.Uint16(chunk[2:])
+			}
+		case "auth":
+			fields := bytes.Split(chunk, []byte{0})
+			for i, f := range []*string{&info.Title, &info.Artist, &info.Copyright} {
+				if i < len(fields) {
+					*f = string(fields[i])
+				}
+			}
+		case "tlbl":
+			for _, name := range bytes.Split(bytes.TrimSuffix(chunk, []byte{0}), []byte{0}) {
+				info.TrackNames = append(info.TrackNames, string(name))
+			}
+		case "time":
+			info.TrackLengths = nsfeTimes(chunk)
+		case "fade":
+			info.TrackFades = nsfeTimes(chunk)
+		case "NEND":
+			p = len(data)
+		default:
+			// Chunks starting with an uppercase letter are mandatory
+			if id[0] >= 'A' && id[0] <= 'Z' {
+				return nil, nil, fmt.Errorf("unsupported NSFe chunk %s", id)
+			}
+		}
+	}
+
+	if !hasInfo || prg == nil {
+		return nil, nil, errors.New("NSFe file has no INFO or DATA chunk")
+	}
+	info.fixup()
+	return info, prg, nil
+}
+
+func nsfeTimes(chunk []byte) []int {
+	times := make([]int, len(chunk)/4)
+	for i := range times {
+		times[i] = int(int32(binary.LittleEndian.Uint32(chunk[i*4:])))
+	}
+	return times
+}
+
+// Fills in defaults for missing or invalid fields
+func (info *NsfInfo) fixup() {
+	if info.Songs < 1 {
+		info.Songs = 1
+	}
+	if info.StartSong < 0 || info.StartSong >= info.Songs {
+		info.StartSong = 0
+	}
+	if info.PlaySpeed == 0 {
+		info.PlaySpeed = nsfNtscSpeed
+		if info.PAL {
+			info.PlaySpeed = nsfPalSpeed
+		}
+	}
+}
+
+// NsfMapper maps NSF music data into cartridge space, performs
+// $5FF8-$5FFF bank switching and hosts declared expansion chips
+type NsfMapper struct {
+	prg    []byte
+	banks  [8]byte
+	prgRAM [8 * 1024]byte
+
+	vrc6 *VRC6Audio
+	fds  *FdsAudio
+	mmc5 *MMC5Audio
+	n163 *N163Audio
+	s5b  *Sunsoft5B
+}
+
+// NewNsfMapper lays out music data according to its load address.
+// All chips but VRC7 are hosted, see NsfInfo.UnsupportedChips
+func NewNsfMapper(rom *Rom) *NsfMapper {
+	info := rom.Nsf
+	m := &NsfMapper{}
+
+	// Without bank switching data is placed linearly at the load address
+	padding := int(info.LoadAddr - 0x8000)
+	if info.Banked() {
+		padding = int(info.LoadAddr & 0x0FFF)
+	}
+	size := padding + len(rom.prgRom)
+	size = (size + nsfBankSize - 1) / nsfBankSize * nsfBankSize
+	m.prg = make([]byte, size)
+	copy(m.prg[padding:], rom.prgRom)
+
+	if info.Chips&NsfChipVRC6 != 0 {
+		m.vrc6 = &VRC6Audio{}
+	}
+	if info.Chips&NsfChipFDS != 0 {
+		m.fds = NewFdsAudio()
+	}
+	if info.Chips&NsfChipMMC5 != 0 {
+		m.mmc5 = NewMMC5Audio()
+	}
+	if info.Chips&NsfChipN163 != 0 {
+		m.n163 = &N163Audio{}
+	}
+	if info.Chips&NsfChip5B != 0 {
+		m.s5b = NewSunsoft5B()
+	}
+	m.Reset(info)
+	return m
+}
+
+// Reset restores initial bank layout from the header and clears RAM
+func (m *NsfMapper) Reset(info *NsfInfo) {
+	for i := range m.banks {
+		m.banks[i] = byte(i)
+	}
+	if info.Banked() {
+		m.banks = info.Banks
+	}
+	for i := range m.prgRAM {
+		m.prgRAM[i] = 0
+	}
+}
+
+// Translate is a no-op, NSF mapper serves cartridge space by itself
+func (m *NsfMapper) Translate(addr uint16) uint16 {
+	return addr
+}
+
+func (m *NsfMapper) state(s *stateBuffer) {
+	s.bytes(m.banks[:])
+	s.bytes(m.prgRAM[:])
+	if m.vrc6 != nil {
+		m.vrc6.state(s)
+	}
+	if m.fds != nil {
+		m.fds.state(s)
+	}
+	if m.mmc5 != nil {
+		m.mmc5.state(s)
+	}
+	if m.n163 != nil {
+		m.n163.state(s)
+	}
+	if m.s5b != nil {
+		m.s5b.state(s)
+	}
+}
+
+// ReadPrg reads a byte from the cartridge space
+func (m *NsfMapper) ReadPrg(addr uint16) byte {
+	switch {
+	case addr >= nsfIdleAddr && addr < nsfIdleAddr+3:
+		// Idle loop: JMP nsfIdleAddr
+		return [...]byte{0x4C, byte(nsfIdleAddr & 0xFF), byte(nsfIdleAddr >> 8)}[addr-nsfIdleAddr]
+	case addr >= 0x4040 && addr < 0x40A0 && m.fds != nil:
+		return m.fds.Read(addr)
+	case addr >= 0x4800 && addr < 0x5000 && m.n163 != nil:
+		return m.n163.ReadData()
+	case addr >= 0x5000 && addr < nsfIdleAddr && m.mmc5 != nil:
+		// ExRAM ends below the idle loop and bank registers
+		return m.mmc5.Read(addr)
+	case addr >= 0x6000 && addr < 0x8000:
+		return m.prgRAM[addr-0x6000]
+	case addr >= 0x8000:
+		bank := int(m.banks[(addr-0x8000)/nsfBankSize])
+		offset := bank*nsfBankSize + int(addr&0x0FFF)
+		if offset < len(m.prg) {
+			return m.prg[offset]
+		}
+	}
+	return 0
+}
+
+// WritePrg handles writes to bank registers, RAM and expansion chips
+func (m *NsfMapper) WritePrg(addr uint16, val byte) {
+	switch {
+	case addr >= 0x4040 && addr < 0x40A0 && m.fds != nil:
+		m.fds.Write(addr, val)
+	case addr >= 0x4800 && addr < 0x5000 && m.n163 != nil:
+		m.n163.WriteData(val)
+	case addr >= 0x5000 && addr < nsfIdleAddr && m.mmc5 != nil:
+		m.mmc5.Write(addr, val)
+	case addr >= 0x5FF8 && addr <= 0x5FFF:
+		m.banks[addr-0x5FF8] = val
+	case addr >= 0x6000 && addr < 0x8000:
+		m.prgRAM[addr-0x6000] = val
+	case addr >= 0x9000 && addr < 0xC000 && m.vrc6 != nil:
+		m.vrc6.WriteRegister(addr, val)
+	case addr >= 0xF800 && m.n163 != nil:
+		m.n163.SetAddress(val)
+	case addr >= 0xC000 && addr < 0xE000 && m.s5b != nil:
+		m.s5b.SelectRegister(val)
+	case addr >= 0xE000 && m.s5b != nil:
+		m.s5b.WriteRegister(val)
+	}
+}
+
+// ReadChr returns 0, NSF has no graphics
+func (m *NsfMapper) ReadChr(addr uint16) byte {
+	return 0
+}
+
+// WriteChr is a no-op, NSF has no graphics
+func (m *NsfMapper) WriteChr(addr uint16, val byte) {
+}
+
+// Clock runs expansion sound chips
+func (m *NsfMapper) Clock(cycles uint16) {
+	if m.vrc6 != nil {
+		m.vrc6.Clock(cycles)
+	}
+	if m.fds != nil {
+		m.fds.Clock(cycles)
+	}
+	if m.mmc5 != nil {
+		m.mmc5.Clock(cycles)
+	}
+	if m.n163 != nil {
+		m.n163.Clock(cycles)
+	}
+	if m.s5b != nil {
+		m.s5b.Clock(cycles)
+	}
+}
+
+// IRQ is never asserted by NSF mapper
+func (m *NsfMapper) IRQ() bool {
+	return false
+}
+
+// Sample returns mixed output of expansion chips in range [0, 1]
+func (m *NsfMapper) Sample() float32 {
+	var out float32
+	var chips float32
+	if m.vrc6 != nil {
+		out += m.vrc6.Sample()
+		chips++
+	}
+	if m.fds != nil {
+		out += m.fds.Sample()
+		chips++
+	}
+	if m.mmc5 != nil {
+		out += m.mmc5.Sample()
+		chips++
+	}
+	if m.n163 != nil {
+		out += m.n163.Sample()
+		chips++
+	}
+	if m.s5b != nil {
+		out += m.s5b.Sample()
+		chips++
+	}
+	if chips == 0 {
+		return 0
+	}
+	return out / chips
+}
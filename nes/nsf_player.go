@@ -0,0 +1,175 @@
+package nes
+
+// NsfPlayer drives the CPU to play NSF music: it calls INIT for the
+// selected song and then PLAY at the rate declared by the file
+type NsfPlayer struct {
+	cpu    *CPU
+	mapper *NsfMapper
+	info   *NsfInfo
+
+	song int
+
+	// CPU cycles between PLAY calls and until the next call
+	playPeriod int64
+	playTimer  int64
+
+	// CPU cycles passed since the song start
+	elapsed uint64
+	clock   uint64
+}
+
+// NewNsfPlayer creates player for the NSF loaded into CPU memory
+// and starts the default song
+func NewNsfPlayer(cpu *CPU, info *NsfInfo) *NsfPlayer {
+	p := &NsfPlayer{
+		cpu:    cpu,
+		mapper: cpu.mem.Mapper().(*NsfMapper),
+		info:   info,
+		clock:  CPUClockNTSC,
+	}
+	if info.PAL {
+		p.clock = CPUClockPAL
+	}
+	p.playPeriod = int64(info.PlaySpeed) * int64(p.clock) / 1000000
+	p.PlaySong(info.StartSong)
+	return p
+}
+
+func (p *NsfPlayer) state(s *stateBuffer) {
+	stateNum(s, &p.song)
+	stateNum(s, &p.playTimer)
+	stateNum(s, &p.elapsed)
+}
+
+// Step executes a single CPU instruction, calling PLAY routine
+// when the previous call has returned and its period has elapsed
+func (p *NsfPlayer) Step() CpuState {
+	if p.cpu.PC == nsfIdleAddr && p.playTimer <= 0 {
+		p.call(p.info.PlayAddr)
+		p.playTimer += p.playPeriod
+	}
+
+	state := p.cpu.Step()
+	p.playTimer -= int64(state.Cycles)
+	p.elapsed += uint64(state.Cycles)
+
+	// Move on when the track length and fade are known and over
+	if length := p.trackTime(p.info.TrackLengths); length >= 0 {
+		fade := p.trackTime(p.info.TrackFades)
+		if fade < 0 {
+			fade = 0
+		}
+		if p.elapsedMs() >= length+fade && p.song+1 < p.info.Songs {
+			p.NextTrack()
+		}
+	}
+	return state
+}
+
+// Makes CPU jump to the routine, returning to the idle loop
+func (p *NsfPlayer) call(addr uint16) {
+	// RTS adds 1 to the address pulled from stack
+	p.cpu.pushWord(nsfIdleAddr - 1)
+	p.cpu.PC = addr
+}
+
+// PlaySong resets the machine and calls INIT for the given song (0-based)
+func (p *NsfPlayer) PlaySong(song int) {
+	if song < 0 || song >= p.info.Songs {
+		return
+	}
+	p.song = song
+
+	mem := p.cpu.mem
+	for addr := uint16(0); addr < 0x0800; addr++ {
+		mem.Write(addr, 0)
+	}
+	for addr := uint16(0x4000); addr <= 0x4013; addr++ {
+		mem.Write(addr, 0)
+	}
+	mem.Write(0x4015, 0x0F)
+	mem.Write(0x4017, 0x40)
+	p.mapper.Reset(p.info)
+
+	// INIT takes song number in A and region in X
+	p.cpu.A = byte(song)
+	p.cpu.X = 0
+	if p.info.PAL {
+		p.cpu.X = 1
+	}
+	p.cpu.Y = 0
+	p.cpu.S = 0xFD
+	p.cpu.P = 0x04
+	p.cpu.PC = nsfIdleAddr
+	p.call(p.info.InitAddr)
+
+	p.playTimer = p.playPeriod
+	p.elapsed = 0
+}
+
+// NextTrack starts the next song
+func (p *NsfPlayer) NextTrack() {
+	p.PlaySong(p.song + 1)
+}
+
+// PrevTrack starts the previous song
+func (p *NsfPlayer) PrevTrack() {
+	p.PlaySong(p.song - 1)
+}
+
+// Title returns name of the tune
+func (p *NsfPlayer) Title() string {
+	return p.info.Title
+}
+
+// Artist returns author of the tune
+func (p *NsfPlayer) Artist() string {
+	return p.info.Artist
+}
+
+// Track returns current track number (1-based)
+func (p *NsfPlayer) Track() int {
+	return p.song + 1
+}
+
+// TrackCount returns total number of tracks
+func (p *NsfPlayer) TrackCount() int {
+	return p.info.Songs
+}
+
+// TrackName returns NSFe name of the current track if present
+func (p *NsfPlayer) TrackName() string {
+	if p.song < len(p.info.TrackNames) {
+		return p.info.TrackNames[p.song]
+	}
+	return ""
+}
+
+// Volume returns fade out level of the current track in range [0, 1]
+func (p *NsfPlayer) Volume() float32 {
+	length := p.trackTime(p.info.TrackLengths)
+	fade := p.trackTime(p.info.TrackFades)
+	if length < 0 || fade <= 0 {
+		return 1
+	}
+	t := p.elapsedMs() - length
+	switch {
+	case t <= 0:
+		return 1
+	case t >= fade:
+		return 0
+	}
+	return 1 - float32(t)/float32(fade)
+}
+
+// Returns NSFe time of the current track or -1 when unknown
+func (p *NsfPlayer) trackTime(times []int) int {
+	if p.song < len(times) {
+		return times[p.song]
+	}
+	return -1
+}
+
+func (p *NsfPlayer) elapsedMs() int {
+	return int(p.elapsed * 1000 / p.clock)
+}
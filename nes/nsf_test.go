@@ -0,0 +1,183 @@
+package nes
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"testing"
+)
+
+// Builds NSF whose INIT stores song number at $0200
+// and PLAY increments $0201
+func testNsf() []byte {
+	data := make([]byte, nsfHeaderLen)
+	copy(data, "NESM\x1a\x01")
+	data[0x06] = 3 // songs
+	data[0x07] = 2 // starting song
+	binary.LittleEndian.PutUint16(data[0x08:], 0x8000)
+	binary.LittleEndian.PutUint16(data[0x0A:], 0x8000)
+	binary.LittleEndian.PutUint16(data[0x0C:], 0x8004)
+	copy(data[0x0E:], "Test tune")
+	binary.LittleEndian.PutUint16(data[0x6E:], nsfNtscSpeed)
+	return append(data,
+		0x8D, 0x00, 0x02, 0x60, // STA $0200; RTS
+		0xEE, 0x01, 0x02, 0x60, // INC $0201; RTS
+	)
+}
+
+func TestNsfUnsupportedChips(t *testing.T) {
+	info := &NsfInfo{Chips: NsfChipVRC6 | NsfChipVRC7 | NsfChipFDS | NsfChipMMC5}
+	if chips := info.UnsupportedChips(); len(chips) != 1 || chips[0] != "VRC7" {
+		t.Fatalf("Unexpected unsupported chips %v", chips)
+	}
+}
+
+func TestNsfExpansionChips(t *testing.T) {
+	rom, err := LoadNsfData(testNsf())
+	if err != nil {
+		t.Fatalf("Failed to load NSF: %v", err)
+	}
+	rom.Nsf.Chips = NsfChipVRC6 | NsfChipMMC5
+	m := NewNsfMapper(rom)
+
+	// VRC6 pulse 1 at full volume with 100% duty
+	m.WritePrg(0x9000, 0x8F)
+	m.WritePrg(0x9002, 0x80)
+	// MMC5 ExRAM and multiplier
+	m.WritePrg(0x5C00, 0x12)
+	m.WritePrg(0x5205, 200)
+	m.WritePrg(0x5206, 3)
+	m.Clock(1)
+	if m.vrc6.pulses[0].output() != 15 || m.Sample() == 0 {
+		t.Fatalf("VRC6 not played")
+	}
+	if m.ReadPrg(0x5C00) != 0x12 || m.ReadPrg(0x5205) != 88 || m.ReadPrg(0x5206) != 2 {
+		t.Fatalf("MMC5 registers not mapped")
+	}
+	// Idle loop stays above ExRAM
+	if m.ReadPrg(nsfIdleAddr) != 0x4C {
+		t.Fatalf("Idle loop replaced by ExRAM")
+	}
+}
+
+func TestVRC6Pulse(t *testing.T) {
+	a := &VRC6Audio{}
+	// Duty 3 is 4 of 16 steps, period 1 is 2 cycles per step
+	a.WriteRegister(0x9000, 0x3A)
+	a.WriteRegister(0x9001, 0x01)
+	a.WriteRegister(0x9002, 0x80)
+	high := 0
+	for i := 0; i < 32; i++ {
+		a.Clock(1)
+		if a.pulses[0].output() == 10 {
+			high++
+		}
+	}
+	if high != 8 {
+		t.Fatalf("Unexpected %d of 32 cycles high", high)
+	}
+
+	// Halted channels keep their state
+	a.WriteRegister(0x9003, 0x01)
+	pos := a.pulses[0].dutyPos
+	a.Clock(16)
+	if a.pulses[0].dutyPos != pos {
+		t.Fatalf("Halted pulse kept running")
+	}
+	a.WriteRegister(0x9003, 0x04)
+	if a.shift != 8 {
+		t.Fatalf("Unexpected frequency shift %d", a.shift)
+	}
+
+	a.WriteRegister(0x9002, 0x00)
+	if a.pulses[0].output() != 0 {
+		t.Fatalf("Disabled pulse not silent")
+	}
+}
+
+func TestVRC6Saw(t *testing.T) {
+	a := &VRC6Audio{}
+	a.WriteRegister(0xB000, 0x10)
+	a.WriteRegister(0xB002, 0x80)
+	// Accumulator grows every other step and resets on the 14th
+	var levels []byte
+	for i := 0; i < 14; i++ {
+		a.Clock(1)
+		levels = append(levels, a.saw.output())
+	}
+	if levels[1] != 2 || levels[11] != 12 || levels[12] != 12 || levels[13] != 0 {
+		t.Fatalf("Unexpected sawtooth levels %v", levels)
+	}
+	if s := a.Sample(); s != 0 {
+		t.Fatalf("Unexpected sample %v after reset", s)
+	}
+}
+
+func TestMMC5Audio(t *testing.T) {
+	a := NewMMC5Audio()
+	// Length is loaded only into enabled channels
+	a.Write(0x5003, 0x08)
+	if a.Read(0x5015) != 0 {
+		t.Fatalf("Length loaded into disabled pulse")
+	}
+	a.Write(0x5015, 0x02)
+	// Constant volume 15, 50% duty, period below 8 is not muted
+	a.Write(0x5004, 0x9F)
+	a.Write(0x5006, 0x02)
+	a.Write(0x5007, 0x18)
+	if a.Read(0x5015) != 0x02 {
+		t.Fatalf("Pulse 2 length not loaded")
+	}
+	high := false
+	for i := 0; i < 48; i++ {
+		a.Clock(1)
+		high = high || a.pulses[1].output() == 15
+	}
+	if !high {
+		t.Fatalf("Pulse 2 not played")
+	}
+	// Length 2 expires after two 240 Hz frames
+	a.Clock(2 * mmc5FrameCycles)
+	if a.Read(0x5015) != 0 {
+		t.Fatalf("Length counter not expired")
+	}
+
+	// Raw PCM ignores zero writes
+	a.Write(0x5011, 0xFF)
+	a.Write(0x5011, 0x00)
+	if s := a.Sample(); s != float32(1)/3 {
+		t.Fatalf("Unexpected PCM sample %v", s)
+	}
+}
+
+func TestNsfPlayer(t *testing.T) {
+	rom, err := LoadNsfData(testNsf())
+	if err != nil {
+		t.Fatalf("Failed to load NSF: %v", err)
+	}
+	if rom.MD5 != md5.Sum(testNsf()) {
+		t.Fatalf("MD5 of the NSF file not computed")
+	}
+	if rom.Nsf.Title != "Test tune" || rom.Nsf.StartSong != 1 {
+		t.Fatalf("Unexpected NSF header %+v", rom.Nsf)
+	}
+
+	cpu := InitCPU(rom.Load())
+	player := NewNsfPlayer(cpu, rom.Nsf)
+
+	// Run for a bit more than two play periods
+	for cycles := 0; cycles < 2*CPUClockNTSC/60+1000; {
+		cycles += int(player.Step().Cycles)
+	}
+
+	if v := cpu.mem.Read(0x0200); v != 1 {
+		t.Fatalf("INIT got song %d, expected 1", v)
+	}
+	if v := cpu.mem.Read(0x0201); v < 2 {
+		t.Fatalf("PLAY called %d times, expected at least 2", v)
+	}
+
+	player.NextTrack()
+	if player.Track() != 3 {
+		t.Fatalf("Unexpected track %d after NextTrack", player.Track())
+	}
+}
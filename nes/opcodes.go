@@ -412,7 +412,7 @@ func brk(c *CPU, m byte) {
 	pcLow := c.mem.Read(0xFFFE)
 	pcHigh := c.mem.Read(0xFFFF)
 	// jump to the address
-	c.PC = uint16((pcHigh << 8) | pcLow)
+	c.PC = uint16(pcHigh)<<8 | uint16(pcLow)
 }
 
 func clc(c *CPU, m byte) {
@@ -517,9 +517,9 @@ func jsr(c *CPU, m byte) {
 	c.push(byte(addr >> 8))
 	c.push(byte(addr & 0xFF))
 
-	pcl := c.mem.Read(c.PC)
-	pch := c.mem.Read(c.PC + 1)
-	c.PC = uint16(pch<<8) | uint16(pcl)
+	pcl := c.mem.Read(c.PC + 1)
+	pch := c.mem.Read(c.PC + 2)
+	c.PC = uint16(pch)<<8 | uint16(pcl)
 }
 
 func ldx(c *CPU, m byte) {
@@ -665,14 +665,14 @@ func rti(c *CPU, m byte) {
 	// Pull Program Counter from stack
 	pcl := c.pop()
 	pch := c.pop()
-	c.PC = uint16(pch<<8 | pcl)
+	c.PC = uint16(pch)<<8 | uint16(pcl)
 }
 
 func rts(c *CPU, m byte) {
 	// Pull Program Counter from stack
 	pcl := c.pop()
 	pch := c.pop()
-	c.PC = uint16((pch<<8)|pcl) + 1
+	c.PC = (uint16(pch)<<8 | uint16(pcl)) + 1
 }
 
 func sbc(c *CPU, m byte) {
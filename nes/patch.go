@@ -0,0 +1,274 @@
+package nes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+const (
+	ipsEOF = 0x454F46
+	// UPS and BPS end with source, target and patch CRC32
+	beatFooterLen = 12
+)
+
+// PatchExtensions lists file extensions of supported patch formats
+var PatchExtensions = []string{".ips", ".ups", ".bps"}
+
+// ApplyPatch applies IPS, UPS or BPS patch to raw ROM data
+// and returns patched copy
+func ApplyPatch(romData []byte, patchData []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(patchData, []byte("PATCH")):
+		return applyIps(romData, patchData)
+	case bytes.HasPrefix(patchData, []byte("UPS1")):
+		return applyUps(romData, patchData)
+	case bytes.HasPrefix(patchData, []byte("BPS1")):
+		return applyBps(romData, patchData)
+	}
+	return nil, errors.New("unknown patch format")
+}
+
+// IPS consists of records: 3 bytes offset, 2 bytes size, data.
+// Zero size means RLE record: 2 bytes count, 1 byte value
+func applyIps(romData []byte, patch []byte) ([]byte, error) {
+	out := append([]byte(nil), romData...)
+	errTruncated := errors.New("IPS patch is truncated")
+
+	p := 5
+	for {
+		if p+3 > len(patch) {
+			return nil, errTruncated
+		}
+		offset := int(patch[p])<<16 | int(patch[p+1])<<8 | int(patch[p+2])
+		p += 3
+		if offset == ipsEOF {
+			break
+		}
+		if p+2 > len(patch) {
+			return nil, errTruncated
+		}
+		size := int(binary.BigEndian.Uint16(patch[p:]))
+		p += 2
+
+		var data []byte
+		if size == 0 {
+			if p+3 > len(patch) {
+				return nil, errTruncated
+			}
+			count := int(binary.BigEndian.Uint16(patch[p:]))
+			data = bytes.Repeat(patch[p+2:p+3], count)
+			p += 3
+		} else {
+			if p+size > len(patch) {
+				return nil, errTruncated
+			}
+			data = patch[p : p+size]
+			p += size
+		}
+
+		if end := offset + len(data); end > len(out) {
+			out = append(out, make([]byte, end-len(out))...)
+		}
+		copy(out[offset:], data)
+	}
+
+	// Optional truncation extension
+	if p+3 <= len(patch) {
+		size := int(patch[p])<<16 | int(patch[p+1])<<8 | int(patch[p+2])
+		if size < len(out) {
+			out = out[:size]
+		}
+	}
+	return out, nil
+}
+
+// beatReader reads variable length numbers used by UPS and BPS
+type beatReader struct {
+	data []byte
+	pos  int
+	end  int
+	err  error
+}
+
+func (r *beatReader) readByte() byte {
+	if r.pos >= r.end {
+		r.err = errors.New("patch is truncated")
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *beatReader) number() int {
+	value, shift := 0, 1
+	for r.err == nil {
+		x := r.readByte()
+		value += int(x&0x7F) * shift
+		if x&0x80 != 0 {
+			break
+		}
+		shift <<= 7
+		value += shift
+	}
+	return value
+}
+
+// Verifies patch checksum and returns source and target checksums
+func beatChecksums(format string, patch []byte) (uint32, uint32, error) {
+	if len(patch) < 4+beatFooterLen {
+		return 0, 0, fmt.Errorf("%s patch is truncated", format)
+	}
+	footer := patch[len(patch)-beatFooterLen:]
+	if crc := crc32.ChecksumIEEE(patch[:len(patch)-4]); crc != binary.LittleEndian.Uint32(footer[8:]) {
+		return 0, 0, fmt.Errorf("%s patch is corrupted: checksum %08X, expected %08X",
+			format, crc, binary.LittleEndian.Uint32(footer[8:]))
+	}
+	return binary.LittleEndian.Uint32(footer), binary.LittleEndian.Uint32(footer[4:]), nil
+}
+
+func verifySource(format string, romData []byte, expected uint32) error {
+	if crc := crc32.ChecksumIEEE(romData); crc != expected {
+		return fmt.Errorf("%s patch does not match the ROM: ROM checksum %08X, patch expects %08X",
+			format, crc, expected)
+	}
+	return nil
+}
+
+func verifyTarget(format string, out []byte, expected uint32) error {
+	if crc := crc32.ChecksumIEEE(out); crc != expected {
+		return fmt.Errorf("%s patch produced wrong result: checksum %08X, expected %08X",
+			format, crc, expected)
+	}
+	return nil
+}
+
+// UPS stores XOR differences: relative offset, bytes terminated by 0
+func applyUps(romData []byte, patch []byte) ([]byte, error) {
+	sourceCrc, targetCrc, err := beatChecksums("UPS", patch)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySource("UPS", romData, sourceCrc); err != nil {
+		return nil, err
+	}
+
+	r := &beatReader{data: patch, pos: 4, end: len(patch) - beatFooterLen}
+	r.number() // source size
+	targetSize := r.number()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	out := make([]byte, targetSize)
+	copy(out, romData)
+	pos := 0
+	for r.err == nil && r.pos < r.end {
+		pos += r.number()
+		for r.err == nil {
+			x := r.readByte()
+			pos++
+			if x == 0 {
+				break
+			}
+			if pos-1 < len(out) {
+				out[pos-1] ^= x
+			}
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if err := verifyTarget("UPS", out, targetCrc); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// BPS commands
+const (
+	bpsSourceRead = iota
+	bpsTargetRead
+	bpsSourceCopy
+	bpsTargetCopy
+)
+
+func applyBps(romData []byte, patch []byte) ([]byte, error) {
+	sourceCrc, targetCrc, err := beatChecksums("BPS", patch)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySource("BPS", romData, sourceCrc); err != nil {
+		return nil, err
+	}
+
+	r := &beatReader{data: patch, pos: 4, end: len(patch) - beatFooterLen}
+	r.number() // source size
+	targetSize := r.number()
+	r.pos += r.number() // skip metadata
+	if r.err != nil || r.pos > r.end {
+		return nil, errors.New("BPS patch is truncated")
+	}
+
+	out := make([]byte, 0, targetSize)
+	errRange := errors.New("BPS patch refers outside of the data")
+	var sourceRel, targetRel int
+	for r.err == nil && r.pos < r.end {
+		data := r.number()
+		length := data>>2 + 1
+
+		switch data & 3 {
+		case bpsSourceRead:
+			if len(out)+length > len(romData) {
+				return nil, errRange
+			}
+			out = append(out, romData[len(out):len(out)+length]...)
+		case bpsTargetRead:
+			if r.pos+length > r.end {
+				return nil, errRange
+			}
+			out = append(out, patch[r.pos:r.pos+length]...)
+			r.pos += length
+		case bpsSourceCopy:
+			sourceRel += bpsOffset(r.number())
+			if sourceRel < 0 || sourceRel+length > len(romData) {
+				return nil, errRange
+			}
+			out = append(out, romData[sourceRel:sourceRel+length]...)
+			sourceRel += length
+		case bpsTargetCopy:
+			targetRel += bpsOffset(r.number())
+			if targetRel < 0 || targetRel >= len(out) {
+				return nil, errRange
+			}
+			// Copied region may overlap with the output being written
+			for i := 0; i < length; i++ {
+				out = append(out, out[targetRel])
+				targetRel++
+			}
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(out) != targetSize {
+		return nil, fmt.Errorf("BPS patch produced %d bytes, expected %d", len(out), targetSize)
+	}
+
+	if err := verifyTarget("BPS", out, targetCrc); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Relative offsets store sign in the lowest bit
+func bpsOffset(data int) int {
+	if data&1 != 0 {
+		return -(data >> 1)
+	}
+	return data >> 1
+}
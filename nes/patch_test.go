@@ -0,0 +1,94 @@
+package nes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"strings"
+	"testing"
+)
+
+func beatNumber(value int) []byte {
+	var out []byte
+	for {
+		x := byte(value & 0x7F)
+		value >>= 7
+		if value == 0 {
+			return append(out, x|0x80)
+		}
+		out = append(out, x)
+		value--
+	}
+}
+
+func beatPatch(magic string, source []byte, target []byte, body []byte) []byte {
+	patch := append([]byte(magic), body...)
+	footer := make([]byte, 8)
+	binary.LittleEndian.PutUint32(footer, crc32.ChecksumIEEE(source))
+	binary.LittleEndian.PutUint32(footer[4:], crc32.ChecksumIEEE(target))
+	patch = append(patch, footer...)
+	return binary.LittleEndian.AppendUint32(patch, crc32.ChecksumIEEE(patch))
+}
+
+func TestApplyIps(t *testing.T) {
+	rom := []byte{0, 1, 2, 3, 4, 5}
+	patch := []byte("PATCH")
+	patch = append(patch, 0, 0, 1, 0, 2, 0xAA, 0xBB) // 2 bytes at 1
+	patch = append(patch, 0, 0, 6, 0, 0, 0, 2, 0xCC) // RLE past the end
+	patch = append(patch, 'E', 'O', 'F')
+
+	out, err := ApplyPatch(rom, patch)
+	if err != nil {
+		t.Fatalf("Failed to apply IPS: %v", err)
+	}
+	if expected := []byte{0, 0xAA, 0xBB, 3, 4, 5, 0xCC, 0xCC}; !bytes.Equal(out, expected) {
+		t.Fatalf("Unexpected IPS result %x", out)
+	}
+}
+
+func TestApplyUps(t *testing.T) {
+	source := []byte{1, 2, 3, 4}
+	target := []byte{1, 7, 3, 4}
+
+	body := append(beatNumber(len(source)), beatNumber(len(target))...)
+	body = append(body, beatNumber(1)...)
+	body = append(body, 2^7, 0)
+	patch := beatPatch("UPS1", source, target, body)
+
+	out, err := ApplyPatch(source, patch)
+	if err != nil {
+		t.Fatalf("Failed to apply UPS: %v", err)
+	}
+	if !bytes.Equal(out, target) {
+		t.Fatalf("Unexpected UPS result %x", out)
+	}
+
+	_, err = ApplyPatch([]byte{9, 9, 9, 9}, patch)
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("Checksum mismatch not reported: %v", err)
+	}
+}
+
+func TestApplyBps(t *testing.T) {
+	source := []byte{1, 2, 3, 4}
+	target := []byte{1, 2, 9, 9, 9, 1, 2}
+
+	body := append(beatNumber(len(source)), beatNumber(len(target))...)
+	body = append(body, beatNumber(0)...)                      // no metadata
+	body = append(body, beatNumber((2-1)<<2|bpsSourceRead)...) // 1, 2
+	body = append(body, beatNumber((1-1)<<2|bpsTargetRead)...) // 9
+	body = append(body, 9)
+	body = append(body, beatNumber((2-1)<<2|bpsTargetCopy)...) // 9, 9 (overlapping)
+	body = append(body, beatNumber(2<<1)...)
+	body = append(body, beatNumber((2-1)<<2|bpsSourceCopy)...) // 1, 2
+	body = append(body, beatNumber(0)...)
+	patch := beatPatch("BPS1", source, target, body)
+
+	out, err := ApplyPatch(source, patch)
+	if err != nil {
+		t.Fatalf("Failed to apply BPS: %v", err)
+	}
+	if !bytes.Equal(out, target) {
+		t.Fatalf("Unexpected BPS result %x", out)
+	}
+}
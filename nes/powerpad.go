@@ -0,0 +1,99 @@
+package nes
+
+// PowerPadButtons is the number of buttons on the mat
+const PowerPadButtons = 12
+
+// Order of buttons returned by NES Power Pad in D3 and D4
+var (
+	powerPadD3 = [8]int{1, 0, 4, 8, 5, 9, 10, 6}
+	powerPadD4 = [4]int{3, 2, 11, 7}
+)
+
+// PowerPad is the Power Pad floor mat, known as Family Trainer on Famicom.
+// Buttons 0-11 are numbered as printed on side B (1-12), side A shares
+// the wiring. NES version plugs into controller port 2 and shifts buttons
+// out through D3 and D4. Family Trainer uses expansion port and selects
+// rows of 4 buttons with $4016 writes, pressed buttons read as 0
+type PowerPad struct {
+	buttons [PowerPadButtons]bool
+	shiftD3 byte
+	shiftD4 byte
+	strobe  bool
+	// Rows deselected by the last write (active low)
+	rows byte
+}
+
+// NewPowerPad creates mat with nobody standing on it
+func NewPowerPad() *PowerPad {
+	return &PowerPad{rows: 0x07}
+}
+
+// SetButton presses or releases mat button 0-11
+func (p *PowerPad) SetButton(button int, pressed bool) {
+	if button >= 0 && button < PowerPadButtons {
+		p.buttons[button] = pressed
+	}
+}
+
+func (p *PowerPad) state(s *stateBuffer) {
+	stateNum(s, &p.shiftD3)
+	stateNum(s, &p.shiftD4)
+	s.bool(&p.strobe)
+	stateNum(s, &p.rows)
+}
+
+func (p *PowerPad) latch() {
+	p.shiftD3, p.shiftD4 = 0, 0xF0
+	for i, b := range powerPadD3 {
+		if p.buttons[b] {
+			p.shiftD3 |= 1 << i
+		}
+	}
+	for i, b := range powerPadD4 {
+		if p.buttons[b] {
+			p.shiftD4 |= 1 << i
+		}
+	}
+}
+
+// Write latches buttons while strobe is high and selects
+// Family Trainer rows
+func (p *PowerPad) Write(val byte) {
+	p.strobe = val&1 != 0
+	p.rows = val & 0x07
+	if p.strobe {
+		p.latch()
+	}
+}
+
+// Read shifts out next buttons in D3 and D4, 1s follow the last ones
+func (p *PowerPad) Read() byte {
+	if p.strobe {
+		p.latch()
+	}
+	val := (p.shiftD3&1)<<3 | (p.shiftD4&1)<<4
+	if !p.strobe {
+		p.shiftD3 = p.shiftD3>>1 | 0x80
+		p.shiftD4 = p.shiftD4>>1 | 0x80
+	}
+	return val
+}
+
+// ReadExpansion returns buttons of selected rows in $4017 D1-D4
+func (p *PowerPad) ReadExpansion(port int) byte {
+	if port == 0 {
+		return 0
+	}
+	var pressed byte
+	for row := 0; row < 3; row++ {
+		if p.rows&(1<<row) != 0 {
+			continue
+		}
+		for i := 0; i < 4; i++ {
+			if p.buttons[row*4+i] {
+				pressed |= 1 << i
+			}
+		}
+	}
+	return ^pressed << 1 & 0x1E
+}
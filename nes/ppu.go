@@ -1,5 +1,10 @@
 package nes
 
+import (
+	"image"
+	"image/color"
+)
+
 const (
 	// PPU register addresses
 	PPUController uint16 = 0x2000
@@ -13,61 +18,483 @@ const (
 	OAMDMA        uint16 = 0x4014
 
 	// PPU Status register flags
-	PPUStatusVBlank byte = 0x80
+	PPUStatusVBlank         byte = 0x80
+	PPUStatusSpriteZeroHit  byte = 0x40
+	PPUStatusSpriteOverflow byte = 0x20
+
+	// Frame dimensions
+	ScreenWidth  = 256
+	ScreenHeight = 240
+
+	dotsPerLine     = 341
+	maxLineSprites  = 8
+	oamDMAStall     = 513
+	paletteAddr     = 0x3F00
+	nametableAddr   = 0x2000
+	nametableSize   = 0x0400
+	attributeOffset = 0x03C0
 )
 
 type PPU struct {
-	cpu      *CPU
+	mem      *Memory
+	profile  *regionProfile
 	cycles   uint16
 	scanline uint16
 	nmi      bool
+
+	ctrl    byte
+	mask    byte
+	status  byte
+	oamAddr byte
+
+	// Current and temporary VRAM address, fine X scroll and write toggle
+	v, t uint16
+	x    byte
+	w    bool
+
+	// $2007 read buffer and the value last driven on the PPU data bus
+	readBuffer byte
+	openBus    byte
+
+	// Nametables (4 when cartridge provides extra memory), palettes, sprites
+	vram    [4 * nametableSize]byte
+	palette [32]byte
+	oam     [256]byte
+
+	frame      [ScreenWidth * ScreenHeight]byte
+	frameCount uint64
+	image      *image.RGBA
+	frameHook  func()
+}
+
+// NewPPU creates PPU and connects its registers to the bus
+func NewPPU(mem *Memory) *PPU {
+	ppu := &PPU{mem: mem, profile: RegionNTSC.profile(),
+		image: image.NewRGBA(image.Rect(0, 0, ScreenWidth, ScreenHeight))}
+	mem.ppu = ppu
+	return ppu
+}
+
+// powerOn clears PPU memory and registers, frame hook stays set
+func (ppu *PPU) powerOn() {
+	*ppu = PPU{mem: ppu.mem, profile: ppu.profile, image: ppu.image, frameHook: ppu.frameHook}
 }
 
-func InitPPU(c *CPU) *PPU {
-	return &PPU{cpu: c}
+func (ppu *PPU) state(s *stateBuffer) {
+	stateNum(s, &ppu.cycles)
+	stateNum(s, &ppu.scanline)
+	s.bool(&ppu.nmi)
+	stateNum(s, &ppu.ctrl)
+	stateNum(s, &ppu.mask)
+	stateNum(s, &ppu.status)
+	stateNum(s, &ppu.oamAddr)
+	stateNum(s, &ppu.v)
+	stateNum(s, &ppu.t)
+	stateNum(s, &ppu.x)
+	s.bool(&ppu.w)
+	stateNum(s, &ppu.readBuffer)
+	stateNum(s, &ppu.openBus)
+	s.bytes(ppu.vram[:])
+	s.bytes(ppu.palette[:])
+	s.bytes(ppu.oam[:])
+	// Picture is kept for light guns and the frontend
+	s.bytes(ppu.frame[:])
+	stateNum(s, &ppu.frameCount)
 }
 
 func (ppu *PPU) Reset() {
 	ppu.cycles = 0
 	ppu.nmi = false
 	ppu.scanline = 0
+	ppu.ctrl, ppu.mask = 0, 0
+	ppu.w = false
+	ppu.readBuffer = 0
 }
 
+// Step runs PPU for the given number of PPU dots
 func (ppu *PPU) Step(cycles uint16) {
-	ppu.cycles += cycles
-	if ppu.cycles >= 341 {
-		ppu.cycles -= 341
+	for i := uint16(0); i < cycles; i++ {
+		ppu.tick()
+	}
+}
+
+func (ppu *PPU) rendering() bool {
+	return ppu.mask&0x18 != 0
+}
+
+func (ppu *PPU) tick() {
+	line, dot := ppu.scanline, ppu.cycles
+	preRenderLine := uint16(ppu.profile.scanlines - 1)
+
+	if line < ScreenHeight && dot == 256 {
+		ppu.renderLine(int(line))
+	}
+	if ppu.rendering() && (line < ScreenHeight || line == preRenderLine) {
+		switch {
+		case dot == 256:
+			ppu.incrementY()
+		case dot == 257:
+			// Copy horizontal scroll from t
+			ppu.v = ppu.v&^0x041F | ppu.t&0x041F
+		case line == preRenderLine && dot >= 280 && dot <= 304:
+			ppu.v = ppu.v&^0x7BE0 | ppu.t&0x7BE0
+		}
+	}
+
+	if line == uint16(ppu.profile.vblankLine) && dot == 1 {
+		if ppu.frameHook != nil {
+			ppu.frameHook()
+		}
+		ppu.status |= PPUStatusVBlank
+		if ppu.ctrl&0x80 != 0 {
+			ppu.nmi = true
+		}
+	} else if line == preRenderLine && dot == 1 {
+		ppu.status &^= PPUStatusVBlank | PPUStatusSpriteZeroHit | PPUStatusSpriteOverflow
+	}
+
+	ppu.cycles++
+	// Last dot of pre-render line is skipped on odd frames
+	if line == preRenderLine && ppu.cycles == dotsPerLine-1 && ppu.frameCount&1 != 0 &&
+		ppu.rendering() && ppu.profile.oddFrameSkip {
+		ppu.cycles++
+	}
+	if ppu.cycles >= dotsPerLine {
+		ppu.cycles = 0
 		ppu.scanline++
+		if ppu.scanline > preRenderLine {
+			ppu.scanline = 0
+			ppu.frameCount++
+		}
+	}
+}
+
+// Moves v to the next pixel row, wrapping into the next nametable
+func (ppu *PPU) incrementY() {
+	if ppu.v&0x7000 != 0x7000 {
+		ppu.v += 0x1000
+		return
+	}
+	ppu.v &^= 0x7000
+	y := (ppu.v & 0x03E0) >> 5
+	switch y {
+	case 29:
+		y = 0
+		ppu.v ^= 0x0800
+	case 31:
+		y = 0
+	default:
+		y++
+	}
+	ppu.v = ppu.v&^0x03E0 | y<<5
+}
+
+// renderLine draws scanline at once using scroll position at its start
+func (ppu *PPU) renderLine(y int) {
+	line := ppu.frame[y*ScreenWidth : (y+1)*ScreenWidth]
+	if !ppu.rendering() {
+		// Backdrop color, or the palette entry v points to
+		backdrop := ppu.palette[0]
+		if ppu.v&0x3F00 == paletteAddr {
+			backdrop = ppu.readPalette(ppu.v)
+		}
+		for i := range line {
+			line[i] = backdrop
+		}
+		return
+	}
+
+	var bg [ScreenWidth]byte
+	if ppu.mask&0x08 != 0 {
+		ppu.renderBackground(&bg)
+	}
+	var sprites [ScreenWidth]byte
+	var behind, zero [ScreenWidth]bool
+	if ppu.mask&0x10 != 0 {
+		ppu.renderSprites(y, &sprites, &behind, &zero)
+	}
+
+	for x := range line {
+		b, s := bg[x], sprites[x]
+		if x < 8 {
+			if ppu.mask&0x02 == 0 {
+				b = 0
+			}
+			if ppu.mask&0x04 == 0 {
+				s = 0
+			}
+		}
+		if zero[x] && b&3 != 0 && s&3 != 0 && x != 255 {
+			ppu.status |= PPUStatusSpriteZeroHit
+		}
+
+		var c byte
+		switch {
+		case s&3 != 0 && (!behind[x] || b&3 == 0):
+			c = ppu.palette[0x10|s]
+		case b&3 != 0:
+			c = ppu.palette[b]
+		default:
+			c = ppu.palette[0]
+		}
+		if ppu.mask&0x01 != 0 {
+			c &= 0x30
+		}
+		line[x] = c & 0x3F
+	}
+}
+
+// Fills palette entries (palette * 4 + color) of background pixels
+func (ppu *PPU) renderBackground(bg *[ScreenWidth]byte) {
+	v := ppu.v
+	fineY := (v >> 12) & 7
+	table := uint16(ppu.ctrl&0x10) << 8
+	for tile := 0; tile < 33; tile++ {
+		index := ppu.readVram(nametableAddr | v&0x0FFF)
+		attr := ppu.readVram(nametableAddr | attributeOffset | v&0x0C00 | (v>>4)&0x38 | (v>>2)&0x07)
+		pal := (attr >> ((v >> 4 & 4) | v&2)) & 3
+
+		addr := table + uint16(index)*16 + fineY
+		lo, hi := ppu.readVram(addr), ppu.readVram(addr+8)
+		for bit := 0; bit < 8; bit++ {
+			x := tile*8 + bit - int(ppu.x)
+			if x < 0 || x >= ScreenWidth {
+				continue
+			}
+			c := (lo>>(7-bit))&1 | ((hi>>(7-bit))&1)<<1
+			if c != 0 {
+				bg[x] = pal<<2 | c
+			}
+		}
+
+		// Next tile, wrapping into the next nametable
+		if v&0x1F == 31 {
+			v = v&^0x1F ^ 0x0400
+		} else {
+			v++
+		}
+	}
+}
+
+// Fills palette entries of sprite pixels, first opaque sprite wins
+func (ppu *PPU) renderSprites(y int, sprites *[ScreenWidth]byte, behind, zero *[ScreenWidth]bool) {
+	height := 8
+	if ppu.ctrl&0x20 != 0 {
+		height = 16
+	}
+
+	count := 0
+	for i := 0; i < 64; i++ {
+		s := ppu.oam[i*4 : i*4+4]
+		row := y - int(s[0]) - 1
+		if row < 0 || row >= height {
+			continue
+		}
+		if count == maxLineSprites {
+			ppu.status |= PPUStatusSpriteOverflow
+			break
+		}
+		count++
+
+		attr := s[2]
+		if attr&0x80 != 0 {
+			row = height - 1 - row
+		}
+		tile := uint16(s[1])
+		var addr uint16
+		if height == 16 {
+			addr = (tile&1)<<12 | (tile&0xFE)*16
+			if row >= 8 {
+				addr += 16
+				row -= 8
+			}
+		} else {
+			addr = uint16(ppu.ctrl&0x08)<<9 | tile*16
+		}
+		addr += uint16(row)
+		lo, hi := ppu.readVram(addr), ppu.readVram(addr+8)
+
+		for bit := 0; bit < 8; bit++ {
+			x := int(s[3]) + bit
+			if x >= ScreenWidth || sprites[x] != 0 {
+				continue
+			}
+			shift := 7 - bit
+			if attr&0x40 != 0 {
+				shift = bit
+			}
+			c := (lo>>shift)&1 | ((hi>>shift)&1)<<1
+			if c == 0 {
+				continue
+			}
+			sprites[x] = (attr&3)<<2 | c
+			behind[x] = attr&0x20 != 0
+			zero[x] = i == 0
+		}
 	}
+}
 
-	if 0 <= ppu.scanline && ppu.scanline <= 239 {
+func (ppu *PPU) readVram(addr uint16) byte {
+	addr &= 0x3FFF
+	switch {
+	case addr < nametableAddr:
+		return ppu.mem.readChr(addr)
+	case addr < paletteAddr:
+		if offset, ok := ppu.mem.nametableOffset(addr); ok {
+			return ppu.vram[offset]
+		}
+		return ppu.mem.mapper.(NametableMapper).ReadNametable(addr)
+	}
+	return ppu.readPalette(addr)
+}
 
-	} else if ppu.scanline == 241 && ppu.cycles == 1 {
-		// VBlank
-		println("VBLANK!!!")
-		ppu.setStatus(PPUStatusVBlank)
-		ppu.nmi = true
+func (ppu *PPU) writeVram(addr uint16, val byte) {
+	addr &= 0x3FFF
+	switch {
+	case addr < nametableAddr:
+		ppu.mem.writeChr(addr, val)
+	case addr < paletteAddr:
+		if offset, ok := ppu.mem.nametableOffset(addr); ok {
+			ppu.vram[offset] = val
+		} else {
+			ppu.mem.mapper.(NametableMapper).WriteNametable(addr, val)
+		}
+	default:
+		ppu.palette[paletteIndex(addr)] = val & 0x3F
+	}
+}
 
-		// FIXME:
-		ppu.cpu.nmiInterrupt()
-		// TODO
+func (ppu *PPU) readPalette(addr uint16) byte {
+	return ppu.palette[paletteIndex(addr)]
+}
 
-	} else if ppu.scanline == 261 && ppu.cycles == 1 {
-		// VBlank off
-		println("vblank off")
-		ppu.clearStatus(PPUStatusVBlank)
-		ppu.nmi = false
-		ppu.scanline = 0
+// Backdrop entries of sprite palettes mirror background ones
+func paletteIndex(addr uint16) uint16 {
+	i := addr & 0x1F
+	if i >= 0x10 && i&3 == 0 {
+		i -= 0x10
 	}
+	return i
+}
 
+// readRegister reads one of the 8 PPU registers
+func (ppu *PPU) readRegister(reg uint16) byte {
+	switch reg {
+	case 2:
+		ppu.openBus = ppu.status&0xE0 | ppu.openBus&0x1F
+		ppu.status &^= PPUStatusVBlank
+		ppu.w = false
+	case 4:
+		ppu.openBus = ppu.oam[ppu.oamAddr]
+	case 7:
+		if ppu.v&0x3FFF < paletteAddr {
+			ppu.openBus = ppu.readBuffer
+			ppu.readBuffer = ppu.readVram(ppu.v)
+		} else {
+			// Palette is read directly, buffer gets the nametable underneath
+			ppu.openBus = ppu.openBus&0xC0 | ppu.readPalette(ppu.v)
+			ppu.readBuffer = ppu.readVram(ppu.v - 0x1000)
+		}
+		ppu.incrementAddr()
+	}
+	return ppu.openBus
 }
 
-func (ppu *PPU) setStatus(flag byte) {
-	status := ppu.cpu.mem.Read(PPUStatus)
-	ppu.cpu.mem.Write(PPUStatus, status|flag)
+// writeRegister writes one of the 8 PPU registers
+func (ppu *PPU) writeRegister(reg uint16, val byte) {
+	ppu.openBus = val
+	switch reg {
+	case 0:
+		// Enabling NMI during vblank fires it immediately
+		if ppu.ctrl&0x80 == 0 && val&0x80 != 0 && ppu.status&PPUStatusVBlank != 0 {
+			ppu.nmi = true
+		}
+		ppu.ctrl = val
+		ppu.t = ppu.t&^0x0C00 | uint16(val&0x03)<<10
+	case 1:
+		ppu.mask = val
+	case 3:
+		ppu.oamAddr = val
+	case 4:
+		ppu.oam[ppu.oamAddr] = val
+		ppu.oamAddr++
+	case 5:
+		if !ppu.w {
+			ppu.t = ppu.t&^0x001F | uint16(val)>>3
+			ppu.x = val & 0x07
+		} else {
+			ppu.t = ppu.t&^0x73E0 | uint16(val&0x07)<<12 | uint16(val&0xF8)<<2
+		}
+		ppu.w = !ppu.w
+	case 6:
+		if !ppu.w {
+			ppu.t = ppu.t&0x00FF | uint16(val&0x3F)<<8
+		} else {
+			ppu.t = ppu.t&0xFF00 | uint16(val)
+			ppu.v = ppu.t
+		}
+		ppu.w = !ppu.w
+	case 7:
+		ppu.writeVram(ppu.v, val)
+		ppu.incrementAddr()
+	}
 }
 
-func (ppu *PPU) clearStatus(flag byte) {
-	status := ppu.cpu.mem.Read(PPUStatus)
-	ppu.cpu.mem.Write(PPUStatus, status & ^flag)
+func (ppu *PPU) incrementAddr() {
+	if ppu.ctrl&0x04 != 0 {
+		ppu.v += 32
+	} else {
+		ppu.v++
+	}
+	ppu.v &= 0x7FFF
+}
+
+// writeOAM stores a byte transferred by OAM DMA
+func (ppu *PPU) writeOAM(val byte) {
+	ppu.oam[ppu.oamAddr] = val
+	ppu.oamAddr++
+}
+
+// takeNMI returns pending NMI and clears it
+func (ppu *PPU) takeNMI() bool {
+	nmi := ppu.nmi
+	ppu.nmi = false
+	return nmi
+}
+
+// SetFrameHook sets function called once per frame at the start of vblank,
+// when the picture is complete and the game is yet to poll input
+func (ppu *PPU) SetFrameHook(hook func()) {
+	ppu.frameHook = hook
+}
+
+// Scanline returns current scanline, 0-239 are visible, the last one
+// (261 on NTSC, 311 on PAL and Dendy) is pre-render
+func (ppu *PPU) Scanline() int {
+	return int(ppu.scanline)
+}
+
+// Dot returns current dot of the scanline
+func (ppu *PPU) Dot() int {
+	return int(ppu.cycles)
+}
+
+// FrameCount returns number of frames completed since power up
+func (ppu *PPU) FrameCount() uint64 {
+	return ppu.frameCount
+}
+
+// Pixel returns color of the framebuffer pixel
+func (ppu *PPU) Pixel(x, y int) color.RGBA {
+	return Palette[ppu.frame[y*ScreenWidth+x]]
+}
+
+// Image returns the framebuffer as an image. The image is reused
+// and changes on the next call
+func (ppu *PPU) Image() *image.RGBA {
+	for i, c := range ppu.frame {
+		rgb := Palette[c]
+		copy(ppu.image.Pix[i*4:], []byte{rgb.R, rgb.G, rgb.B, rgb.A})
+	}
+	return ppu.image
 }
@@ -0,0 +1,77 @@
+package nes
+
+import (
+	"testing"
+)
+
+func newTestPPU() (*Memory, *PPU) {
+	m := &Memory{mapper: &NROM128{}, chr: make([]byte, 0x2000), chrRAM: true}
+	m.apu = NewAPU(m)
+	ppu := NewPPU(m)
+	return m, ppu
+}
+
+func TestPPUVBlank(t *testing.T) {
+	m, ppu := newTestPPU()
+	m.Write(PPUController, 0x80)
+
+	for line := 0; line < ppu.profile.vblankLine; line++ {
+		ppu.Step(dotsPerLine)
+	}
+	ppu.Step(1)
+	if m.nmi() {
+		t.Fatalf("NMI raised before vblank")
+	}
+	ppu.Step(1)
+	if !m.nmi() || m.nmi() {
+		t.Fatalf("NMI not raised once at vblank")
+	}
+
+	// Status read returns and clears the flag
+	if m.Read(PPUStatus)&PPUStatusVBlank == 0 || m.Read(PPUStatus)&PPUStatusVBlank != 0 {
+		t.Fatalf("Status read did not acknowledge vblank")
+	}
+}
+
+func TestPPUDataBuffer(t *testing.T) {
+	m, _ := newTestPPU()
+	m.Write(PPUAddress, 0x21)
+	m.Write(PPUAddress, 0x00)
+	m.Write(PPUData, 0x12)
+	m.Write(PPUData, 0x34)
+
+	m.Write(PPUAddress, 0x21)
+	m.Write(PPUAddress, 0x00)
+	// First read returns stale buffer
+	m.Read(PPUData)
+	if v := m.Read(PPUData); v != 0x12 {
+		t.Fatalf("Unexpected buffered read %02x", v)
+	}
+
+	// Palette is read directly, sprite backdrop mirrors background one
+	m.Write(PPUAddress, 0x3F)
+	m.Write(PPUAddress, 0x10)
+	m.Write(PPUData, 0x2A)
+	m.Write(PPUAddress, 0x3F)
+	m.Write(PPUAddress, 0x00)
+	if v := m.Read(PPUData); v != 0x2A {
+		t.Fatalf("Unexpected palette read %02x", v)
+	}
+}
+
+func TestOAMDMA(t *testing.T) {
+	m, ppu := newTestPPU()
+	for i := 0; i < 256; i++ {
+		m.ram[0x0200+i] = byte(i)
+	}
+	m.Write(OAMDMA, 0x02)
+	if ppu.oam[0x10] != 0x10 || ppu.oam[0xFF] != 0xFF {
+		t.Fatalf("Sprite memory not filled by DMA")
+	}
+	if stall := m.dmaStall(); stall != oamDMAStall && stall != oamDMAStall+1 {
+		t.Fatalf("Unexpected DMA stall %d", stall)
+	}
+	if stall := m.dmaStall(); stall != 0 {
+		t.Fatalf("DMA stall reported twice")
+	}
+}
@@ -0,0 +1,132 @@
+package nes
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Region is the TV system the console is built for
+type Region byte
+
+const (
+	RegionNTSC Region = iota
+	RegionPAL
+	RegionDendy
+)
+
+// regionProfile describes clocks and timing of a console region
+type regionProfile struct {
+	name string
+	// Master clock in Hz and its dividers for CPU and PPU
+	masterClock int
+	cpuDivider  uint64
+	ppuDivider  uint64
+
+	scanlines int
+	// VBlank flag and NMI are raised at dot 1 of this line
+	vblankLine int
+	// Pre-render line is one dot shorter on odd frames with rendering on
+	oddFrameSkip bool
+
+	frameSteps   *frameSteps
+	noisePeriods *[16]uint16
+	dmcRates     *[16]uint16
+}
+
+var regionProfiles = [...]regionProfile{
+	RegionNTSC: {
+		name:         "NTSC",
+		masterClock:  21477272,
+		cpuDivider:   12,
+		ppuDivider:   4,
+		scanlines:    262,
+		vblankLine:   241,
+		oddFrameSkip: true,
+		frameSteps:   &ntscFrameSteps,
+		noisePeriods: &noisePeriodTable,
+		dmcRates:     &dmcRateTable,
+	},
+	RegionPAL: {
+		name:         "PAL",
+		masterClock:  26601712,
+		cpuDivider:   16,
+		ppuDivider:   5,
+		scanlines:    312,
+		vblankLine:   241,
+		frameSteps:   &palFrameSteps,
+		noisePeriods: &noisePeriodTablePAL,
+		dmcRates:     &dmcRateTablePAL,
+	},
+	// Dendy runs PAL clocks with NTSC APU, 51 extra lines
+	// go before vblank to keep NTSC game timing
+	RegionDendy: {
+		name:         "Dendy",
+		masterClock:  26601712,
+		cpuDivider:   15,
+		ppuDivider:   5,
+		scanlines:    312,
+		vblankLine:   291,
+		frameSteps:   &ntscFrameSteps,
+		noisePeriods: &noisePeriodTable,
+		dmcRates:     &dmcRateTable,
+	},
+}
+
+func (r Region) profile() *regionProfile {
+	if int(r) >= len(regionProfiles) {
+		return &regionProfiles[RegionNTSC]
+	}
+	return &regionProfiles[r]
+}
+
+func (r Region) String() string {
+	return r.profile().name
+}
+
+// ParseRegion returns region by its name: ntsc, pal or dendy
+func ParseRegion(name string) (Region, error) {
+	for r := range regionProfiles {
+		if strings.EqualFold(name, regionProfiles[r].name) {
+			return Region(r), nil
+		}
+	}
+	return RegionNTSC, fmt.Errorf("unknown region %s", name)
+}
+
+// CPUClock returns CPU clock rate in Hz
+func (r Region) CPUClock() int {
+	p := r.profile()
+	return p.masterClock / int(p.cpuDivider)
+}
+
+// FrameRate returns number of frames per second
+func (r Region) FrameRate() float64 {
+	p := r.profile()
+	dots := float64(dotsPerLine * p.scanlines)
+	if p.oddFrameSkip {
+		dots -= 0.5
+	}
+	return float64(p.masterClock) / float64(p.ppuDivider) / dots
+}
+
+// scheduler keeps CPU and PPU in step on the master clock
+type scheduler struct {
+	profile *regionProfile
+	// Master clock ticks passed by CPU and by PPU
+	cpuTime uint64
+	ppuTime uint64
+}
+
+func (s *scheduler) state(sb *stateBuffer) {
+	stateNum(sb, &s.cpuTime)
+	stateNum(sb, &s.ppuTime)
+}
+
+// cpuCycles advances CPU by the given cycles and returns
+// PPU dots to run to catch up with it
+func (s *scheduler) cpuCycles(cycles uint16) uint16 {
+	s.cpuTime += uint64(cycles) * s.profile.cpuDivider
+	dots := (s.cpuTime - s.ppuTime) / s.profile.ppuDivider
+	s.ppuTime += dots * s.profile.ppuDivider
+	return uint16(dots)
+}
@@ -0,0 +1,58 @@
+package nes
+
+import (
+	"testing"
+)
+
+func TestSchedulerPAL(t *testing.T) {
+	s := scheduler{profile: RegionPAL.profile()}
+	// 3.2 dots per CPU cycle
+	dots := 0
+	for i := 0; i < 5; i++ {
+		dots += int(s.cpuCycles(1))
+	}
+	if dots != 16 {
+		t.Fatalf("Unexpected %d PPU dots in 5 CPU cycles", dots)
+	}
+}
+
+func TestRegionFrameTiming(t *testing.T) {
+	rom := testRom(0, 1)
+	// JMP $8000
+	copy(rom.prgRom, []byte{0x4C, 0x00, 0x80})
+
+	for _, tc := range []struct {
+		region Region
+		cycles uint64
+	}{
+		{RegionNTSC, 29780},
+		{RegionPAL, 33247},
+		{RegionDendy, 35464},
+	} {
+		c := NewRegionConsole(rom, tc.region)
+		c.StepFrame()
+		start := c.cpu.cyclesPassed
+		c.StepFrame()
+		if n := c.cpu.cyclesPassed - start; n < tc.cycles-3 || n > tc.cycles+3 {
+			t.Fatalf("%s frame took %d CPU cycles, expected %d", tc.region, n, tc.cycles)
+		}
+	}
+}
+
+func TestDendyVBlankLine(t *testing.T) {
+	_, ppu := newTestPPU()
+	ppu.profile = RegionDendy.profile()
+	for line := 0; line < 241; line++ {
+		ppu.Step(dotsPerLine)
+	}
+	ppu.Step(2)
+	if ppu.status&PPUStatusVBlank != 0 {
+		t.Fatalf("VBlank started at NTSC line")
+	}
+	for line := 241; line < 291; line++ {
+		ppu.Step(dotsPerLine)
+	}
+	if ppu.status&PPUStatusVBlank == 0 {
+		t.Fatalf("VBlank not started at line 291")
+	}
+}
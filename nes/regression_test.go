@@ -0,0 +1,195 @@
+package nes
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// ROM regression suite runs ROMs listed in the manifest of the ROM
+// directory and compares hashes of the picture with golden ones.
+// Every manifest line is
+//
+//	<rom> <frame> <sha256 or -> [fm2 movie]
+//
+// with paths relative to the directory and # starting comments.
+// Run go test -run TestRomRegression -update to rewrite the hashes
+const (
+	romDirEnv          = "DARKNES_ROM_DIR"
+	defaultRomDir      = "testdata/roms"
+	regressionManifest = "manifest.txt"
+	noGoldenHash       = "-"
+)
+
+var updateGoldens = flag.Bool("update", false, "rewrite golden hashes of the ROM regression suite")
+
+// regressionCase is a manifest line, other lines are kept as they are
+type regressionCase struct {
+	rom   string
+	frame int
+	hash  string
+	movie string
+	line  int
+}
+
+func parseRegressionManifest(r io.Reader) ([]string, []regressionCase, error) {
+	var lines []string
+	var cases []regressionCase
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		text := scanner.Text()
+		lines = append(lines, text)
+		fields := strings.Fields(text)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, nil, fmt.Errorf("line %d: expected rom, frame, hash and optional movie", len(lines))
+		}
+		frame, err := strconv.Atoi(fields[1])
+		if err != nil || frame < 1 {
+			return nil, nil, fmt.Errorf("line %d: bad frame %q", len(lines), fields[1])
+		}
+		c := regressionCase{rom: fields[0], frame: frame, hash: fields[2], line: len(lines) - 1}
+		if len(fields) == 4 {
+			c.movie = fields[3]
+		}
+		cases = append(cases, c)
+	}
+	return lines, cases, scanner.Err()
+}
+
+func (c regressionCase) String() string {
+	fields := []string{c.rom, strconv.Itoa(c.frame), c.hash}
+	if c.movie != "" {
+		fields = append(fields, c.movie)
+	}
+	return strings.Join(fields, " ")
+}
+
+// runRegressionCase returns hash of the picture at the frame of the case.
+// ROMs are loaded the way darknes loads them, FDS BIOS and patches
+// are looked up next to them
+func runRegressionCase(dir string, c regressionCase) (hash string, err error) {
+	// Failing case must not stop the rest of the suite
+	defer func() {
+		if r := recover(); r != nil {
+			err = PanicError(r)
+		}
+	}()
+	rom, err := LoadRomFile(filepath.Join(dir, c.rom), LoadOptions{})
+	if err != nil {
+		return "", err
+	}
+	var movie *Movie
+	if c.movie != "" {
+		f, err := os.Open(filepath.Join(dir, c.movie))
+		if err != nil {
+			return "", err
+		}
+		movie, err = ReadFM2(f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	region := rom.Header.Region()
+	if movie != nil && movie.PAL {
+		region = RegionPAL
+	}
+	console := NewRegionConsole(rom, region)
+	pads := console.ConnectControllers(movie != nil && movie.FourScore)
+	if movie != nil {
+		if _, err := console.PlayMovie(movie, pads); err != nil {
+			return "", err
+		}
+	}
+
+	err = console.RunFrames(c.frame, func() error {
+		console.Audio().Samples()
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(console.Frame().Pix)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func TestRomRegression(t *testing.T) {
+	dir := os.Getenv(romDirEnv)
+	if dir == "" {
+		dir = defaultRomDir
+	}
+	manifestPath := filepath.Join(dir, regressionManifest)
+	f, err := os.Open(manifestPath)
+	if errors.Is(err, os.ErrNotExist) {
+		t.Skipf("No ROM manifest %s, set %s to the ROM directory", manifestPath, romDirEnv)
+	}
+	if err != nil {
+		t.Fatalf("Failed to open manifest: %v", err)
+	}
+	lines, cases, err := parseRegressionManifest(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Bad manifest: %v", err)
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%s@%d", c.rom, c.frame), func(t *testing.T) {
+			hash, err := runRegressionCase(dir, c)
+			if err != nil {
+				t.Fatalf("Failed to run %s: %v", c.rom, err)
+			}
+			if *updateGoldens {
+				c.hash = hash
+				lines[c.line] = c.String()
+				return
+			}
+			if c.hash == noGoldenHash {
+				t.Skipf("No golden hash, picture hash is %s", hash)
+			}
+			if hash != c.hash {
+				t.Fatalf("Picture hash %s differs from golden %s", hash, c.hash)
+			}
+		})
+	}
+
+	if *updateGoldens {
+		data := strings.Join(lines, "\n") + "\n"
+		if err := os.WriteFile(manifestPath, []byte(data), 0644); err != nil {
+			t.Fatalf("Failed to update manifest: %v", err)
+		}
+	}
+}
+
+func TestRegressionManifest(t *testing.T) {
+	manifest := "# comment\n\nsmb.nes 120 -\nzelda.nes 600 ab12 zelda.fm2\n"
+	lines, cases, err := parseRegressionManifest(strings.NewReader(manifest))
+	if err != nil {
+		t.Fatalf("Failed to parse manifest: %v", err)
+	}
+	if len(lines) != 4 || len(cases) != 2 {
+		t.Fatalf("Unexpected %d lines and %d cases", len(lines), len(cases))
+	}
+	if cases[1].movie != "zelda.fm2" || cases[1].frame != 600 || cases[1].line != 3 {
+		t.Fatalf("Unexpected case %+v", cases[1])
+	}
+	if s := cases[1].String(); s != lines[3] {
+		t.Fatalf("Case written as %q", s)
+	}
+
+	if _, _, err := parseRegressionManifest(strings.NewReader("smb.nes x -\n")); err == nil {
+		t.Fatalf("Bad frame accepted")
+	}
+}
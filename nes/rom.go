@@ -1,6 +1,13 @@
 // Package rom implements iNES rom format
 package nes
 
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"hash/crc32"
+)
+
 const (
 	romHeaderLen uint32 = 16
 )
@@ -15,9 +22,14 @@ type RomHeader struct {
 	Flags7     byte
 	Flags9     byte
 	HasTrainer bool
+	HasBattery bool
 	MapperNum  byte
 	PrgBegin   uint32
 	PrgEnd     uint32
+	// Fields corrected by the game database
+	Fixes []HeaderFix
+	// Single-screen mirroring of UNIF boards, iNES flags cannot express it
+	singleScreen Mirroring
 }
 
 // Rom contains ordered ROM data fields in iNES format
@@ -26,6 +38,31 @@ type Rom struct {
 	Header *RomHeader
 	prgRom []byte
 	chrRom []byte
+	// Famicom Disk System disk sides
+	disk [][]byte
+	// NSF music data description
+	Nsf *NsfInfo
+	// Checksums of the game data, see checksum
+	CRC32 uint32
+	SHA1  [sha1.Size]byte
+	MD5   [md5.Size]byte
+}
+
+// checksum computes checksums of PRG and CHR data of cartridges,
+// of disk sides of FDS images and of whole NSF files
+func (r *Rom) checksum() {
+	var game []byte
+	switch {
+	case r.Nsf != nil:
+		game = r.data
+	case r.disk != nil:
+		game = bytes.Join(r.disk, nil)
+	default:
+		game = append(append([]byte(nil), r.prgRom...), r.chrRom...)
+	}
+	r.CRC32 = crc32.ChecksumIEEE(game)
+	r.SHA1 = sha1.Sum(game)
+	r.MD5 = md5.Sum(game)
 }
 
 // Read method returns byte from ROM at the specified address
@@ -46,6 +83,7 @@ func LoadRomData(romData []byte) *Rom {
 			Flags7:     romData[7],
 			Flags9:     romData[9],
 			HasTrainer: (romData[6] & 4) != 0,
+			HasBattery: (romData[6] & 2) != 0,
 			MapperNum:  ((romData[6] & 0xf0) >> 4) | (romData[7] & 0xf0),
 			PrgBegin:   romHeaderLen,
 		},
@@ -63,5 +101,74 @@ func LoadRomData(romData []byte) *Rom {
 		chrEnd := rom.Header.PrgEnd + (uint32(rom.Header.ChrRomSize) * 8192)
 		rom.chrRom = rom.data[rom.Header.PrgEnd:chrEnd]
 	}
+	rom.checkGameDB()
 	return &rom
 }
+
+// NES 2.0 default expansion devices
+const (
+	ExpansionUnspecified    = 0x00
+	ExpansionStandard       = 0x01
+	ExpansionFourScore      = 0x02
+	ExpansionZapper         = 0x08
+	ExpansionPowerPadA      = 0x0B
+	ExpansionPowerPadB      = 0x0C
+	ExpansionFamilyTrainerA = 0x0D
+	ExpansionFamilyTrainerB = 0x0E
+	ExpansionVaus           = 0x0F
+	ExpansionVausFamicom    = 0x10
+	ExpansionFamilyBASIC    = 0x23
+)
+
+// IsNES20 reports whether the header is in NES 2.0 format
+func (h *RomHeader) IsNES20() bool {
+	return bytes.HasPrefix(h.headerData, []byte("NES\x1a")) && h.Flags7&0x0C == 0x08
+}
+
+// ExpansionDevice returns NES 2.0 default expansion device,
+// ExpansionUnspecified for other formats
+func (h *RomHeader) ExpansionDevice() byte {
+	if !h.IsNES20() || len(h.headerData) < 16 {
+		return ExpansionUnspecified
+	}
+	return h.headerData[15] & 0x3F
+}
+
+// Region returns TV system from NES 2.0 timing field or iNES
+// flags 9, multi-region games run as NTSC
+func (h *RomHeader) Region() Region {
+	if h.IsNES20() && len(h.headerData) >= 16 {
+		switch h.headerData[12] & 0x03 {
+		case 1:
+			return RegionPAL
+		case 3:
+			return RegionDendy
+		}
+		return RegionNTSC
+	}
+	if h.Flags9&0x01 != 0 {
+		return RegionPAL
+	}
+	return RegionNTSC
+}
+
+// Mirroring returns nametable mirroring soldered on the board
+func (h *RomHeader) Mirroring() Mirroring {
+	switch {
+	case h.singleScreen != 0:
+		return h.singleScreen
+	case h.Flags6&0x08 != 0:
+		return MirrorFourScreen
+	case h.Flags6&0x01 != 0:
+		return MirrorVertical
+	}
+	return MirrorHorizontal
+}
+
+// Reads null-terminated string from a fixed size field
+func cString(field []byte) string {
+	if i := bytes.IndexByte(field, 0); i >= 0 {
+		field = field[:i]
+	}
+	return string(field)
+}
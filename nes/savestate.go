@@ -0,0 +1,227 @@
+package nes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Save state layout, integers are little endian:
+//
+//	magic "DNSS", version uint16, region byte, ROM MD5 [16]byte
+//	chunks: tag [4]byte, length uint32, data
+//
+// Chunk data is a sequence of component fields, numbers are stored
+// as varints so they keep loading when a field is widened. Fields
+// added by newer versions go to the end of the chunk, older states
+// leave them at their current values. Unknown chunks are skipped
+const (
+	stateMagic = "DNSS"
+	// StateVersion is the save state format written by SaveState
+	StateVersion = 1
+
+	stateHeaderSize = 4 + 2 + 1 + 16
+)
+
+// isSaveState reports whether data starts like a save state
+func isSaveState(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(stateMagic))
+}
+
+// stateful is implemented by components with state kept in save states.
+// state visits fields in a fixed order either saving or loading them
+type stateful interface {
+	state(s *stateBuffer)
+}
+
+// stateBuffer writes component fields into a chunk or reads them back
+type stateBuffer struct {
+	loading bool
+	version int
+	data    []byte
+	off     int
+	err     error
+}
+
+type stateNumber interface {
+	~uint8 | ~uint16 | ~uint32 | ~uint64 | ~int8 | ~int | ~int64
+}
+
+// stateNum saves or loads integer field
+func stateNum[T stateNumber](s *stateBuffer, v *T) {
+	if !s.loading {
+		s.data = binary.AppendUvarint(s.data, uint64(*v))
+		return
+	}
+	if s.off >= len(s.data) {
+		return
+	}
+	val, n := binary.Uvarint(s.data[s.off:])
+	if n <= 0 {
+		s.fail(errors.New("bad number"))
+		return
+	}
+	s.off += n
+	*v = T(val)
+}
+
+func (s *stateBuffer) bool(v *bool) {
+	b := byte(0)
+	if *v {
+		b = 1
+	}
+	stateNum(s, &b)
+	*v = b != 0
+}
+
+func (s *stateBuffer) float(v *float32) {
+	bits := math.Float32bits(*v)
+	stateNum(s, &bits)
+	*v = math.Float32frombits(bits)
+}
+
+// bytes saves or loads memory of fixed size
+func (s *stateBuffer) bytes(b []byte) {
+	if !s.loading {
+		s.data = append(s.data, b...)
+		return
+	}
+	if s.off+len(b) > len(s.data) {
+		return
+	}
+	s.off += copy(b, s.data[s.off:])
+}
+
+// block saves or loads memory which size depends on the cartridge,
+// it must match when loading
+func (s *stateBuffer) block(b []byte) {
+	size := uint32(len(b))
+	stateNum(s, &size)
+	if int(size) != len(b) {
+		s.fail(fmt.Errorf("memory size %d, expected %d", size, len(b)))
+		return
+	}
+	s.bytes(b)
+}
+
+func (s *stateBuffer) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+	// Stop reading the rest of the chunk
+	s.off = len(s.data)
+}
+
+// stateChunk is a component saved under its own tag
+type stateChunk struct {
+	tag       string
+	component stateful
+}
+
+func (c *Console) stateChunks() []stateChunk {
+	chunks := []stateChunk{
+		{"CPU ", c.cpu},
+		{"CLK ", &c.clock},
+		{"RAM ", c.mem},
+		{"PPU ", c.ppu},
+		{"APU ", c.mem.apu},
+	}
+	if mapper, ok := c.mem.mapper.(stateful); ok {
+		chunks = append(chunks, stateChunk{"MAPR", mapper})
+	}
+	for i, tag := range []string{"JOY1", "JOY2"} {
+		if device, ok := c.mem.ports[i].(stateful); ok {
+			chunks = append(chunks, stateChunk{tag, device})
+		}
+	}
+	if device, ok := c.mem.expansion.(stateful); ok {
+		chunks = append(chunks, stateChunk{"EXP ", device})
+	}
+	if c.nsf != nil {
+		chunks = append(chunks, stateChunk{"NSF ", c.nsf})
+	}
+	return chunks
+}
+
+// SaveState writes snapshot of the whole machine
+func (c *Console) SaveState(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString(stateMagic)
+	binary.Write(&buf, binary.LittleEndian, uint16(StateVersion))
+	buf.WriteByte(byte(c.region))
+	buf.Write(c.rom.MD5[:])
+
+	for _, chunk := range c.stateChunks() {
+		s := &stateBuffer{version: StateVersion}
+		chunk.component.state(s)
+		buf.WriteString(chunk.tag)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(s.data)))
+		buf.Write(s.data)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// LoadState restores snapshot written by SaveState of the same ROM
+// and region. Console is left untouched when the state is rejected
+func (c *Console) LoadState(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) < stateHeaderSize || !isSaveState(data) {
+		return errors.New("not a save state")
+	}
+	version := int(binary.LittleEndian.Uint16(data[4:]))
+	if version > StateVersion {
+		return fmt.Errorf("save state version %d is newer than supported %d", version, StateVersion)
+	}
+	if region := Region(data[6]); region != c.region {
+		return fmt.Errorf("save state of %s console, running %s", region, c.region)
+	}
+	if !bytes.Equal(data[7:stateHeaderSize], c.rom.MD5[:]) {
+		return errors.New("save state of a different ROM")
+	}
+
+	chunks := map[string][]byte{}
+	for rest := data[stateHeaderSize:]; len(rest) > 0; {
+		if len(rest) < 8 {
+			return errors.New("truncated save state")
+		}
+		tag, size := string(rest[:4]), binary.LittleEndian.Uint32(rest[4:])
+		rest = rest[8:]
+		if uint64(size) > uint64(len(rest)) {
+			return fmt.Errorf("truncated %q chunk", tag)
+		}
+		chunks[tag], rest = rest[:size], rest[size:]
+	}
+
+	// Roll back on errors found in the middle of a chunk
+	var backup bytes.Buffer
+	if err := c.SaveState(&backup); err != nil {
+		return err
+	}
+	if err := c.loadChunks(chunks, version); err != nil {
+		c.LoadState(&backup)
+		return err
+	}
+	return nil
+}
+
+func (c *Console) loadChunks(chunks map[string][]byte, version int) error {
+	for _, chunk := range c.stateChunks() {
+		data, ok := chunks[chunk.tag]
+		if !ok {
+			continue
+		}
+		s := &stateBuffer{loading: true, version: version, data: data}
+		chunk.component.state(s)
+		if s.err != nil {
+			return fmt.Errorf("%q chunk: %w", chunk.tag, s.err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package nes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// stateTestConsole runs a program touching RAM, PPU and APU
+func stateTestConsole() *Console {
+	rom := testRom(0, 1)
+	copy(rom.prgRom, []byte{
+		0xA9, 0x1E, 0x8D, 0x01, 0x20, // LDA #$1E; STA $2001
+		0xA9, 0x01, 0x8D, 0x15, 0x40, // LDA #$01; STA $4015
+		0xE6, 0x00, // INC $00
+		0xA5, 0x00, 0x8D, 0x07, 0x20, // LDA $00; STA $2007
+		0x8D, 0x02, 0x40, 0x8D, 0x03, 0x40, // STA $4002; STA $4003
+		0x4C, 0x0A, 0x80, // JMP $800A
+	})
+	rom.MD5 = [16]byte{1, 2, 3}
+	return NewConsole(rom)
+}
+
+func TestSaveStateRoundTrip(t *testing.T) {
+	c := stateTestConsole()
+	c.RunFrames(5, nil)
+
+	var state bytes.Buffer
+	if err := c.SaveState(&state); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+	c.RunFrames(3, nil)
+	ram, frame, cpu := c.mem.ram, c.ppu.frame, *c.cpu
+
+	// The same frames are emulated again from the snapshot
+	if err := c.LoadState(bytes.NewReader(state.Bytes())); err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	if c.ppu.frameCount != 5 {
+		t.Fatalf("Unexpected frame count %d after load", c.ppu.frameCount)
+	}
+	c.RunFrames(3, nil)
+	if c.mem.ram != ram || c.ppu.frame != frame || *c.cpu != cpu {
+		t.Fatalf("Emulation diverged after loading state")
+	}
+
+	// State loads into a freshly powered console too
+	fresh := stateTestConsole()
+	if err := fresh.LoadState(bytes.NewReader(state.Bytes())); err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	fresh.RunFrames(3, nil)
+	if fresh.mem.ram != ram || fresh.cpu.PC != cpu.PC {
+		t.Fatalf("Fresh console diverged after loading state")
+	}
+}
+
+func TestSaveStateRejected(t *testing.T) {
+	c := stateTestConsole()
+	c.RunFrames(2, nil)
+	var state bytes.Buffer
+	c.SaveState(&state)
+	data := state.Bytes()
+
+	other := stateTestConsole()
+	other.rom.MD5[0] = 0xFF
+	if err := other.LoadState(bytes.NewReader(data)); err == nil {
+		t.Fatalf("State of a different ROM loaded")
+	}
+
+	newer := bytes.Clone(data)
+	binary.LittleEndian.PutUint16(newer[4:], StateVersion+1)
+	if err := c.LoadState(bytes.NewReader(newer)); err == nil {
+		t.Fatalf("State of newer version loaded")
+	}
+	if err := c.LoadState(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Fatalf("Truncated state loaded")
+	}
+	if other.ppu.frameCount != 0 || c.ppu.frameCount != 2 {
+		t.Fatalf("Rejected state changed the console")
+	}
+}
+
+func TestSaveStateChunks(t *testing.T) {
+	c := stateTestConsole()
+	c.RunFrames(1, nil)
+	var state bytes.Buffer
+	c.SaveState(&state)
+	data := state.Bytes()
+
+	// Unknown chunks are skipped
+	data = append(data, "XTRA\x02\x00\x00\x00ab"...)
+	c.mem.ram[0] = 0xAA
+	if err := c.LoadState(bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to load state with unknown chunk: %v", err)
+	}
+	if c.mem.ram[0] == 0xAA {
+		t.Fatalf("RAM not restored")
+	}
+
+	// Fields missing in shorter chunks of older versions stay as they are
+	s := &stateBuffer{}
+	stateNum(s, &c.cpu.A)
+	cpu := *c.cpu
+	cpu.A++
+	s = &stateBuffer{loading: true, data: s.data}
+	cpu.state(s)
+	if s.err != nil || cpu.A != c.cpu.A || cpu.PC != c.cpu.PC {
+		t.Fatalf("Unexpected CPU %+v loaded from short chunk", cpu)
+	}
+}
@@ -0,0 +1,216 @@
+package nes
+
+import "math"
+
+const (
+	// Tone and noise generators are clocked every 16 CPU cycles
+	s5bToneDivider = 16
+	// Envelope generator steps every 8 CPU cycles (32-step envelope)
+	s5bEnvelopeDivider = 8
+)
+
+// 5-bit logarithmic volume table, 1.5 dB per step
+var s5bVolumeTable = func() (t [32]float32) {
+	for i := 1; i < 32; i++ {
+		t[i] = float32(math.Pow(10, -float64(31-i)*1.5/20))
+	}
+	return
+}()
+
+// s5bTone is a single square channel of the 5B
+type s5bTone struct {
+	period  uint16
+	counter uint16
+	output  bool
+}
+
+func (t *s5bTone) clock() {
+	t.counter++
+	if t.counter >= t.period {
+		t.counter = 0
+		t.output = !t.output
+	}
+}
+
+// Sunsoft5B is the YM2149-like expansion sound chip found on
+// Sunsoft 5B cartridges: 3 square channels, noise and envelope
+type Sunsoft5B struct {
+	regs    [16]byte
+	address byte
+
+	tones [3]s5bTone
+
+	noisePeriod  byte
+	noiseCounter byte
+	noiseShift   uint32
+
+	envPeriod  uint16
+	envCounter uint16
+	envStep    byte
+	envHolding bool
+	envAttack  bool
+	envLevel   byte
+
+	toneDivider byte
+	envDivider  byte
+}
+
+func (s *Sunsoft5B) state(sb *stateBuffer) {
+	sb.bytes(s.regs[:])
+	stateNum(sb, &s.address)
+	for i := range s.tones {
+		stateNum(sb, &s.tones[i].period)
+		stateNum(sb, &s.tones[i].counter)
+		sb.bool(&s.tones[i].output)
+	}
+	stateNum(sb, &s.noisePeriod)
+	stateNum(sb, &s.noiseCounter)
+	stateNum(sb, &s.noiseShift)
+	stateNum(sb, &s.envPeriod)
+	stateNum(sb, &s.envCounter)
+	stateNum(sb, &s.envStep)
+	sb.bool(&s.envHolding)
+	sb.bool(&s.envAttack)
+	stateNum(sb, &s.envLevel)
+	stateNum(sb, &s.toneDivider)
+	stateNum(sb, &s.envDivider)
+}
+
+// NewSunsoft5B creates 5B sound chip in its power up state
+func NewSunsoft5B() *Sunsoft5B {
+	return &Sunsoft5B{noiseShift: 1}
+}
+
+// SelectRegister handles writes to $C000-$DFFF
+func (s *Sunsoft5B) SelectRegister(val byte) {
+	s.address = val
+}
+
+// WriteRegister handles writes to $E000-$FFFF
+func (s *Sunsoft5B) WriteRegister(val byte) {
+	// Upper nibble must be zero, otherwise write is ignored
+	if s.address&0xF0 != 0 {
+		return
+	}
+	r := s.address & 0x0F
+	s.regs[r] = val
+
+	switch {
+	case r <= 0x05:
+		ch := r / 2
+		s.tones[ch].period = uint16(s.regs[ch*2]) | uint16(s.regs[ch*2+1]&0x0F)<<8
+	case r == 0x06:
+		s.noisePeriod = val & 0x1F
+	case r == 0x0B || r == 0x0C:
+		s.envPeriod = uint16(s.regs[0x0B]) | uint16(s.regs[0x0C])<<8
+	case r == 0x0D:
+		// Writing the shape restarts the envelope
+		s.envStep = 0
+		s.envCounter = 0
+		s.envHolding = false
+		s.envAttack = val&0x04 != 0
+		s.updateEnvelopeLevel()
+	}
+}
+
+// Clock advances the chip by the given number of CPU cycles
+func (s *Sunsoft5B) Clock(cycles uint16) {
+	for i := uint16(0); i < cycles; i++ {
+		s.envDivider++
+		if s.envDivider == s5bEnvelopeDivider {
+			s.envDivider = 0
+			s.clockEnvelope()
+		}
+
+		s.toneDivider++
+		if s.toneDivider < s5bToneDivider {
+			continue
+		}
+		s.toneDivider = 0
+		for ch := range s.tones {
+			s.tones[ch].clock()
+		}
+		s.clockNoise()
+	}
+}
+
+func (s *Sunsoft5B) clockNoise() {
+	s.noiseCounter++
+	if s.noiseCounter < s.noisePeriod {
+		return
+	}
+	s.noiseCounter = 0
+	// 17-bit LFSR with taps at bits 0 and 3
+	feedback := (s.noiseShift ^ (s.noiseShift >> 3)) & 1
+	s.noiseShift = (s.noiseShift >> 1) | feedback<<16
+}
+
+func (s *Sunsoft5B) clockEnvelope() {
+	if s.envHolding {
+		return
+	}
+	s.envCounter++
+	if s.envCounter < s.envPeriod {
+		return
+	}
+	s.envCounter = 0
+	s.envStep++
+	if s.envStep == 32 {
+		// Shape bits: 3 - continue, 2 - attack, 1 - alternate, 0 - hold
+		shape := s.regs[0x0D]
+		switch {
+		case shape&0x08 == 0:
+			s.envHolding = true
+			s.envLevel = 0
+			return
+		case shape&0x01 != 0:
+			if shape&0x02 != 0 {
+				s.envAttack = !s.envAttack
+			}
+			s.envHolding = true
+			s.envLevel = 0
+			if s.envAttack {
+				s.envLevel = 31
+			}
+			return
+		case shape&0x02 != 0:
+			s.envAttack = !s.envAttack
+		}
+		s.envStep = 0
+	}
+	s.updateEnvelopeLevel()
+}
+
+func (s *Sunsoft5B) updateEnvelopeLevel() {
+	if s.envAttack {
+		s.envLevel = s.envStep
+	} else {
+		s.envLevel = 31 - s.envStep
+	}
+}
+
+// Sample returns mixed output of all channels in range [0, 1]
+func (s *Sunsoft5B) Sample() float32 {
+	mixer := s.regs[0x07]
+	noise := s.noiseShift&1 != 0
+
+	var out float32
+	for ch := range s.tones {
+		toneOff := mixer&(1<<ch) != 0
+		noiseOff := mixer&(8<<ch) != 0
+		if !(toneOff || s.tones[ch].output) || !(noiseOff || noise) {
+			continue
+		}
+		vol := s.regs[0x08+ch]
+		level := s.envLevel
+		if vol&0x10 == 0 {
+			// Fixed 4-bit volume maps onto the 5-bit scale
+			level = (vol & 0x0F) << 1
+			if level != 0 {
+				level++
+			}
+		}
+		out += s5bVolumeTable[level]
+	}
+	return out / 3
+}
@@ -0,0 +1,201 @@
+package nes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	unifHeaderLen = 32
+)
+
+// Board names of UNIF dumps (without NES-/UNL-/HVC-/BTL-/BMC- prefix)
+// and the corresponding iNES mapper numbers
+var unifBoards = map[string]byte{
+	"NROM":                   0,
+	"NROM-128":               0,
+	"NROM-256":               0,
+	"RROM":                   0,
+	"RROM-128":               0,
+	"SAROM":                  1,
+	"SBROM":                  1,
+	"SCROM":                  1,
+	"SEROM":                  1,
+	"SGROM":                  1,
+	"SKROM":                  1,
+	"SLROM":                  1,
+	"SL1ROM":                 1,
+	"SNROM":                  1,
+	"SOROM":                  1,
+	"SUROM":                  1,
+	"SXROM":                  1,
+	"UNROM":                  2,
+	"UOROM":                  2,
+	"CNROM":                  3,
+	"TBROM":                  4,
+	"TEROM":                  4,
+	"TFROM":                  4,
+	"TGROM":                  4,
+	"TKROM":                  4,
+	"TLROM":                  4,
+	"TNROM":                  4,
+	"TSROM":                  4,
+	"TVROM":                  4,
+	"B4":                     4,
+	"ELROM":                  5,
+	"EKROM":                  5,
+	"ETROM":                  5,
+	"EWROM":                  5,
+	"AMROM":                  7,
+	"ANROM":                  7,
+	"AOROM":                  7,
+	"PNROM":                  9,
+	"FJROM":                  10,
+	"FKROM":                  10,
+	"CPROM":                  13,
+	"NAMCOT-163":             19,
+	"GNROM":                  66,
+	"MHROM":                  66,
+	"BTR":                    69,
+	"JLROM":                  69,
+	"JSROM":                  69,
+	"Sachen-8259A":           141,
+	"Sachen-8259B":           138,
+	"Sachen-8259C":           139,
+	"Sachen-8259D":           137,
+	"SA-72007":               145,
+	"SA-72008":               133,
+	"SA-NROM":                143,
+	"TC-U01-1.5M":            147,
+	"22211":                  132,
+	"TEK90":                  90,
+	"MARIO1-MALEE2":          42,
+	"Super24in1SC03":         176,
+	"Supervision16in1":       53,
+	"NovelDiamond9999999in1": 201,
+	"42in1ResetSwitch":       233,
+	"70in1":                  236,
+	"8237":                   215,
+	"D1038":                  59,
+	"Ghostbusters63in1":      226,
+}
+
+// Known board name prefixes which carry no mapper information
+var unifPrefixes = []string{"NES-", "UNL-", "HVC-", "BTL-", "BMC-"}
+
+// UnifBoardMapper returns iNES mapper number of the UNIF board
+func UnifBoardMapper(board string) (byte, bool) {
+	if mapper, ok := unifBoards[board]; ok {
+		return mapper, true
+	}
+	for _, prefix := range unifPrefixes {
+		if name := strings.TrimPrefix(board, prefix); name != board {
+			if mapper, ok := unifBoards[name]; ok {
+				return mapper, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// LoadUnifData parses UNIF (.unf) file and returns ROM in the same form
+// as LoadRomData does, board name is translated into iNES mapper number.
+// Boards of mappers GetMapper does not implement are rejected
+func LoadUnifData(romData []byte) (*Rom, error) {
+	if len(romData) < unifHeaderLen || !bytes.HasPrefix(romData, []byte("UNIF")) {
+		return nil, errors.New("not a UNIF file")
+	}
+
+	var board string
+	var prgChunks, chrChunks [16][]byte
+	// Mapper controlled mirroring unless MIRR chunk says otherwise
+	mirroring := byte(5)
+	battery := false
+
+	for p := unifHeaderLen; p+8 <= len(romData); {
+		id := string(romData[p : p+4])
+		length := int(binary.LittleEndian.Uint32(romData[p+4:]))
+		p += 8
+		if length < 0 || p+length > len(romData) {
+			return nil, fmt.Errorf("UNIF chunk %s is truncated", id)
+		}
+		chunk := romData[p : p+length]
+		p += length
+
+		switch {
+		case id == "MAPR":
+			board = cString(chunk)
+		case id == "MIRR" && length > 0:
+			mirroring = chunk[0]
+		case id == "BATR":
+			battery = true
+		case strings.HasPrefix(id, "PRG") || strings.HasPrefix(id, "CHR"):
+			var n int
+			if _, err := fmt.Sscanf(id[3:], "%X", &n); err != nil || n > 0x0F {
+				continue
+			}
+			if id[0] == 'P' {
+				prgChunks[n] = chunk
+			} else {
+				chrChunks[n] = chunk
+			}
+		}
+	}
+
+	if board == "" {
+		return nil, errors.New("UNIF file has no MAPR chunk")
+	}
+	mapper, ok := UnifBoardMapper(board)
+	if !ok {
+		return nil, fmt.Errorf("unknown UNIF board %s", board)
+	}
+	if !MapperSupported(mapper) {
+		return nil, fmt.Errorf("unsupported board %q (mapper %d)", board, mapper)
+	}
+
+	prg := bytes.Join(prgChunks[:], nil)
+	chr := bytes.Join(chrChunks[:], nil)
+	if len(prg) == 0 {
+		return nil, errors.New("UNIF file has no PRG data")
+	}
+
+	flags6 := (mapper & 0x0F) << 4
+	var singleScreen Mirroring
+	switch mirroring {
+	case 1:
+		flags6 |= 0x01
+	case 2:
+		singleScreen = MirrorSingleLow
+	case 3:
+		singleScreen = MirrorSingleHigh
+	case 4:
+		flags6 |= 0x08
+	}
+	if battery {
+		flags6 |= 0x02
+	}
+
+	rom := &Rom{
+		data: romData,
+		Header: &RomHeader{
+			headerData: romData[:unifHeaderLen],
+			PrgRomSize: byte((len(prg) + 16*1024 - 1) / (16 * 1024)),
+			ChrRomSize: byte((len(chr) + 8191) / 8192),
+			Flags6:     flags6,
+			Flags7:     mapper & 0xF0,
+			HasBattery: battery,
+			MapperNum:  mapper,
+
+			singleScreen: singleScreen,
+		},
+		prgRom: prg,
+	}
+	if len(chr) > 0 {
+		rom.chrRom = chr
+	}
+	rom.checksum()
+	return rom, nil
+}
@@ -0,0 +1,59 @@
+package nes
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"testing"
+)
+
+func unifChunk(id string, data []byte) []byte {
+	chunk := make([]byte, 8, 8+len(data))
+	copy(chunk, id)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(data)))
+	return append(chunk, data...)
+}
+
+func TestLoadUnifData(t *testing.T) {
+	data := make([]byte, unifHeaderLen)
+	copy(data, "UNIF")
+	data = append(data, unifChunk("MAPR", []byte("NES-BTR\x00"))...)
+	data = append(data, unifChunk("PRG1", make([]byte, 16*1024))...)
+	data = append(data, unifChunk("PRG0", make([]byte, 16*1024))...)
+	data = append(data, unifChunk("CHR0", make([]byte, 8*1024))...)
+	data = append(data, unifChunk("MIRR", []byte{1})...)
+	data = append(data, unifChunk("BATR", []byte{1})...)
+
+	rom, err := LoadUnifData(data)
+	if err != nil {
+		t.Fatalf("Failed to load UNIF: %v", err)
+	}
+	if rom.MD5 != md5.Sum(append(bytes.Clone(rom.prgRom), rom.chrRom...)) {
+		t.Fatalf("MD5 of PRG and CHR not computed")
+	}
+	h := rom.Header
+	if h.MapperNum != 69 || h.PrgRomSize != 2 || h.ChrRomSize != 1 {
+		t.Fatalf("Unexpected header: mapper %d, PRG %d, CHR %d", h.MapperNum, h.PrgRomSize, h.ChrRomSize)
+	}
+	if !h.HasBattery || h.Flags6&0x01 == 0 {
+		t.Fatalf("Battery or vertical mirroring flag missing: %08b", h.Flags6)
+	}
+
+	// Single-screen mirroring
+	single := append(bytes.Clone(data), unifChunk("MIRR", []byte{3})...)
+	if rom, err := LoadUnifData(single); err != nil || rom.Header.Mirroring() != MirrorSingleHigh {
+		t.Fatalf("Single-screen mirroring not loaded")
+	}
+
+	// Boards of mappers without implementation
+	mmc1 := append(bytes.Clone(data[:unifHeaderLen]), unifChunk("MAPR", []byte("NES-SNROM\x00"))...)
+	mmc1 = append(mmc1, unifChunk("PRG0", make([]byte, 16*1024))...)
+	if _, err := LoadUnifData(mmc1); err == nil || err.Error() != `unsupported board "NES-SNROM" (mapper 1)` {
+		t.Fatalf("Unexpected error %v for unsupported board", err)
+	}
+
+	data = append(data[:unifHeaderLen], unifChunk("MAPR", []byte("UNL-UNKNOWN\x00"))...)
+	if _, err := LoadUnifData(data); err == nil {
+		t.Fatalf("Unknown board not reported")
+	}
+}
@@ -0,0 +1,81 @@
+package nes
+
+const (
+	// Potentiometer range of the paddle from the leftmost
+	// to the rightmost position
+	vausMin = 0x62
+	vausMax = 0xF2
+)
+
+// Vaus is the Arkanoid paddle. Its potentiometer value is read serially,
+// MSB first and inverted. NES version plugs into controller port 2 and
+// returns fire in D3 and data in D4, Famicom version uses expansion port
+// and returns fire in $4016 D1 and data in $4017 D1
+type Vaus struct {
+	position byte
+	fire     bool
+	shift    byte
+	strobe   bool
+}
+
+// NewVaus creates paddle turned to the middle
+func NewVaus() *Vaus {
+	return &Vaus{position: (vausMin + vausMax) / 2}
+}
+
+// Aim turns the knob to match screen column x, y is ignored
+func (v *Vaus) Aim(x, y int) {
+	x = min(max(x, 0), ScreenWidth-1)
+	v.position = byte(vausMin + x*(vausMax-vausMin)/(ScreenWidth-1))
+}
+
+// SetTrigger presses or releases the fire button
+func (v *Vaus) SetTrigger(pressed bool) {
+	v.fire = pressed
+}
+
+func (v *Vaus) state(s *stateBuffer) {
+	stateNum(s, &v.shift)
+	s.bool(&v.strobe)
+}
+
+// Position returns potentiometer value
+func (v *Vaus) Position() byte {
+	return v.position
+}
+
+// Write latches potentiometer value while strobe is high
+func (v *Vaus) Write(val byte) {
+	v.strobe = val&1 != 0
+	if v.strobe {
+		v.shift = ^v.position
+	}
+}
+
+func (v *Vaus) nextBit() byte {
+	bit := v.shift >> 7
+	if !v.strobe {
+		v.shift <<= 1
+	}
+	return bit
+}
+
+func (v *Vaus) fireBit() byte {
+	if v.fire {
+		return 1
+	}
+	return 0
+}
+
+// Read returns fire in D3 and the next potentiometer bit in D4
+func (v *Vaus) Read() byte {
+	return v.fireBit()<<3 | v.nextBit()<<4
+}
+
+// ReadExpansion returns fire in $4016 D1 and potentiometer bits in $4017 D1
+func (v *Vaus) ReadExpansion(port int) byte {
+	if port == 0 {
+		return v.fireBit() << 1
+	}
+	return v.nextBit() << 1
+}
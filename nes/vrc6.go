@@ -0,0 +1,182 @@
+package nes
+
+// vrc6Pulse is a pulse channel of the VRC6 with 16-step duty cycle
+type vrc6Pulse struct {
+	enabled bool
+	// Digitized mode ignores duty and outputs volume constantly
+	digitized bool
+	duty      byte
+	volume    byte
+	dutyPos   byte
+	timer     uint16
+	period    uint16
+}
+
+func (p *vrc6Pulse) state(s *stateBuffer) {
+	s.bool(&p.enabled)
+	s.bool(&p.digitized)
+	stateNum(s, &p.duty)
+	stateNum(s, &p.volume)
+	stateNum(s, &p.dutyPos)
+	stateNum(s, &p.timer)
+	stateNum(s, &p.period)
+}
+
+func (p *vrc6Pulse) write(reg uint16, val byte) {
+	switch reg {
+	case 0:
+		p.digitized = val&0x80 != 0
+		p.duty = (val >> 4) & 0x07
+		p.volume = val & 0x0F
+	case 1:
+		p.period = p.period&0x0F00 | uint16(val)
+	case 2:
+		p.period = p.period&0x00FF | uint16(val&0x0F)<<8
+		p.enabled = val&0x80 != 0
+		if !p.enabled {
+			p.dutyPos = 15
+		}
+	}
+}
+
+func (p *vrc6Pulse) clock(shift byte) {
+	if !p.enabled {
+		return
+	}
+	if p.timer > 0 {
+		p.timer--
+		return
+	}
+	p.timer = p.period >> shift
+	p.dutyPos = (p.dutyPos - 1) & 0x0F
+}
+
+// Current output level 0-15
+func (p *vrc6Pulse) output() byte {
+	if !p.enabled || !p.digitized && p.dutyPos > p.duty {
+		return 0
+	}
+	return p.volume
+}
+
+// vrc6Saw is the sawtooth channel of the VRC6, its accumulator
+// is increased every other step and reset every 7th increase
+type vrc6Saw struct {
+	enabled     bool
+	rate        byte
+	accumulator byte
+	step        byte
+	timer       uint16
+	period      uint16
+}
+
+func (w *vrc6Saw) state(s *stateBuffer) {
+	s.bool(&w.enabled)
+	stateNum(s, &w.rate)
+	stateNum(s, &w.accumulator)
+	stateNum(s, &w.step)
+	stateNum(s, &w.timer)
+	stateNum(s, &w.period)
+}
+
+func (w *vrc6Saw) write(reg uint16, val byte) {
+	switch reg {
+	case 0:
+		w.rate = val & 0x3F
+	case 1:
+		w.period = w.period&0x0F00 | uint16(val)
+	case 2:
+		w.period = w.period&0x00FF | uint16(val&0x0F)<<8
+		w.enabled = val&0x80 != 0
+		if !w.enabled {
+			w.accumulator = 0
+			w.step = 0
+		}
+	}
+}
+
+func (w *vrc6Saw) clock(shift byte) {
+	if !w.enabled {
+		return
+	}
+	if w.timer > 0 {
+		w.timer--
+		return
+	}
+	w.timer = w.period >> shift
+	w.step++
+	switch {
+	case w.step == 14:
+		w.step = 0
+		w.accumulator = 0
+	case w.step&1 == 0:
+		w.accumulator += w.rate
+	}
+}
+
+// Current output level 0-31, the top 5 bits of the accumulator
+func (w *vrc6Saw) output() byte {
+	return w.accumulator >> 3
+}
+
+// VRC6Audio is the Konami VRC6 expansion sound: two pulse channels
+// and a sawtooth. Registers are at $9000-$9003, $A000-$A002 and
+// $B000-$B002 as wired on VRC6a boards and in NSF players
+type VRC6Audio struct {
+	pulses [2]vrc6Pulse
+	saw    vrc6Saw
+
+	// $9003 halts all channels or speeds them up 16x or 256x
+	halt  bool
+	shift byte
+}
+
+func (a *VRC6Audio) state(s *stateBuffer) {
+	for i := range a.pulses {
+		a.pulses[i].state(s)
+	}
+	a.saw.state(s)
+	s.bool(&a.halt)
+	stateNum(s, &a.shift)
+}
+
+// WriteRegister handles writes to $9000-$B002
+func (a *VRC6Audio) WriteRegister(addr uint16, val byte) {
+	reg := addr & 0x03
+	switch addr & 0xF000 {
+	case 0x9000:
+		if reg == 3 {
+			a.halt = val&0x01 != 0
+			a.shift = 0
+			if val&0x04 != 0 {
+				a.shift = 8
+			} else if val&0x02 != 0 {
+				a.shift = 4
+			}
+			return
+		}
+		a.pulses[0].write(reg, val)
+	case 0xA000:
+		a.pulses[1].write(reg, val)
+	case 0xB000:
+		a.saw.write(reg, val)
+	}
+}
+
+// Clock advances the channels by the given number of CPU cycles
+func (a *VRC6Audio) Clock(cycles uint16) {
+	if a.halt {
+		return
+	}
+	for i := uint16(0); i < cycles; i++ {
+		a.pulses[0].clock(a.shift)
+		a.pulses[1].clock(a.shift)
+		a.saw.clock(a.shift)
+	}
+}
+
+// Sample returns mixed output of all channels in range [0, 1]
+func (a *VRC6Audio) Sample() float32 {
+	out := a.pulses[0].output() + a.pulses[1].output() + a.saw.output()
+	return float32(out) / (15 + 15 + 31)
+}
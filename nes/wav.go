@@ -0,0 +1,180 @@
+package nes
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	wavHeaderLen = 44
+)
+
+// Names of mixer channels used for per-channel recordings
+var channelNames = [mixerChannels]string{"pulse1", "pulse2", "triangle", "noise", "dmc", "expansion"}
+
+// WavWriter writes mono 16-bit PCM WAV file
+type WavWriter struct {
+	w          io.WriteSeeker
+	sampleRate int
+	dataLen    uint32
+	buf        []byte
+}
+
+// NewWavWriter writes WAV header, sizes are filled in by Close
+func NewWavWriter(w io.WriteSeeker, sampleRate int) (*WavWriter, error) {
+	wav := &WavWriter{w: w, sampleRate: sampleRate}
+	if err := wav.writeHeader(); err != nil {
+		return nil, err
+	}
+	return wav, nil
+}
+
+func (wav *WavWriter) writeHeader() error {
+	h := make([]byte, wavHeaderLen)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], wavHeaderLen-8+wav.dataLen)
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	// PCM, 1 channel
+	binary.LittleEndian.PutUint16(h[20:], 1)
+	binary.LittleEndian.PutUint16(h[22:], 1)
+	binary.LittleEndian.PutUint32(h[24:], uint32(wav.sampleRate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(wav.sampleRate)*2)
+	binary.LittleEndian.PutUint16(h[32:], 2)
+	binary.LittleEndian.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], wav.dataLen)
+
+	if _, err := wav.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := wav.w.Write(h)
+	return err
+}
+
+// WriteSamples appends samples in range [-1, 1]
+func (wav *WavWriter) WriteSamples(samples []float32) error {
+	wav.buf = wav.buf[:0]
+	for _, s := range samples {
+		wav.buf = binary.LittleEndian.AppendUint16(wav.buf, uint16(int16(s*32767)))
+	}
+	n, err := wav.w.Write(wav.buf)
+	wav.dataLen += uint32(n)
+	return err
+}
+
+// Close updates header with the length of written data
+// and closes underlying file if there is one
+func (wav *WavWriter) Close() error {
+	err := wav.writeHeader()
+	if c, ok := wav.w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// channelRecording is a mixer playing a single channel into its own file
+type channelRecording struct {
+	mixer *Mixer
+	wav   *WavWriter
+}
+
+// AudioRecorder writes mixed output and optionally every channel
+// to separate WAV files. It records from mixers of its own, unlike
+// the played mixer they are never rate adjusted and stay at the
+// sample rate of the files
+type AudioRecorder struct {
+	source   *Mixer
+	channels []channelRecording
+}
+
+// NewAudioRecorder creates WAV file at path for the output of mixer,
+// following its volumes. With perChannel set each channel is also
+// written to path-<channel>.wav
+func NewAudioRecorder(path string, mixer *Mixer, perChannel bool) (*AudioRecorder, error) {
+	r := &AudioRecorder{source: mixer}
+	if err := r.record(path, newRecordingMixer(mixer, -1)); err != nil {
+		return nil, err
+	}
+	if !perChannel {
+		return r, nil
+	}
+
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	for ch := 0; ch < mixerChannels; ch++ {
+		if ch == ChannelExpansion && mixer.expansion == nil {
+			continue
+		}
+		name := fmt.Sprintf("%s-%s.wav", base, channelNames[ch])
+		if err := r.record(name, newRecordingMixer(mixer, ch)); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// newRecordingMixer attaches mixer with the settings of source,
+// playing only the solo channel unless it is negative
+func newRecordingMixer(source *Mixer, solo int) *Mixer {
+	m := NewMixer(source.apu, source.clockRate, source.sampleRate)
+	m.SetExpansion(source.expansion)
+	m.solo = solo
+	return m
+}
+
+// record starts writing samples of the mixer to the file at path
+func (r *AudioRecorder) record(path string, mixer *Mixer) error {
+	wav, err := createWav(path, mixer.sampleRate)
+	if err != nil {
+		r.source.apu.detachMixer(mixer)
+		return err
+	}
+	r.channels = append(r.channels, channelRecording{mixer, wav})
+	return nil
+}
+
+func createWav(path string, sampleRate int) (*WavWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	wav, err := NewWavWriter(f, sampleRate)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return wav, nil
+}
+
+// Write records samples of the mixed output and of individual
+// channels produced since the last call
+func (r *AudioRecorder) Write() error {
+	for _, ch := range r.channels {
+		ch.mixer.volumes = r.source.volumes
+		ch.mixer.muted = r.source.muted
+		ch.mixer.master = r.source.master
+		if err := ch.wav.WriteSamples(ch.mixer.Samples()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops recording and finalizes the files
+func (r *AudioRecorder) Close() error {
+	var err error
+	for _, ch := range r.channels {
+		r.source.apu.detachMixer(ch.mixer)
+		if cerr := ch.wav.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
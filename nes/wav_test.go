@@ -0,0 +1,48 @@
+package nes
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAudioRecorder(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.wav")
+
+	apu := NewAPU(nil)
+	mixer := NewMixer(apu, CPUClockNTSC, 44100)
+	r, err := NewAudioRecorder(path, mixer, true)
+	if err != nil {
+		t.Fatalf("Failed to start recording: %v", err)
+	}
+	// Recording keeps the file rate when played output is rate adjusted
+	mixer.SetRateAdjust(1.1)
+	apu.Clock(CPUClockNTSC / 60)
+	mixer.Samples()
+	if err := r.Write(); err != nil {
+		t.Fatalf("Failed to write samples: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Failed to close recording: %v", err)
+	}
+	if len(apu.mixers) != 1 {
+		t.Fatalf("Channel mixers left attached: %d", len(apu.mixers))
+	}
+
+	// 735 samples of 1/60 s at 44100 Hz in every file
+	for _, name := range []string{"out.wav", "out-pulse1.wav", "out-dmc.wav"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Missing recording: %v", err)
+		}
+		dataLen := binary.LittleEndian.Uint32(data[40:])
+		if string(data[:4]) != "RIFF" || dataLen < 1466 || dataLen > 1474 || int(dataLen)+wavHeaderLen != len(data) {
+			t.Fatalf("Bad WAV header in %s: data length %d, file size %d", name, dataLen, len(data))
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out-expansion.wav")); err == nil {
+		t.Fatalf("Expansion channel recorded without expansion audio")
+	}
+}
@@ -0,0 +1,81 @@
+package nes
+
+const (
+	// Zapper data lines
+	zapperNoLight byte = 0x08
+	zapperTrigger byte = 0x10
+
+	// Photodiode sees pixels around the aiming point
+	zapperRadius = 3
+	// Lit pixels keep the sensor on for about 20 scanlines
+	zapperPersistence = 20
+	// Minimal average of RGB components considered as light
+	zapperBrightness = 85
+)
+
+// Zapper is the NES light gun. It senses light from the pixels
+// already drawn by the PPU around the point it is aimed at
+type Zapper struct {
+	ppu     *PPU
+	x, y    int
+	trigger bool
+}
+
+// NewZapper creates light gun looking at the PPU output, aimed off screen
+func NewZapper(ppu *PPU) *Zapper {
+	return &Zapper{ppu: ppu, x: -1, y: -1}
+}
+
+// Aim points the gun at framebuffer pixel, coordinates outside
+// of the screen aim off screen
+func (z *Zapper) Aim(x, y int) {
+	z.x, z.y = x, y
+}
+
+// SetTrigger pulls or releases the trigger
+func (z *Zapper) SetTrigger(pulled bool) {
+	z.trigger = pulled
+}
+
+// Read returns light sense in bit 3 (0 when light is detected)
+// and trigger in bit 4
+func (z *Zapper) Read() byte {
+	var val byte
+	if !z.detectLight() {
+		val |= zapperNoLight
+	}
+	if z.trigger {
+		val |= zapperTrigger
+	}
+	return val
+}
+
+// Write is ignored, Zapper has no strobe input
+func (z *Zapper) Write(val byte) {}
+
+func (z *Zapper) detectLight() bool {
+	if z.x < 0 || z.x >= ScreenWidth || z.y < 0 || z.y >= ScreenHeight {
+		return false
+	}
+	scanline := z.ppu.Scanline()
+	// Current line is drawn at dot 256
+	if z.ppu.Dot() < 256 {
+		scanline--
+	}
+
+	for y := z.y - zapperRadius; y <= z.y+zapperRadius; y++ {
+		if y < 0 || y >= ScreenHeight || y > scanline || scanline-y > zapperPersistence {
+			continue
+		}
+		for x := z.x - zapperRadius; x <= z.x+zapperRadius; x++ {
+			if x < 0 || x >= ScreenWidth {
+				continue
+			}
+			c := z.ppu.Pixel(x, y)
+			if (int(c.R)+int(c.G)+int(c.B))/3 >= zapperBrightness {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package nes
+
+import (
+	"testing"
+)
+
+func TestZapperLight(t *testing.T) {
+	m, ppu := newTestPPU()
+	// White backdrop, rendering disabled
+	m.Write(PPUAddress, 0x3F)
+	m.Write(PPUAddress, 0x00)
+	m.Write(PPUData, 0x30)
+	m.Write(PPUAddress, 0x00)
+	m.Write(PPUAddress, 0x00)
+
+	z := NewZapper(ppu)
+	ppu.Step(100 * dotsPerLine)
+
+	z.Aim(50, 95)
+	if z.Read()&zapperNoLight != 0 {
+		t.Fatalf("Light not detected on drawn line")
+	}
+	// Lines below are not drawn yet
+	z.Aim(50, 150)
+	if z.Read()&zapperNoLight == 0 {
+		t.Fatalf("Light detected ahead of the beam")
+	}
+	// Sensor goes dark long after the beam passed
+	z.Aim(50, 20)
+	if z.Read()&zapperNoLight == 0 {
+		t.Fatalf("Light detected from old lines")
+	}
+
+	z.Aim(-1, -1)
+	z.SetTrigger(true)
+	if z.Read() != zapperNoLight|zapperTrigger {
+		t.Fatalf("Unexpected off screen read %02x", z.Read())
+	}
+}
@@ -0,0 +1,126 @@
+package ui
+
+import (
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"darknes/nes"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+const (
+	// AudioSampleRate is the output rate audio sources should produce
+	AudioSampleRate = nes.DefaultSampleRate
+
+	// Samples per chunk queued to the device
+	audioChunk = 512
+	// Ring buffer capacity, about 170 ms
+	ringSize = 8192
+	// Maximum deviation of the sample rate used to keep the buffer half full
+	maxRateDelta = 0.005
+)
+
+// ringBuffer is a lock-free sample queue with a single producer
+// (emulation loop) and a single consumer (audio feeder)
+type ringBuffer struct {
+	data  [ringSize]float32
+	read  atomic.Uint64
+	write atomic.Uint64
+}
+
+func (r *ringBuffer) len() int {
+	return int(r.write.Load() - r.read.Load())
+}
+
+// push stores samples, those not fitting into the buffer are dropped
+func (r *ringBuffer) push(samples []float32) {
+	w := r.write.Load()
+	if free := ringSize - int(w-r.read.Load()); len(samples) > free {
+		samples = samples[:free]
+	}
+	for i, s := range samples {
+		r.data[(w+uint64(i))%ringSize] = s
+	}
+	r.write.Store(w + uint64(len(samples)))
+}
+
+// pop reads up to len(out) samples and returns their number
+func (r *ringBuffer) pop(out []float32) int {
+	rd := r.read.Load()
+	n := min(len(out), int(r.write.Load()-rd))
+	for i := 0; i < n; i++ {
+		out[i] = r.data[(rd+uint64(i))%ringSize]
+	}
+	r.read.Store(rd + uint64(n))
+	return n
+}
+
+// audioOutput plays samples through SDL audio device
+type audioOutput struct {
+	device   sdl.AudioDeviceID
+	ring     ringBuffer
+	done     chan struct{}
+	finished chan struct{}
+}
+
+func openAudio() (*audioOutput, error) {
+	spec := sdl.AudioSpec{
+		Freq:     AudioSampleRate,
+		Format:   sdl.AUDIO_F32SYS,
+		Channels: 1,
+		Samples:  audioChunk,
+	}
+	device, err := sdl.OpenAudioDevice("", false, &spec, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	audio := &audioOutput{
+		device:   device,
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go audio.feed()
+	sdl.PauseAudioDevice(device, false)
+	return audio, nil
+}
+
+// feed moves samples from the ring buffer to the device
+// keeping its own queue short
+func (audio *audioOutput) feed() {
+	defer close(audio.finished)
+	chunk := make([]float32, audioChunk)
+	for {
+		select {
+		case <-audio.done:
+			return
+		default:
+		}
+
+		if sdl.GetQueuedAudioSize(audio.device) >= 2*audioChunk*4 {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		n := audio.ring.pop(chunk)
+		if n == 0 {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		sdl.QueueAudio(audio.device, unsafe.Slice((*byte)(unsafe.Pointer(&chunk[0])), n*4))
+	}
+}
+
+// rateAdjust returns resampling ratio which keeps the ring buffer half full:
+// sources produce a bit more samples when it drains and less when it fills up
+func (audio *audioOutput) rateAdjust() float64 {
+	fill := float64(audio.ring.len()) / ringSize
+	return 1 + maxRateDelta*(1-2*fill)
+}
+
+func (audio *audioOutput) close() {
+	close(audio.done)
+	<-audio.finished
+	sdl.CloseAudioDevice(audio.device)
+}
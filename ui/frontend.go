@@ -2,8 +2,11 @@ package ui
 
 import (
 	"darknes/common"
+	"darknes/nes"
 	"fmt"
 	"strings"
+	"time"
+	"unsafe"
 
 	"github.com/veandco/go-sdl2/sdl"
 	"github.com/veandco/go-sdl2/ttf"
@@ -14,24 +17,201 @@ const (
 
 	fontPath = "assets/fonts/Poppins-Regular.ttf"
 	fontSize = 18
+
+	// NTSC video frame period, 60.0988 Hz
+	ntscFrameTime = time.Second * 10000 / 600988
+
+	// Picture is drawn 2x scaled below the debug text
+	screenScale = 2
+	screenX     = 144
+	screenY     = 110
 )
 
 type SdlFrontend struct {
 	window  *sdl.Window
 	surface *sdl.Surface
 
-	cpuEmu common.CpuEmulator
-	ppuEmu common.PpuEmulator
+	emu    common.Emulator
+	disk   common.DiskDrive
+	player common.MusicPlayer
+
+	// Players 3 and 4 are available through Four Score
+	keyMaps [4]KeyMap
+	pads    [4]common.Joypad
+	gun     common.LightGun
+	// Power Pad or Family BASIC keyboard, driven by keyboard only
+	keyDevice    common.Joypad
+	keyDeviceMap KeyMap
+
+	// Connected gamepads by joystick instance ID
+	gamepads map[sdl.JoystickID]*gamepad
+	padMaps  map[string]PadMap
+	deadzone float32
+
+	audioSrc common.AudioSource
+	audio    *audioOutput
+
+	// Save state slots 1-10 bound to F1-F10
+	states common.StateSlots
+	// Soft reset and power cycle bound to Ctrl+R and Ctrl+Shift+R
+	resetter common.Resetter
+
+	recorder      common.AudioRecorder
+	startRecorder func() (common.AudioRecorder, error)
+
+	// Video frame period of the emulated region
+	frameTime time.Duration
 
 	running bool
+	// Paused emulation is stepped by single instructions
+	paused bool
 
 	// text overlay surface
 	text *sdl.Surface
 	font *ttf.Font
 }
 
-func CreateFrontend(cpuEmu common.CpuEmulator, ppuEmu common.PpuEmulator) *SdlFrontend {
-	return &SdlFrontend{cpuEmu: cpuEmu, ppuEmu: ppuEmu}
+func CreateFrontend(emu common.Emulator) *SdlFrontend {
+	return &SdlFrontend{
+		emu:       emu,
+		keyMaps:   [4]KeyMap{DefaultKeyMap(), {}, {}, {}},
+		gamepads:  map[sdl.JoystickID]*gamepad{},
+		deadzone:  defaultDeadzone,
+		frameTime: ntscFrameTime,
+	}
+}
+
+// SetFrameRate sets video frame rate of the emulated console,
+// NTSC rate is used by default
+func (frontend *SdlFrontend) SetFrameRate(fps float64) {
+	frontend.frameTime = time.Duration(float64(time.Second) / fps)
+}
+
+// AttachLightGun lets mouse aim the light gun and pull its trigger
+// with the left button. Right button shoots off screen.
+// Arkanoid paddle follows the mouse the same way
+func (frontend *SdlFrontend) AttachLightGun(gun common.LightGun) {
+	frontend.gun = gun
+}
+
+// AttachKeyboardDevice lets keyboard press buttons of the device
+// through its own bindings, gamepads are not assigned to it
+func (frontend *SdlFrontend) AttachKeyboardDevice(device common.Joypad, keyMap KeyMap) {
+	frontend.keyDevice = device
+	frontend.keyDeviceMap = keyMap
+}
+
+// AttachStateSlots lets F1-F10 load save state slots 1-10,
+// Shift+F1-F10 save them. Keys bound to controllers or keyboard
+// devices, like Family BASIC function keys, keep their bindings
+func (frontend *SdlFrontend) AttachStateSlots(states common.StateSlots) {
+	frontend.states = states
+}
+
+// AttachResetter lets Ctrl+R reset the console and Ctrl+Shift+R
+// power cycle it, unless R is bound to a controller or keyboard device
+func (frontend *SdlFrontend) AttachResetter(resetter common.Resetter) {
+	frontend.resetter = resetter
+}
+
+// AttachController lets keyboard and gamepads drive
+// controller of player 0-3
+func (frontend *SdlFrontend) AttachController(player int, pad common.Joypad) {
+	frontend.pads[player] = pad
+}
+
+// SetKeyMap replaces keyboard bindings of player 0-3 controller.
+// Only player 0 has bindings by default
+func (frontend *SdlFrontend) SetKeyMap(player int, keyMap KeyMap) {
+	frontend.keyMaps[player] = keyMap
+}
+
+// SetPadMaps sets bindings of gamepads by their name or GUID,
+// other pads use DefaultPadMap
+func (frontend *SdlFrontend) SetPadMaps(padMaps map[string]PadMap) {
+	frontend.padMaps = padMaps
+}
+
+// SetDeadzone sets fraction of analog stick range ignored
+// when converting it into d-pad directions
+func (frontend *SdlFrontend) SetDeadzone(deadzone float32) {
+	frontend.deadzone = deadzone
+}
+
+// AttachDiskDrive enables disk side switching (Tab key)
+func (frontend *SdlFrontend) AttachDiskDrive(disk common.DiskDrive) {
+	frontend.disk = disk
+}
+
+// AttachMusicPlayer shows track info and enables track
+// selection with Left/Right keys
+func (frontend *SdlFrontend) AttachMusicPlayer(player common.MusicPlayer) {
+	frontend.player = player
+}
+
+// AttachAudio plays samples of the source through the audio device
+func (frontend *SdlFrontend) AttachAudio(source common.AudioSource) {
+	frontend.audioSrc = source
+}
+
+// AttachAudioRecorder enables audio recording toggled with F12,
+// start is called to create every new recording
+func (frontend *SdlFrontend) AttachAudioRecorder(start func() (common.AudioRecorder, error)) {
+	frontend.startRecorder = start
+}
+
+// RecordAudio writes audio to the recorder until F12 is pressed or emulation ends
+func (frontend *SdlFrontend) RecordAudio(recorder common.AudioRecorder) {
+	frontend.recorder = recorder
+}
+
+// toggleRecording starts a new recording or finishes the current one
+func (frontend *SdlFrontend) toggleRecording() {
+	if frontend.recorder != nil {
+		if err := frontend.recorder.Close(); err != nil {
+			fmt.Println("Failed to write audio:", err)
+		}
+		frontend.recorder = nil
+		return
+	}
+	if frontend.startRecorder == nil {
+		return
+	}
+	recorder, err := frontend.startRecorder()
+	if err != nil {
+		fmt.Println("Failed to start recording:", err)
+		return
+	}
+	frontend.recorder = recorder
+}
+
+// boundKey reports whether the key drives a controller or keyboard device
+func (frontend *SdlFrontend) boundKey(key sdl.Keycode) bool {
+	if _, ok := frontend.keyDeviceMap[key]; ok && frontend.keyDevice != nil {
+		return true
+	}
+	for player, keyMap := range frontend.keyMaps {
+		if _, ok := keyMap[key]; ok && frontend.pads[player] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (frontend *SdlFrontend) useStateSlot(slot int, save bool) {
+	if save {
+		if err := frontend.states.SaveState(slot); err != nil {
+			fmt.Printf("Failed to save state %d: %v\n", slot, err)
+			return
+		}
+		fmt.Println("Saved state", slot)
+		return
+	}
+	if err := frontend.states.LoadState(slot); err != nil {
+		fmt.Printf("Failed to load state %d: %v\n", slot, err)
+		return
+	}
+	fmt.Println("Loaded state", slot)
 }
 
 func (frontend *SdlFrontend) renderText(textstr string, x int32, y int32) (err error) {
@@ -56,27 +236,85 @@ func (frontend *SdlFrontend) handleEvent(event sdl.Event) {
 		frontend.running = false
 		break
 	case *sdl.KeyboardEvent:
+		for player, keyMap := range frontend.keyMaps {
+			if button, ok := keyMap[t.Keysym.Sym]; ok && frontend.pads[player] != nil && t.Repeat == 0 {
+				frontend.pads[player].SetButton(button, t.State == sdl.PRESSED)
+			}
+		}
+		if button, ok := frontend.keyDeviceMap[t.Keysym.Sym]; ok && frontend.keyDevice != nil && t.Repeat == 0 {
+			frontend.keyDevice.SetButton(button, t.State == sdl.PRESSED)
+		}
 		if t.State == sdl.RELEASED {
 			if t.Keysym.Sym == sdl.K_LEFT {
-				// TODO:
+				if frontend.player != nil {
+					frontend.player.PrevTrack()
+				}
 			} else if t.Keysym.Sym == sdl.K_RIGHT {
-				// TODO:
+				if frontend.player != nil {
+					frontend.player.NextTrack()
+				}
 			}
-			if t.Keysym.Sym == sdl.K_UP {
-				// TODO:
-			} else if t.Keysym.Sym == sdl.K_DOWN {
-				// TODO:
-			} else if t.Keysym.Sym == sdl.K_SPACE {
-
-				// TODO
-				frontend.step()
+			if t.Keysym.Sym == sdl.K_PAUSE {
+				frontend.paused = !frontend.paused
+			} else if t.Keysym.Sym == sdl.K_SPACE && frontend.paused {
+				frontend.draw(frontend.emu.StepInstruction())
+			} else if t.Keysym.Sym == sdl.K_TAB && frontend.disk != nil {
+				frontend.disk.SwitchSide()
+			} else if t.Keysym.Sym == sdl.K_F12 {
+				frontend.toggleRecording()
+			} else if t.Keysym.Sym >= sdl.K_F1 && t.Keysym.Sym <= sdl.K_F10 && frontend.states != nil && !frontend.boundKey(t.Keysym.Sym) {
+				frontend.useStateSlot(int(t.Keysym.Sym-sdl.K_F1)+1, t.Keysym.Mod&sdl.KMOD_SHIFT != 0)
+			} else if t.Keysym.Sym == sdl.K_r && t.Keysym.Mod&sdl.KMOD_CTRL != 0 && frontend.resetter != nil && !frontend.boundKey(t.Keysym.Sym) {
+				frontend.resetter.Reset(t.Keysym.Mod&sdl.KMOD_SHIFT != 0)
 			}
 		}
 		break
+	case *sdl.MouseMotionEvent:
+		if frontend.gun != nil && t.State&sdl.ButtonRMask() == 0 {
+			frontend.gun.Aim(screenPoint(t.X, t.Y))
+		}
+	case *sdl.MouseButtonEvent:
+		if frontend.gun == nil {
+			break
+		}
+		pressed := t.State == sdl.PRESSED
+		switch t.Button {
+		case sdl.BUTTON_LEFT:
+			frontend.gun.SetTrigger(pressed)
+		case sdl.BUTTON_RIGHT:
+			if pressed {
+				frontend.gun.Aim(-1, -1)
+			} else {
+				frontend.gun.Aim(screenPoint(t.X, t.Y))
+			}
+			frontend.gun.SetTrigger(pressed)
+		}
+	case *sdl.ControllerDeviceEvent:
+		if t.Type == sdl.CONTROLLERDEVICEADDED {
+			frontend.addGamepad(int(t.Which))
+		} else if t.Type == sdl.CONTROLLERDEVICEREMOVED {
+			frontend.removeGamepad(t.Which)
+		}
+	case *sdl.ControllerButtonEvent:
+		frontend.gamepadButton(t.Which, sdl.GameControllerButton(t.Button), t.State == sdl.PRESSED)
+	case *sdl.ControllerAxisEvent:
+		frontend.gamepadAxis(t.Which, sdl.GameControllerAxis(t.Axis), t.Value)
 	}
 }
 
 func (frontend *SdlFrontend) RunSdlLoop() (err error) {
+	// Finish recording however the loop ends, CPU jam and other
+	// emulator failures are returned so the caller still writes
+	// save files
+	defer func() {
+		if r := recover(); r != nil {
+			err = nes.PanicError(r)
+		}
+		if frontend.recorder != nil {
+			frontend.toggleRecording()
+		}
+	}()
+
 	if err = ttf.Init(); err != nil {
 		return
 	}
@@ -87,6 +325,27 @@ func (frontend *SdlFrontend) RunSdlLoop() (err error) {
 	}
 	defer sdl.Quit()
 
+	// Pads connected at start are reported by device added events too
+	if err := sdl.InitSubSystem(sdl.INIT_GAMECONTROLLER); err != nil {
+		fmt.Println("Gamepads disabled:", err)
+	}
+	defer func() {
+		for id := range frontend.gamepads {
+			frontend.removeGamepad(id)
+		}
+	}()
+
+	// Emulation runs without sound when there is no audio device
+	if frontend.audioSrc != nil {
+		if err := sdl.InitSubSystem(sdl.INIT_AUDIO); err != nil {
+			fmt.Println("Audio disabled:", err)
+		} else if frontend.audio, err = openAudio(); err != nil {
+			fmt.Println("Audio disabled:", err)
+		} else {
+			defer frontend.audio.close()
+		}
+	}
+
 	if frontend.window, err = sdl.CreateWindow(windowTitle, sdl.WINDOWPOS_UNDEFINED,
 		sdl.WINDOWPOS_UNDEFINED, 800, 600, sdl.WINDOW_SHOWN); err != nil {
 		return
@@ -106,29 +365,32 @@ func (frontend *SdlFrontend) RunSdlLoop() (err error) {
 	frontend.window.UpdateSurface()
 
 	// Main loop
+	nextFrame := time.Now()
 	frontend.running = true
 	for frontend.running {
 		for event := sdl.PollEvent(); event != nil; event = sdl.PollEvent() {
 			frontend.handleEvent(event)
 		}
 
-		// TODO
-		frontend.step()
+		if !frontend.paused {
+			frontend.draw(frontend.emu.StepFrame())
+			frontend.playAudio()
+		}
 
-		sdl.Delay(16)
+		// Audio rate follows video, not the other way around
+		nextFrame = nextFrame.Add(frontend.frameTime)
+		if wait := time.Until(nextFrame); wait > 0 {
+			time.Sleep(wait)
+		} else {
+			nextFrame = time.Now()
+		}
 	}
 
 	return
 }
 
-func (frontend *SdlFrontend) step() {
-	// Perform CPU step
-	cpuState := frontend.cpuEmu.Step()
-
-	// Perform PPU step
-	ppuCycles := cpuState.Cycles * 3
-	frontend.ppuEmu.Step(ppuCycles)
-
+// draw shows the picture and CPU state after the last instruction
+func (frontend *SdlFrontend) draw(cpuState nes.CpuState) {
 	// Extract debug info
 	opName := strings.Split(cpuState.LastOp.GetOpHandlerName(cpuState.LastOp.Handler), ".")[1]
 
@@ -138,5 +400,68 @@ func (frontend *SdlFrontend) step() {
 		opName, cpuState.PC, cpuState.P, cpuState.S, cpuState.A, cpuState.A, cpuState.X, cpuState.X, cpuState.Y, cpuState.Y)
 
 	frontend.surface.FillRect(nil, 0)
+	if err := frontend.drawScreen(); err != nil {
+		fmt.Println("Failed to draw picture:", err)
+	}
 	frontend.renderText(cpuDebugText, 10, 10)
+
+	if frontend.player != nil {
+		trackText := fmt.Sprintf("Track %d/%d %s", frontend.player.Track(),
+			frontend.player.TrackCount(), frontend.player.TrackName())
+		frontend.renderText(frontend.player.Title()+" - "+frontend.player.Artist(), 10, 40)
+		frontend.renderText(trackText, 10, 70)
+	}
+
+	if frontend.disk != nil {
+		diskText := "Disk: ejected"
+		if side := frontend.disk.CurrentSide(); side >= 0 {
+			diskText = fmt.Sprintf("Disk: %d/%d (Tab to switch)", side+1, frontend.disk.SideCount())
+		}
+		frontend.renderText(diskText, 10, 40)
+	}
+}
+
+// drawScreen copies PPU picture into the window
+func (frontend *SdlFrontend) drawScreen() error {
+	img := frontend.emu.Frame()
+	bounds := img.Bounds()
+	picture, err := sdl.CreateRGBSurfaceWithFormatFrom(unsafe.Pointer(&img.Pix[0]),
+		int32(bounds.Dx()), int32(bounds.Dy()), 32, int32(img.Stride), sdl.PIXELFORMAT_ABGR8888)
+	if err != nil {
+		return err
+	}
+	defer picture.Free()
+
+	dst := &sdl.Rect{X: screenX, Y: screenY, W: int32(bounds.Dx()) * screenScale, H: int32(bounds.Dy()) * screenScale}
+	return picture.BlitScaled(nil, frontend.surface, dst)
+}
+
+// screenPoint converts window coordinates into picture pixel
+func screenPoint(x, y int32) (int, int) {
+	if x < screenX || y < screenY {
+		return -1, -1
+	}
+	return int(x-screenX) / screenScale, int(y-screenY) / screenScale
+}
+
+// playAudio passes samples produced during the frame to the audio device
+func (frontend *SdlFrontend) playAudio() {
+	if frontend.audioSrc == nil {
+		return
+	}
+	if frontend.player != nil {
+		frontend.audioSrc.SetMasterVolume(frontend.player.Volume())
+	}
+
+	samples := frontend.audioSrc.Samples()
+	if frontend.recorder != nil {
+		if err := frontend.recorder.Write(); err != nil {
+			fmt.Println("Failed to write audio:", err)
+			frontend.toggleRecording()
+		}
+	}
+	if frontend.audio != nil {
+		frontend.audio.ring.push(samples)
+		frontend.audioSrc.SetRateAdjust(frontend.audio.rateAdjust())
+	}
 }
@@ -0,0 +1,186 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+
+	"darknes/nes"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+const (
+	// Stick deflection below this fraction is ignored
+	defaultDeadzone = 0.3
+)
+
+// PadMap binds gamepad buttons to controller buttons
+type PadMap map[sdl.GameControllerButton]int
+
+// DefaultPadMap returns bindings matching button labels of most pads
+func DefaultPadMap() PadMap {
+	return PadMap{
+		sdl.CONTROLLER_BUTTON_A:          nes.ButtonA,
+		sdl.CONTROLLER_BUTTON_B:          nes.ButtonB,
+		sdl.CONTROLLER_BUTTON_BACK:       nes.ButtonSelect,
+		sdl.CONTROLLER_BUTTON_START:      nes.ButtonStart,
+		sdl.CONTROLLER_BUTTON_DPAD_UP:    nes.ButtonUp,
+		sdl.CONTROLLER_BUTTON_DPAD_DOWN:  nes.ButtonDown,
+		sdl.CONTROLLER_BUTTON_DPAD_LEFT:  nes.ButtonLeft,
+		sdl.CONTROLLER_BUTTON_DPAD_RIGHT: nes.ButtonRight,
+	}
+}
+
+// Parse rebinds buttons from comma separated button=padbutton pairs,
+// e.g. "a=b,b=a". Pad buttons are named as SDL names them (a, b, x, y,
+// back, start, leftshoulder, dpup...)
+func (pm PadMap) Parse(spec string) error {
+	for _, pair := range strings.Split(spec, ",") {
+		name, padName, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return fmt.Errorf("pad binding %q is not button=padbutton", pair)
+		}
+		button := buttonByName(name)
+		if button < 0 {
+			return fmt.Errorf("unknown button %s", name)
+		}
+		padButton := sdl.GameControllerGetButtonFromString(padName)
+		if padButton == sdl.CONTROLLER_BUTTON_INVALID {
+			return fmt.Errorf("unknown pad button %s", padName)
+		}
+
+		for b, nesButton := range pm {
+			if nesButton == button {
+				delete(pm, b)
+			}
+		}
+		pm[padButton] = button
+	}
+	return nil
+}
+
+// ParsePadMaps parses per-device bindings separated by semicolons:
+// "device:bindings;device:bindings". Device is matched against
+// pad name or GUID, bindings are in PadMap.Parse format
+func ParsePadMaps(spec string) (map[string]PadMap, error) {
+	maps := map[string]PadMap{}
+	for _, entry := range strings.Split(spec, ";") {
+		device, bindings, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("pad mapping %q is not device:bindings", entry)
+		}
+		padMap := DefaultPadMap()
+		if err := padMap.Parse(bindings); err != nil {
+			return nil, fmt.Errorf("%s: %w", device, err)
+		}
+		maps[strings.ToLower(strings.TrimSpace(device))] = padMap
+	}
+	return maps, nil
+}
+
+// gamepad is a connected game controller driving one of the players
+type gamepad struct {
+	controller *sdl.GameController
+	player     int
+	padMap     PadMap
+
+	// Buttons pressed on the pad and directions of the analog stick
+	// are tracked separately, either of them presses the button
+	pressed [nes.ButtonCount]bool
+	stick   [nes.ButtonCount]bool
+}
+
+func (pad *gamepad) button(button int) bool {
+	return pad.pressed[button] || pad.stick[button]
+}
+
+// addGamepad opens newly connected pad and assigns it to a free player
+func (frontend *SdlFrontend) addGamepad(index int) {
+	player := -1
+	for p := range frontend.pads {
+		if frontend.pads[p] != nil && frontend.gamepadOf(p) == nil {
+			player = p
+			break
+		}
+	}
+	if player < 0 {
+		return
+	}
+
+	controller := sdl.GameControllerOpen(index)
+	if controller == nil {
+		fmt.Println("Failed to open gamepad:", sdl.GetError())
+		return
+	}
+	guid := sdl.JoystickGetGUIDString(sdl.JoystickGetDeviceGUID(index))
+	padMap, ok := frontend.padMaps[strings.ToLower(guid)]
+	if !ok {
+		if padMap, ok = frontend.padMaps[strings.ToLower(controller.Name())]; !ok {
+			padMap = DefaultPadMap()
+		}
+	}
+
+	id := controller.Joystick().InstanceID()
+	frontend.gamepads[id] = &gamepad{controller: controller, player: player, padMap: padMap}
+	fmt.Printf("Gamepad %s connected as player %d\n", controller.Name(), player+1)
+}
+
+// removeGamepad releases buttons held on disconnected pad
+func (frontend *SdlFrontend) removeGamepad(id sdl.JoystickID) {
+	pad, ok := frontend.gamepads[id]
+	if !ok {
+		return
+	}
+	for button := 0; button < nes.ButtonCount; button++ {
+		if pad.button(button) {
+			frontend.pads[pad.player].SetButton(button, false)
+		}
+	}
+	fmt.Printf("Gamepad %s of player %d disconnected\n", pad.controller.Name(), pad.player+1)
+	pad.controller.Close()
+	delete(frontend.gamepads, id)
+}
+
+func (frontend *SdlFrontend) gamepadOf(player int) *gamepad {
+	for _, pad := range frontend.gamepads {
+		if pad.player == player {
+			return pad
+		}
+	}
+	return nil
+}
+
+func (frontend *SdlFrontend) gamepadButton(id sdl.JoystickID, padButton sdl.GameControllerButton, pressed bool) {
+	pad, ok := frontend.gamepads[id]
+	if !ok {
+		return
+	}
+	if button, ok := pad.padMap[padButton]; ok {
+		pad.pressed[button] = pressed
+		frontend.pads[pad.player].SetButton(button, pad.button(button))
+	}
+}
+
+// gamepadAxis converts left stick position into d-pad directions
+func (frontend *SdlFrontend) gamepadAxis(id sdl.JoystickID, axis sdl.GameControllerAxis, value int16) {
+	pad, ok := frontend.gamepads[id]
+	if !ok {
+		return
+	}
+	var negative, positive int
+	switch axis {
+	case sdl.CONTROLLER_AXIS_LEFTX:
+		negative, positive = nes.ButtonLeft, nes.ButtonRight
+	case sdl.CONTROLLER_AXIS_LEFTY:
+		negative, positive = nes.ButtonUp, nes.ButtonDown
+	default:
+		return
+	}
+
+	threshold := int(frontend.deadzone * 32767)
+	pad.stick[negative] = int(value) < -threshold
+	pad.stick[positive] = int(value) > threshold
+	for _, button := range []int{negative, positive} {
+		frontend.pads[pad.player].SetButton(button, pad.button(button))
+	}
+}
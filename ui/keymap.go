@@ -0,0 +1,111 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+
+	"darknes/nes"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// KeyMap binds keyboard keys to controller buttons
+type KeyMap map[sdl.Keycode]int
+
+// DefaultKeyMap returns bindings: arrows, X - A, Z - B,
+// Right Shift - Select, Return - Start
+func DefaultKeyMap() KeyMap {
+	return KeyMap{
+		sdl.K_x:      nes.ButtonA,
+		sdl.K_z:      nes.ButtonB,
+		sdl.K_RSHIFT: nes.ButtonSelect,
+		sdl.K_RETURN: nes.ButtonStart,
+		sdl.K_UP:     nes.ButtonUp,
+		sdl.K_DOWN:   nes.ButtonDown,
+		sdl.K_LEFT:   nes.ButtonLeft,
+		sdl.K_RIGHT:  nes.ButtonRight,
+	}
+}
+
+// DefaultMatKeyMap binds Power Pad buttons 1-12 to the keyboard grid:
+// R T Y U, F G H J, V B N M
+func DefaultMatKeyMap() KeyMap {
+	keys := []sdl.Keycode{
+		sdl.K_r, sdl.K_t, sdl.K_y, sdl.K_u,
+		sdl.K_f, sdl.K_g, sdl.K_h, sdl.K_j,
+		sdl.K_v, sdl.K_b, sdl.K_n, sdl.K_m,
+	}
+	km := KeyMap{}
+	for button, key := range keys {
+		km[key] = button
+	}
+	return km
+}
+
+// Host keys for Family BASIC keys named differently by SDL
+var familyHostKeys = map[string]string{
+	"Stop":     "End",
+	"Yen":      "\\",
+	"RShift":   "Right Shift",
+	"LShift":   "Left Shift",
+	"Kana":     "Right Alt",
+	"Ctrl":     "Left Ctrl",
+	"Esc":      "Escape",
+	"Grph":     "Left Alt",
+	"Clr Home": "Home",
+	"Ins":      "Insert",
+	"Del":      "Delete",
+}
+
+// FamilyKeyboardKeyMap binds host keys to Family BASIC keys
+// with the same labels
+func FamilyKeyboardKeyMap() KeyMap {
+	km := KeyMap{}
+	for key, name := range nes.FamilyKeyNames {
+		if hostName, ok := familyHostKeys[name]; ok {
+			name = hostName
+		}
+		if code := sdl.GetKeyFromName(name); code != sdl.K_UNKNOWN {
+			km[code] = key
+		}
+	}
+	return km
+}
+
+// Parse rebinds buttons from comma separated button=key pairs,
+// e.g. "a=S,b=A,start=Space". Keys are named as SDL names them
+func (km KeyMap) Parse(spec string) error {
+	for _, pair := range strings.Split(spec, ",") {
+		name, keyName, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return fmt.Errorf("key binding %q is not button=key", pair)
+		}
+		button := buttonByName(name)
+		if button < 0 {
+			return fmt.Errorf("unknown button %s", name)
+		}
+		key := sdl.GetKeyFromName(keyName)
+		if key == sdl.K_UNKNOWN {
+			return fmt.Errorf("unknown key %s", keyName)
+		}
+
+		// Button is bound to a single key
+		for k, b := range km {
+			if b == button {
+				delete(km, k)
+			}
+		}
+		km[key] = button
+	}
+	return nil
+}
+
+// buttonByName returns controller button with the given name or -1
+func buttonByName(name string) int {
+	for button, buttonName := range nes.ButtonNames {
+		if strings.EqualFold(name, buttonName) {
+			return button
+		}
+	}
+	return -1
+}